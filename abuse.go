@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// defaultBlockedEmailDomains are well known disposable email providers.
+const defaultBlockedEmailDomains = "mailinator.com,guerrillamail.com,10minutemail.com,tempmail.com,temp-mail.org," +
+	"yopmail.com,trashmail.com,sharklasers.com,getnada.com,dispostable.com,maildrop.cc,throwawaymail.com"
+
+// spamThreshold is the content score at which a message is rejected.
+const spamThreshold = 5
+
+// Submission is a post of one of the public forms.
+type Submission struct {
+	Form  string // contact, subscribe, register, review, question or answer
+	IP    string
+	Email string
+	Text  string // free text worth scoring, if the form has any
+	r     *http.Request
+}
+
+// AbuseCheck inspects a submission and returns the reason for rejecting
+// it, or "" to let it through. Returning an error instead lets a check
+// choose how the rejection is reported to the client.
+type AbuseCheck interface {
+	Name() string
+	Check(s Submission) (reason string, err error)
+}
+
+// abuseChecks run in order on every public form post; the cheap ones
+// come first.
+var abuseChecks = []AbuseCheck{
+	honeypotCheck{},
+	submitTimeCheck{},
+	ipLimit,
+	emailLimit,
+	disposableEmailCheck{},
+	spamScoreCheck{},
+}
+
+var (
+	ipLimit = &rateLimit{
+		name:  "ip_rate",
+		limit: func() int { return config.IPSubmitLimit },
+		key:   func(s Submission) string { return s.IP },
+	}
+	emailLimit = &rateLimit{
+		name:  "email_rate",
+		limit: func() int { return config.EmailSubmitLimit },
+		key:   func(s Submission) string { return strings.ToLower(s.Email) },
+	}
+)
+
+// AbuseRejection records a submission an abuse check refused, so admins
+// can spot false positives.
+type AbuseRejection struct {
+	Id      int64     `db:"Id"`
+	Form    string    `db:"Form,size:32"`
+	Check   string    `db:"CheckName,size:32"`
+	Reason  string    `db:"Reason"`
+	IP      string    `db:"IP,size:64"`
+	Email   string    `db:"Email"`
+	Text    string    `db:"Text,size:65535"`
+	Created time.Time `db:"Created"`
+}
+
+// newSubmission collects what the abuse checks need from a form post.
+func newSubmission(r *http.Request, form, email, text string) Submission {
+	return Submission{Form: form, IP: clientIP(r), Email: strings.TrimSpace(email), Text: text, r: r}
+}
+
+// checkAbuse runs s through abuseChecks and records the first rejection.
+// The error is ready to be returned from a handler.
+func checkAbuse(s Submission) error {
+	for _, check := range abuseChecks {
+		reason, err := check.Check(s)
+		if reason == "" && err == nil {
+			continue
+		}
+		if reason == "" {
+			reason = err.Error()
+		}
+		if err == nil {
+			err = Validation("Sorry, your submission looks like spam. Please reload the page and try again, or email us instead.")
+		}
+		abuseRejections.WithLabelValues(s.Form, check.Name()).Inc()
+		logger.Warn(s.r.Context(), "submission rejected", Fields{"form": s.Form, "check": check.Name(), "reason": reason, "ip": s.IP})
+		rej := AbuseRejection{
+			Form:    s.Form,
+			Check:   check.Name(),
+			Reason:  truncate(reason, 255),
+			IP:      s.IP,
+			Email:   truncate(s.Email, 255),
+			Text:    truncate(s.Text, 4000),
+			Created: time.Now(),
+		}
+		if ierr := dbFor(s.r).Insert(&rej); ierr != nil {
+			logger.Error(s.r.Context(), "rejection not recorded", Fields{"error": ierr})
+		}
+		return err
+	}
+	return nil
+}
+
+// clientIP is the address of the client, trusting X-Forwarded-For only
+// when the site is configured to run behind a proxy. The proxy appends
+// the address it saw, so the last entry is the only one the client
+// cannot forge.
+func clientIP(r *http.Request) string {
+	if config.TrustProxy {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			hops := strings.Split(fwd, ",")
+			if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// honeypotField is hidden from people, so anything typed into it came
+// from a bot filling in every input.
+const honeypotField = "website"
+
+// guardFields are the formGuard inputs. bind copies them from a JSON
+// body into the form values, so the checks read them the same way.
+var guardFields = []string{honeypotField, "form_ts"}
+
+// formTimestamp is the signed render time the submit time check expects.
+func formTimestamp() string {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	return ts + "." + signToken("form", ts)
+}
+
+// formGuard renders the hidden inputs the honeypot and submit time
+// checks rely on. Every public form includes it.
+func formGuard() template.HTML {
+	return template.HTML(`<div style="position:absolute;left:-10000px" aria-hidden="true">` +
+		`<input type="text" name="` + honeypotField + `" tabindex="-1" autocomplete="off"></div>` +
+		`<input type="hidden" name="form_ts" value="` + formTimestamp() + `">`)
+}
+
+// FormTokenHandler gives JSON clients the form_ts value a rendered form
+// would carry, to post along with their submission.
+func FormTokenHandler(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return json.NewEncoder(w).Encode(map[string]string{"form_ts": formTimestamp()})
+}
+
+type honeypotCheck struct{}
+
+func (honeypotCheck) Name() string { return "honeypot" }
+
+func (honeypotCheck) Check(s Submission) (string, error) {
+	if s.r.FormValue(honeypotField) != "" {
+		return "honeypot field filled in", nil
+	}
+	return "", nil
+}
+
+// submitTimeCheck rejects forms posted faster than a person could fill
+// them in, using the signed render time from formGuard.
+type submitTimeCheck struct{}
+
+func (submitTimeCheck) Name() string { return "submit_time" }
+
+func (submitTimeCheck) Check(s Submission) (string, error) {
+	parts := strings.SplitN(s.r.FormValue("form_ts"), ".", 2)
+	if len(parts) != 2 || !verifyToken("form", parts[0], parts[1]) {
+		return "missing or forged form timestamp", nil
+	}
+	unix, _ := strconv.ParseInt(parts[0], 10, 64)
+	elapsed := time.Since(time.Unix(unix, 0))
+	if elapsed < config.SubmitMinTime {
+		return "submitted after " + elapsed.String(), nil
+	}
+	if elapsed > 24*time.Hour {
+		return "", Validation("This form has expired, please reload the page and try again.")
+	}
+	return "", nil
+}
+
+type disposableEmailCheck struct{}
+
+func (disposableEmailCheck) Name() string { return "disposable_email" }
+
+func (disposableEmailCheck) Check(s Submission) (string, error) {
+	at := strings.LastIndex(s.Email, "@")
+	if at < 0 {
+		return "", nil
+	}
+	domain := strings.ToLower(s.Email[at+1:])
+	for _, blocked := range config.BlockedEmailDomains {
+		if domain == blocked || strings.HasSuffix(domain, "."+blocked) {
+			return "disposable domain " + domain, Validation("Please use a permanent email address.")
+		}
+	}
+	return "", nil
+}
+
+// spamWords are phrases that hardly ever appear in a genuine message to
+// a shop.
+var spamWords = []string{"viagra", "casino", "crypto", "bitcoin", "loan", "seo services", "backlinks",
+	"click here", "buy now", "earn money", "work from home", "100% free", "winner", "porn"}
+
+type spamScoreCheck struct{}
+
+func (spamScoreCheck) Name() string { return "spam_score" }
+
+func (spamScoreCheck) Check(s Submission) (string, error) {
+	if score := spamScore(s.Text); score >= spamThreshold {
+		return "spam score " + strconv.Itoa(score), nil
+	}
+	return "", nil
+}
+
+// spamScore adds up a few cheap signals: links, spammy phrases and
+// shouting.
+func spamScore(text string) int {
+	lower := strings.ToLower(text)
+	score := 2 * (strings.Count(lower, "http://") + strings.Count(lower, "https://") + strings.Count(lower, "www."))
+	score += 3 * strings.Count(lower, "[url")
+	for _, word := range spamWords {
+		if strings.Contains(lower, word) {
+			score += 2
+		}
+	}
+	var letters, upper int
+	for _, c := range text {
+		if unicode.IsLetter(c) {
+			letters++
+			if unicode.IsUpper(c) {
+				upper++
+			}
+		}
+	}
+	if letters >= 20 && upper*10 > letters*7 {
+		score += 2
+	}
+	return score
+}
+
+// rateLimit allows a number of submissions per key in a sliding hour.
+// The counts live in memory, so every instance limits on its own.
+type rateLimit struct {
+	name  string
+	limit func() int
+	key   func(s Submission) string
+
+	mu   sync.Mutex
+	hits map[string][]time.Time
+}
+
+const rateWindow = time.Hour
+
+func (l *rateLimit) Name() string { return l.name }
+
+func (l *rateLimit) Check(s Submission) (string, error) {
+	key := l.key(s)
+	if key == "" {
+		return "", nil
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.hits == nil {
+		l.hits = map[string][]time.Time{}
+	}
+	hits := recent(l.hits[key], now)
+	if len(hits) >= l.limit() {
+		l.hits[key] = hits
+		return "over " + strconv.Itoa(l.limit()) + " submissions per hour", RateLimited("Too many submissions, please try again later.")
+	}
+	l.hits[key] = append(hits, now)
+	return "", nil
+}
+
+// prune forgets keys with no submissions in the window.
+func (l *rateLimit) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, hits := range l.hits {
+		if hits = recent(hits, now); len(hits) == 0 {
+			delete(l.hits, key)
+		} else {
+			l.hits[key] = hits
+		}
+	}
+}
+
+func recent(hits []time.Time, now time.Time) []time.Time {
+	i := 0
+	for i < len(hits) && now.Sub(hits[i]) > rateWindow {
+		i++
+	}
+	return hits[i:]
+}
+
+// pruneRateLimits is run as a job so the limiters do not grow forever.
+func pruneRateLimits(ctx context.Context) error {
+	now := time.Now()
+	ipLimit.prune(now)
+	emailLimit.prune(now)
+	return nil
+}
+
+type AbuseAdmin struct {
+	Form       string
+	Forms      []string
+	Rejections []AbuseRejection
+}
+
+type AbuseAdminPage struct {
+	User    string
+	Content AbuseAdmin
+}
+
+// ManageAbuseHandler lists recently rejected submissions.
+func ManageAbuseHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	a := AbuseAdmin{Form: r.FormValue("form")}
+	db := dbFor(r)
+	if _, err := db.Select(&a.Forms, "SELECT DISTINCT Form FROM abuserejections ORDER BY Form"); err != nil {
+		return Internal(err, "Rejected submissions are unavailable right now.")
+	}
+	query, args := "SELECT * FROM abuserejections", []interface{}{}
+	if a.Form != "" {
+		query, args = query+" WHERE Form=?", append(args, a.Form)
+	}
+	if _, err := db.Select(&a.Rejections, query+" ORDER BY Id DESC LIMIT 200", args...); err != nil {
+		return Internal(err, "Rejected submissions are unavailable right now.")
+	}
+	return renderer.Render(w, r, "manage_abuse", AbuseAdminPage{User: getStringFromSession(r, "User"), Content: a})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	tests := []struct {
+		trustProxy bool
+		forwarded  string
+		want       string
+	}{
+		{false, "", "192.0.2.1"},
+		{false, "203.0.113.7", "192.0.2.1"},
+		{true, "", "192.0.2.1"},
+		{true, "203.0.113.7", "203.0.113.7"},
+		// The client can send its own header; the proxy appends the
+		// address it saw.
+		{true, "10.0.0.1, 203.0.113.7", "203.0.113.7"},
+		{true, "10.0.0.1,203.0.113.7 ", "203.0.113.7"},
+		{true, "10.0.0.1, ", "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		config.TrustProxy = tt.trustProxy
+		r := httptest.NewRequest("POST", "/contact/", nil)
+		r.RemoteAddr = "192.0.2.1:4321"
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("clientIP(trust %v, %q) = %q, want %q", tt.trustProxy, tt.forwarded, got, tt.want)
+		}
+	}
+}
+
+func TestSpamScore(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"Do you ship the drill to Canada?", 0},
+		{"See https://example.com and www.example.com", 4},
+		{"[url=http://x]cheap[/url]", 5},
+		{"Buy now, casino bonus!", 4},
+		{"WHY HAS MY ORDER NOT ARRIVED YET", 2},
+		{"OK", 0},
+	}
+	for _, tt := range tests {
+		if got := spamScore(tt.text); got != tt.want {
+			t.Errorf("spamScore(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	gmux "github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Profile is the part of a User customers edit themselves. The username
+// is their email address and cannot be changed.
+type Profile struct {
+	Name  string `form:"name" validate:"max=100"`
+	Phone string `form:"phone" validate:"phone"`
+}
+
+// PasswordChange is the new password of the security form; the current
+// password and the confirmation are compared as typed.
+type PasswordChange struct {
+	Password string `form:"password" label:"New password" validate:"required,password"`
+}
+
+// WishlistItem is a product a customer saved for later.
+type WishlistItem struct {
+	Id        int64     `db:"Id"`
+	Username  string    `db:"Username"`
+	ProductId int64     `db:"ProductId"`
+	Added     time.Time `db:"Added"`
+}
+
+// accountForms are the forms on the account page. A rejected post is
+// shown again with what was wrong with it.
+type accountForms struct {
+	Profile     Profile
+	ProfileErr  error
+	PasswordErr error
+}
+
+type Account struct {
+	User            User
+	Profile         Profile
+	ShippingAddress *Address
+	BillingAddress  *Address
+	Addresses       int
+	Orders          []Order // the latest accountOrders
+	Wishlist        []ProductLink
+	Newsletter      string // the subscriber status of the username, if any
+	Saved           string // the section just saved, for the notice
+	ProfileError    string
+	ProfileFields   map[string]string
+	PasswordError   string
+	PasswordFields  map[string]string
+}
+
+// accountOrders is how many orders the account page lists.
+const accountOrders = 10
+
+type AccountPage struct {
+	User    string
+	Content Account
+}
+
+func loadUser(r *http.Request, username string) (*User, error) {
+	obj, err := dbFor(r).Get(User{}, username)
+	if err != nil {
+		return nil, Internal(err, "Your account is unavailable right now.")
+	}
+	if obj == nil {
+		return nil, Unauthorized("Please log in first.")
+	}
+	return obj.(*User), nil
+}
+
+// wishlist returns the products username saved, newest first.
+func wishlist(db *meteredDbMap, username string) ([]Product, error) {
+	var products []Product
+	_, err := db.Select(&products, "SELECT p.* FROM products p JOIN wishlist w ON w.ProductId=p.Id "+
+		"WHERE w.Username=? ORDER BY w.Added DESC, w.Id DESC", username)
+	return products, err
+}
+
+func onWishlist(db *meteredDbMap, username string, productId int64) (bool, error) {
+	count, err := db.SelectInt("SELECT count(*) FROM wishlist WHERE Username=? AND ProductId=?", username, productId)
+	return count > 0, err
+}
+
+func renderAccount(w http.ResponseWriter, r *http.Request, status int, username string, forms accountForms) error {
+	user, err := loadUser(r, username)
+	if err != nil {
+		return err
+	}
+	db := dbFor(r)
+	a := Account{User: *user, Profile: forms.Profile, Saved: r.FormValue("saved")}
+	if forms.ProfileErr == nil {
+		a.Profile = Profile{Name: user.Name, Phone: user.Phone}
+	}
+	if a.ShippingAddress, err = defaultAddress(db, username, "shipping"); err != nil {
+		return Internal(err, "Your account is unavailable right now.")
+	}
+	if a.BillingAddress, err = defaultAddress(db, username, "billing"); err != nil {
+		return Internal(err, "Your account is unavailable right now.")
+	}
+	count, err := db.SelectInt("SELECT count(*) FROM addresses WHERE Username=?", username)
+	if err != nil {
+		return Internal(err, "Your account is unavailable right now.")
+	}
+	a.Addresses = int(count)
+	if _, err := db.Select(&a.Orders, "SELECT * FROM orders WHERE Username=? ORDER BY Created DESC, Id DESC LIMIT ?", username, accountOrders); err != nil {
+		return Internal(err, "Your account is unavailable right now.")
+	}
+	products, err := wishlist(db, username)
+	if err != nil {
+		return Internal(err, "Your account is unavailable right now.")
+	}
+	pr, err := pricerFor(r)
+	if err != nil {
+		return err
+	}
+	for _, p := range products {
+		a.Wishlist = append(a.Wishlist, ProductLink{Product: p, Price: pr.Price(p), Was: pr.Was(p), URL: productPath(p)})
+	}
+	var subs []Subscriber
+	if _, err := db.Select(&subs, "SELECT * FROM subscribers WHERE Email=?", username); err != nil {
+		return Internal(err, "Your account is unavailable right now.")
+	}
+	if len(subs) > 0 {
+		a.Newsletter = subs[0].Status
+	}
+	if forms.ProfileErr != nil {
+		errs := formErrors(forms.ProfileErr)
+		a.ProfileError, a.ProfileFields = errs.Error, errs.Fields
+	}
+	if forms.PasswordErr != nil {
+		errs := formErrors(forms.PasswordErr)
+		a.PasswordError, a.PasswordFields = errs.Error, errs.Fields
+	}
+	return renderer.RenderStatus(w, r, status, "account", AccountPage{User: username, Content: a})
+}
+
+// AccountHandler shows the customer's profile, orders, addresses,
+// wishlist, newsletter subscription and security settings.
+func AccountHandler(w http.ResponseWriter, r *http.Request) error {
+	username, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+	return renderAccount(w, r, http.StatusOK, username, accountForms{})
+}
+
+// SaveProfileHandler updates the customer's name and phone number.
+func SaveProfileHandler(w http.ResponseWriter, r *http.Request) error {
+	username, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+	user, err := loadUser(r, username)
+	if err != nil {
+		return err
+	}
+	profile := Profile{}
+	if err := bind(r, &profile); err != nil {
+		return renderAccount(w, r, http.StatusBadRequest, username, accountForms{Profile: profile, ProfileErr: err})
+	}
+	user.Name, user.Phone = profile.Name, profile.Phone
+	if _, err := dbFor(r).Update(user); err != nil {
+		return Internal(err, "Your profile could not be saved.")
+	}
+	http.Redirect(w, r, "/account/?saved=profile", http.StatusSeeOther)
+	return nil
+}
+
+// ChangePasswordHandler sets a new password once the current one has been
+// given.
+func ChangePasswordHandler(w http.ResponseWriter, r *http.Request) error {
+	username, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+	user, err := loadUser(r, username)
+	if err != nil {
+		return err
+	}
+	reject := func(field, msg string) error {
+		err := &AppError{Kind: KindValidation, Message: msg, Fields: map[string]string{field: msg}}
+		return renderAccount(w, r, http.StatusBadRequest, username, accountForms{PasswordErr: err})
+	}
+	if bcrypt.CompareHashAndPassword(user.Secret, []byte(r.FormValue("current"))) != nil {
+		return reject("current", "Your current password is not correct.")
+	}
+	change := PasswordChange{}
+	if err := bind(r, &change); err != nil {
+		return renderAccount(w, r, http.StatusBadRequest, username, accountForms{PasswordErr: err})
+	}
+	if r.FormValue("confirm") != change.Password {
+		return reject("confirm", "The new passwords do not match.")
+	}
+	secret, err := bcrypt.GenerateFromPassword([]byte(change.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return Internal(err, "Your password could not be changed, please try again later.")
+	}
+	user.Secret = secret
+	if _, err := dbFor(r).Update(user); err != nil {
+		return Internal(err, "Your password could not be changed, please try again later.")
+	}
+	logger.Info(r.Context(), "password changed", Fields{"user": username})
+	http.Redirect(w, r, "/account/?saved=password", http.StatusSeeOther)
+	return nil
+}
+
+// AccountNewsletterHandler subscribes the customer's email address, with
+// the usual confirmation email, or unsubscribes it straight away.
+func AccountNewsletterHandler(w http.ResponseWriter, r *http.Request) error {
+	username, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+	switch r.FormValue("action") {
+	case "subscribe":
+		if err := requestSubscription(dbFor(r), username); err != nil {
+			return err
+		}
+	case "unsubscribe":
+		if _, err := dbFor(r).Exec("UPDATE subscribers SET Status=? WHERE Email=?", SubscriberUnsubscribed, username); err != nil {
+			return Internal(err, "Your subscription could not be updated, please try again later.")
+		}
+	default:
+		return Validation("Unknown newsletter action %q.", r.FormValue("action"))
+	}
+	http.Redirect(w, r, "/account/?saved=newsletter", http.StatusSeeOther)
+	return nil
+}
+
+// AddToWishlistHandler saves product_id to the customer's wishlist and
+// sends them back to the page they came from.
+func AddToWishlistHandler(w http.ResponseWriter, r *http.Request) error {
+	username, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+	id, err := strconv.ParseInt(r.FormValue("product_id"), 10, 64)
+	if err != nil {
+		return Validation("Invalid product id %q.", r.FormValue("product_id"))
+	}
+	obj, err := dbFor(r).Get(Product{}, id)
+	if err != nil {
+		return Internal(err, "Your wishlist could not be updated.")
+	}
+	if obj == nil {
+		return NotFound("Product %d does not exist.", id)
+	}
+	saved, err := onWishlist(dbFor(r), username, id)
+	if err != nil {
+		return Internal(err, "Your wishlist could not be updated.")
+	}
+	if !saved {
+		if err := dbFor(r).Insert(&WishlistItem{Username: username, ProductId: id, Added: time.Now()}); err != nil {
+			return Internal(err, "Your wishlist could not be updated.")
+		}
+	}
+	http.Redirect(w, r, backPath(r), http.StatusSeeOther)
+	return nil
+}
+
+// RemoveFromWishlistHandler takes product {id} off the customer's
+// wishlist.
+func RemoveFromWishlistHandler(w http.ResponseWriter, r *http.Request) error {
+	username, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+	id, _ := strconv.ParseInt(gmux.Vars(r)["id"], 10, 64)
+	if _, err := dbFor(r).Exec("DELETE FROM wishlist WHERE Username=? AND ProductId=?", username, id); err != nil {
+		return Internal(err, "Your wishlist could not be updated.")
+	}
+	http.Redirect(w, r, backPath(r), http.StatusSeeOther)
+	return nil
+}
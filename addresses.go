@@ -0,0 +1,316 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	gmux "github.com/gorilla/mux"
+)
+
+// Address is one entry in a customer's address book. Checkout picks the
+// defaults unless the customer chooses another one.
+type Address struct {
+	Id              int64     `db:"Id"`
+	Username        string    `db:"Username"`
+	Name            string    `db:"Name" form:"name" label:"Full name" validate:"required,max=100"`
+	Company         string    `db:"Company" form:"company" validate:"max=100"`
+	Line1           string    `db:"Line1" form:"line1" label:"Address" validate:"required,max=255"`
+	Line2           string    `db:"Line2" form:"line2" label:"Address line 2" validate:"max=255"`
+	City            string    `db:"City" form:"city" validate:"required,max=100"`
+	Region          string    `db:"Region" form:"region" validate:"max=100"`
+	PostalCode      string    `db:"PostalCode,size:20" form:"postal_code" label:"Postal code" validate:"max=20"`
+	Country         string    `db:"Country,size:2" form:"country" validate:"required"` // ISO 3166-1 alpha-2
+	Phone           string    `db:"Phone,size:16" form:"phone" validate:"phone"`
+	DefaultShipping bool      `db:"DefaultShipping" form:"default_shipping"`
+	DefaultBilling  bool      `db:"DefaultBilling" form:"default_billing"`
+	Created         time.Time `db:"Created"`
+	Updated         time.Time `db:"Updated"`
+}
+
+// countryFormat says how addresses are written in a country. Line is the
+// city line with {city}, {region} and {postal} placeholders.
+type countryFormat struct {
+	Name           string
+	RegionLabel    string // empty when addresses there carry no region
+	RegionRequired bool
+	PostalLabel    string
+	Postal         *regexp.Regexp // nil when the country has no postal codes
+	Line           string
+}
+
+var countryFormats = map[string]countryFormat{
+	"US": {"United States", "State", true, "ZIP code", regexp.MustCompile(`^\d{5}(-\d{4})?$`), "{city}, {region} {postal}"},
+	"CA": {"Canada", "Province", true, "Postal code", regexp.MustCompile(`^[A-Z]\d[A-Z] ?\d[A-Z]\d$`), "{city} {region} {postal}"},
+	"MX": {"Mexico", "State", true, "Postal code", regexp.MustCompile(`^\d{5}$`), "{postal} {city}, {region}"},
+	"GB": {"United Kingdom", "County", false, "Postcode", regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`), "{city}\n{postal}"},
+	"IE": {"Ireland", "County", false, "Eircode", regexp.MustCompile(`^[A-Z\d]{3} ?[A-Z\d]{4}$`), "{city}\n{region}\n{postal}"},
+	"DE": {"Germany", "", false, "Postleitzahl", regexp.MustCompile(`^\d{5}$`), "{postal} {city}"},
+	"FR": {"France", "", false, "Code postal", regexp.MustCompile(`^\d{5}$`), "{postal} {city}"},
+	"NL": {"Netherlands", "", false, "Postcode", regexp.MustCompile(`^\d{4} ?[A-Z]{2}$`), "{postal} {city}"},
+	"AU": {"Australia", "State", true, "Postcode", regexp.MustCompile(`^\d{4}$`), "{city} {region} {postal}"},
+	"NZ": {"New Zealand", "", false, "Postcode", regexp.MustCompile(`^\d{4}$`), "{city} {postal}"},
+	"CN": {"China", "Province", true, "Postal code", regexp.MustCompile(`^\d{6}$`), "{city}, {region} {postal}"},
+	"JP": {"Japan", "Prefecture", true, "Postal code", regexp.MustCompile(`^\d{3}-?\d{4}$`), "{postal} {region} {city}"},
+	"HK": {"Hong Kong", "District", false, "", nil, "{city}\n{region}"},
+}
+
+// Country is an option of the country select.
+type Country struct {
+	Code string
+	Name string
+}
+
+// countries lists countryFormats by name.
+func countries() []Country {
+	list := make([]Country, 0, len(countryFormats))
+	for code, f := range countryFormats {
+		list = append(list, Country{code, f.Name})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Validate adds the rules that depend on the country to the ones in the
+// struct tags.
+func (a *Address) Validate() map[string]string {
+	a.Country = strings.ToUpper(a.Country)
+	f, ok := countryFormats[a.Country]
+	if !ok {
+		return map[string]string{"country": "We do not deliver to that country yet."}
+	}
+	problems := map[string]string{}
+	if f.RegionRequired && a.Region == "" {
+		problems["region"] = f.RegionLabel + " is required."
+	}
+	if f.Postal == nil {
+		a.PostalCode = ""
+	} else {
+		a.PostalCode = strings.ToUpper(a.PostalCode)
+		if !f.Postal.MatchString(a.PostalCode) {
+			problems["postal_code"] = f.PostalLabel + " is not valid for " + f.Name + "."
+		}
+	}
+	return problems
+}
+
+// Lines is the address as it is written on a parcel in its country.
+func (a Address) Lines() []string {
+	f := countryFormats[a.Country]
+	line := f.Line
+	if line == "" {
+		line = "{city} {region} {postal}"
+	}
+	city := strings.NewReplacer("{city}", a.City, "{region}", a.Region, "{postal}", a.PostalCode).Replace(line)
+	lines := []string{a.Name, a.Company, a.Line1, a.Line2}
+	lines = append(lines, strings.Split(city, "\n")...)
+	lines = append(lines, f.Name)
+	out := lines[:0]
+	for _, l := range lines {
+		if l = strings.Trim(l, " ,"); l != "" {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// userAddresses returns the address book of username, defaults first.
+func userAddresses(db *meteredDbMap, username string) ([]Address, error) {
+	var list []Address
+	_, err := db.Select(&list, "SELECT * FROM addresses WHERE Username=? ORDER BY DefaultShipping DESC, DefaultBilling DESC, Id", username)
+	return list, err
+}
+
+// userAddress loads one address, making sure it belongs to username.
+func userAddress(db *meteredDbMap, username string, id int64) (*Address, error) {
+	obj, err := db.Get(Address{}, id)
+	if err != nil {
+		return nil, Internal(err, "The address could not be loaded.")
+	}
+	if obj == nil || obj.(*Address).Username != username {
+		return nil, NotFound("Address %d does not exist.", id)
+	}
+	return obj.(*Address), nil
+}
+
+// defaultAddress returns the default shipping or billing address of
+// username, or nil when none is set.
+func defaultAddress(db *meteredDbMap, username, kind string) (*Address, error) {
+	var list []Address
+	if _, err := db.Select(&list, "SELECT * FROM addresses WHERE Username=? AND "+defaultColumn(kind)+"=1 LIMIT 1", username); err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, nil
+	}
+	return &list[0], nil
+}
+
+func defaultColumn(kind string) string {
+	if kind == "billing" {
+		return "DefaultBilling"
+	}
+	return "DefaultShipping"
+}
+
+// saveAddress stores a and keeps at most one default of each kind per
+// user. The first address saved becomes the default for both.
+func saveAddress(db *meteredDbMap, a *Address) error {
+	count, err := db.SelectInt("SELECT count(*) FROM addresses WHERE Username=? AND Id<>?", a.Username, a.Id)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		a.DefaultShipping, a.DefaultBilling = true, true
+	}
+	a.Updated = time.Now()
+	if a.Id == 0 {
+		a.Created = a.Updated
+		err = db.Insert(a)
+	} else {
+		_, err = db.Update(a)
+	}
+	if err != nil {
+		return err
+	}
+	if a.DefaultShipping {
+		if _, err := db.Exec("UPDATE addresses SET DefaultShipping=0 WHERE Username=? AND Id<>?", a.Username, a.Id); err != nil {
+			return err
+		}
+	}
+	if a.DefaultBilling {
+		if _, err := db.Exec("UPDATE addresses SET DefaultBilling=0 WHERE Username=? AND Id<>?", a.Username, a.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type AddressBook struct {
+	Addresses []Address
+	Countries []Country
+	Edit      Address
+	Error     string
+	Fields    map[string]string
+}
+
+type AddressBookPage struct {
+	User    string
+	Content AddressBook
+}
+
+func renderAddressBook(w http.ResponseWriter, r *http.Request, status int, username string, edit Address, err error) error {
+	list, lerr := userAddresses(dbFor(r), username)
+	if lerr != nil {
+		return Internal(lerr, "Your addresses are unavailable right now.")
+	}
+	book := AddressBook{Addresses: list, Countries: countries(), Edit: edit}
+	if err != nil {
+		errs := formErrors(err)
+		book.Error, book.Fields = errs.Error, errs.Fields
+	}
+	return renderer.RenderStatus(w, r, status, "account_addresses", AddressBookPage{User: username, Content: book})
+}
+
+func addressID(r *http.Request) int64 {
+	id, _ := strconv.ParseInt(gmux.Vars(r)["id"], 10, 64)
+	return id
+}
+
+// AddressBookHandler lists the user's addresses next to a form for adding
+// one, or for editing the one given by {id}.
+func AddressBookHandler(w http.ResponseWriter, r *http.Request) error {
+	username, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+	edit := Address{Country: "US"}
+	if gmux.Vars(r)["id"] != "" {
+		a, err := userAddress(dbFor(r), username, addressID(r))
+		if err != nil {
+			return err
+		}
+		edit = *a
+	}
+	return renderAddressBook(w, r, http.StatusOK, username, edit, nil)
+}
+
+// SaveAddressHandler adds an address, or updates it when the route has
+// an {id}.
+func SaveAddressHandler(w http.ResponseWriter, r *http.Request) error {
+	username, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+	a := &Address{Username: username}
+	if gmux.Vars(r)["id"] != "" {
+		if a, err = userAddress(dbFor(r), username, addressID(r)); err != nil {
+			return err
+		}
+	}
+	if err := bind(r, a); err != nil {
+		return renderAddressBook(w, r, http.StatusBadRequest, username, *a, err)
+	}
+	if err := saveAddress(dbFor(r), a); err != nil {
+		return Internal(err, "The address could not be saved.")
+	}
+	http.Redirect(w, r, "/account/addresses/", http.StatusSeeOther)
+	return nil
+}
+
+// DefaultAddressHandler makes an address the default for kind.
+func DefaultAddressHandler(w http.ResponseWriter, r *http.Request) error {
+	username, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+	a, err := userAddress(dbFor(r), username, addressID(r))
+	if err != nil {
+		return err
+	}
+	switch r.FormValue("kind") {
+	case "shipping":
+		a.DefaultShipping = true
+	case "billing":
+		a.DefaultBilling = true
+	default:
+		return Validation("Unknown address kind %q.", r.FormValue("kind"))
+	}
+	if err := saveAddress(dbFor(r), a); err != nil {
+		return Internal(err, "The address could not be saved.")
+	}
+	http.Redirect(w, r, "/account/addresses/", http.StatusSeeOther)
+	return nil
+}
+
+func DeleteAddressHandler(w http.ResponseWriter, r *http.Request) error {
+	username, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+	a, err := userAddress(dbFor(r), username, addressID(r))
+	if err != nil {
+		return err
+	}
+	if _, err := dbFor(r).Delete(a); err != nil {
+		return Internal(err, "The address could not be deleted.")
+	}
+	// Hand the defaults to the oldest remaining address.
+	for _, kind := range []string{"shipping", "billing"} {
+		def, err := defaultAddress(dbFor(r), username, kind)
+		if err != nil {
+			return Internal(err, "The address could not be deleted.")
+		}
+		if def != nil {
+			continue
+		}
+		if _, err := dbFor(r).Exec("UPDATE addresses SET "+defaultColumn(kind)+"=1 WHERE Username=? ORDER BY Id LIMIT 1", username); err != nil {
+			return Internal(err, "The address could not be deleted.")
+		}
+	}
+	http.Redirect(w, r, "/account/addresses/", http.StatusSeeOther)
+	return nil
+}
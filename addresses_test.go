@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestAddressValidate(t *testing.T) {
+	tests := []struct {
+		a          Address
+		wantFields []string
+		wantPostal string
+	}{
+		{Address{Country: "us", Region: "CA", PostalCode: "94103"}, nil, "94103"},
+		{Address{Country: "US", Region: "CA", PostalCode: "94103-1234"}, nil, "94103-1234"},
+		{Address{Country: "US", PostalCode: "9410"}, []string{"postal_code", "region"}, "9410"},
+		{Address{Country: "GB", PostalCode: "sw1a 1aa"}, nil, "SW1A 1AA"},
+		{Address{Country: "CA", Region: "ON", PostalCode: "k1a0b1"}, nil, "K1A0B1"},
+		{Address{Country: "DE", PostalCode: "1011"}, []string{"postal_code"}, "1011"},
+		{Address{Country: "HK", PostalCode: "999077"}, nil, ""},
+		{Address{Country: "ZZ"}, []string{"country"}, ""},
+	}
+	for _, tt := range tests {
+		a := tt.a
+		problems := a.Validate()
+		var fields []string
+		for f := range problems {
+			fields = append(fields, f)
+		}
+		sort.Strings(fields)
+		if strings.Join(fields, ",") != strings.Join(tt.wantFields, ",") {
+			t.Errorf("Validate(%s %q) problems %v, want %v", tt.a.Country, tt.a.PostalCode, problems, tt.wantFields)
+		}
+		if a.PostalCode != tt.wantPostal {
+			t.Errorf("Validate(%s %q) left postal code %q, want %q", tt.a.Country, tt.a.PostalCode, a.PostalCode, tt.wantPostal)
+		}
+	}
+}
+
+func TestAddressLines(t *testing.T) {
+	tests := []struct {
+		a    Address
+		want []string
+	}{
+		{Address{Name: "Ada Lovelace", Line1: "1 Main St", City: "Springfield", Region: "IL", PostalCode: "62701", Country: "US"},
+			[]string{"Ada Lovelace", "1 Main St", "Springfield, IL 62701", "United States"}},
+		{Address{Name: "Ada Lovelace", Company: "WildView", Line1: "Hauptstr. 1", Line2: "2. OG", City: "Berlin", PostalCode: "10115", Country: "DE"},
+			[]string{"Ada Lovelace", "WildView", "Hauptstr. 1", "2. OG", "10115 Berlin", "Germany"}},
+		{Address{Name: "Ada Lovelace", Line1: "10 Downing St", City: "London", PostalCode: "SW1A 2AA", Country: "GB"},
+			[]string{"Ada Lovelace", "10 Downing St", "London", "SW1A 2AA", "United Kingdom"}},
+		// Hong Kong has no postal codes; empty lines are left out.
+		{Address{Name: "Ada Lovelace", Line1: "1 Queen's Rd", City: "Hong Kong", Region: "Central", Country: "HK"},
+			[]string{"Ada Lovelace", "1 Queen's Rd", "Hong Kong", "Central", "Hong Kong"}},
+	}
+	for _, tt := range tests {
+		got := tt.a.Lines()
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("Lines() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestCountries(t *testing.T) {
+	list := countries()
+	if len(list) != len(countryFormats) {
+		t.Fatalf("countries() has %d entries, want %d", len(list), len(countryFormats))
+	}
+	if !sort.SliceIsSorted(list, func(i, j int) bool { return list[i].Name < list[j].Name }) {
+		t.Errorf("countries() is not sorted by name: %v", list)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxLineQuantity is the most of one product a single order can hold.
+const maxLineQuantity = 99
+
+// CartLine is a product and quantity as posted by the cart.
+type CartLine struct {
+	ProductId int64 `json:"product_id"`
+	Quantity  int   `json:"quantity"`
+}
+
+// CartItem is a cart line with its product loaded and priced.
+type CartItem struct {
+	Product  Product
+	Price    Money // of one, in the currency of the cart
+	Quantity int
+}
+
+// CartRequest is what the cart posts to the pricing endpoints: its lines,
+// where they are going and how, and a coupon code. The destination is either one of the user's
+// saved addresses or a country, region and postal code.
+type CartRequest struct {
+	Lines      []CartLine `json:"lines"`
+	AddressId  int64      `json:"address_id"`
+	Country    string     `json:"country"`
+	Region     string     `json:"region"`
+	PostalCode string     `json:"postal_code"`
+	Shipping   string     `json:"shipping"` // method code, the cheapest when empty
+	Coupon     string     `json:"coupon"`
+}
+
+// parseCartRequest reads a CartRequest from a JSON body, or from form
+// values where product_id and quantity repeat once per line.
+func parseCartRequest(r *http.Request) (CartRequest, error) {
+	var req CartRequest
+	if isJSON(r) {
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxBodyBytes)).Decode(&req); err != nil {
+			return req, Validation("The request body is not valid JSON.")
+		}
+		return req, nil
+	}
+	if err := r.ParseForm(); err != nil {
+		return req, Validation("The form could not be read.")
+	}
+	ids, quantities := r.Form["product_id"], r.Form["quantity"]
+	if len(ids) != len(quantities) {
+		return req, Validation("Every product needs a quantity.")
+	}
+	for i := range ids {
+		id, err1 := strconv.ParseInt(ids[i], 10, 64)
+		qty, err2 := strconv.Atoi(quantities[i])
+		if err1 != nil || err2 != nil {
+			return req, Validation("Product ids and quantities must be numbers.")
+		}
+		req.Lines = append(req.Lines, CartLine{id, qty})
+	}
+	req.AddressId, _ = strconv.ParseInt(r.FormValue("address_id"), 10, 64)
+	req.Country, req.Region, req.PostalCode = r.FormValue("country"), r.FormValue("region"), r.FormValue("postal_code")
+	req.Shipping, req.Coupon = r.FormValue("shipping"), r.FormValue("coupon")
+	return req, nil
+}
+
+// loadCart loads the products of lines, merging repeated products, and
+// prices them with pr.
+func loadCart(db *meteredDbMap, pr *Pricer, lines []CartLine) ([]CartItem, error) {
+	if len(lines) == 0 {
+		return nil, Validation("Your cart is empty.")
+	}
+	var items []CartItem
+	index := map[int64]int{}
+	for _, line := range lines {
+		if line.Quantity < 1 {
+			return nil, Validation("Quantities must be at least 1.")
+		}
+		if i, ok := index[line.ProductId]; ok {
+			items[i].Quantity += line.Quantity
+			continue
+		}
+		obj, err := db.Get(Product{}, line.ProductId)
+		if err != nil {
+			return nil, Internal(err, "Your cart could not be loaded.")
+		}
+		if obj == nil {
+			return nil, NotFound("Product %d does not exist.", line.ProductId)
+		}
+		index[line.ProductId] = len(items)
+		p := *obj.(*Product)
+		items = append(items, CartItem{Product: p, Price: pr.Price(p), Quantity: line.Quantity})
+	}
+	for _, item := range items {
+		if item.Quantity > maxLineQuantity {
+			return nil, Validation("You can order at most %d of %s.", maxLineQuantity, item.Product.Name)
+		}
+	}
+	return items, nil
+}
+
+// destination resolves where the cart is going. Visitors give a country;
+// logged in users may pick a saved address or fall back to their default
+// shipping address.
+func (req CartRequest) destination(r *http.Request) (Address, error) {
+	username := getStringFromSession(r, "User")
+	if req.AddressId != 0 {
+		if username == "" {
+			return Address{}, Unauthorized("Please log in to use your saved addresses.")
+		}
+		a, err := userAddress(dbFor(r), username, req.AddressId)
+		if err != nil {
+			return Address{}, err
+		}
+		return *a, nil
+	}
+	if req.Country != "" {
+		return Address{
+			Country:    strings.ToUpper(strings.TrimSpace(req.Country)),
+			Region:     strings.ToUpper(strings.TrimSpace(req.Region)),
+			PostalCode: strings.ToUpper(strings.TrimSpace(req.PostalCode)),
+		}, nil
+	}
+	if username != "" {
+		a, err := defaultAddress(dbFor(r), username, "shipping")
+		if err != nil {
+			return Address{}, Internal(err, "Your addresses could not be loaded.")
+		}
+		if a != nil {
+			return *a, nil
+		}
+	}
+	return Address{}, Validation("Please tell us where to ship to.")
+}
+
+// OrderLine is a priced cart line with its share of the tax.
+type OrderLine struct {
+	ProductId int64
+	Name      string
+	Quantity  int
+	UnitPrice Money
+	Total     Money
+	Discount  Money // from promotions, taken off Total before tax
+	TaxClass  string
+	TaxName   string
+	TaxRate   float64 // percent
+	Tax       Money
+}
+
+// OrderTotals is what an order for the cart would cost. With
+// PricesIncludeTax the line totals and shipping already contain the tax
+// and Total does not add it again.
+type OrderTotals struct {
+	Currency         string
+	Lines            []OrderLine
+	Subtotal         Money
+	Discounts        []Discount
+	Discount         Money // off the goods, all promotions together
+	Shipping         ShippingOption
+	ShippingDiscount Money // the whole shipping charge with free shipping
+	ShippingTax      Money
+	Tax              Money
+	Total            Money
+	PricesIncludeTax bool
+}
+
+// computeTotals prices req: its lines, the chosen shipping method, the
+// promotions that apply and the tax on what is left from taxProvider.
+func computeTotals(r *http.Request, req CartRequest) (OrderTotals, error) {
+	s, err := newShipment(r, req)
+	if err != nil {
+		return OrderTotals{}, err
+	}
+	options, _, err := availableShipping(s)
+	if err != nil {
+		return OrderTotals{}, err
+	}
+	t := OrderTotals{Currency: s.Subtotal.Currency, Subtotal: s.Subtotal, PricesIncludeTax: config.PricesIncludeTax}
+	if t.Shipping, err = chooseShipping(options, req.Shipping); err != nil {
+		return OrderTotals{}, err
+	}
+	if t.Discounts, err = applyPromotions(r, s.Items, s.Subtotal, t.Shipping.Rate, req.Coupon); err != nil {
+		return OrderTotals{}, err
+	}
+	zero := Money{Currency: t.Currency}
+	t.Discount, t.ShippingDiscount = zero, zero
+	for _, item := range s.Items {
+		t.Lines = append(t.Lines, OrderLine{
+			ProductId: item.Product.Id,
+			Name:      item.Product.Name,
+			Quantity:  item.Quantity,
+			UnitPrice: item.Price,
+			Total:     item.Price.Mul(item.Quantity),
+			Discount:  zero,
+			TaxClass:  item.Product.TaxClass,
+		})
+	}
+	for _, d := range t.Discounts {
+		for i, off := range d.Lines {
+			t.Lines[i].Discount = t.Lines[i].Discount.Add(off)
+		}
+		if d.FreeShipping {
+			t.ShippingDiscount = t.Shipping.Rate
+		}
+	}
+	taxReq := TaxRequest{Destination: s.Destination, Currency: t.Currency, Shipping: t.Shipping.Rate.Sub(t.ShippingDiscount), Inclusive: config.PricesIncludeTax}
+	for i, line := range t.Lines {
+		// Stacked promotions never take a line below nothing.
+		if line.Discount.Amount > line.Total.Amount {
+			t.Lines[i].Discount = line.Total
+		}
+		t.Discount = t.Discount.Add(t.Lines[i].Discount)
+		taxReq.Lines = append(taxReq.Lines, TaxLine{Ref: strconv.FormatInt(line.ProductId, 10), TaxClass: line.TaxClass, Amount: line.Total.Sub(t.Lines[i].Discount)})
+	}
+	tax, err := taxProvider.Tax(r.Context(), taxReq)
+	if err != nil {
+		return OrderTotals{}, Internal(err, "Tax could not be calculated right now.")
+	}
+	if len(tax.Lines) != len(t.Lines) {
+		return OrderTotals{}, Internal(fmt.Errorf("tax provider returned %d lines for %d", len(tax.Lines), len(t.Lines)), "Tax could not be calculated right now.")
+	}
+	for i, lt := range tax.Lines {
+		t.Lines[i].TaxName, t.Lines[i].TaxRate, t.Lines[i].Tax = lt.Name, lt.Rate, lt.Tax
+	}
+	t.ShippingTax, t.Tax = tax.Shipping.Tax, tax.Total
+	t.Total = t.Subtotal.Sub(t.Discount).Add(t.Shipping.Rate).Sub(t.ShippingDiscount)
+	if !t.PricesIncludeTax {
+		t.Total = t.Total.Add(t.Tax)
+	}
+	return t, nil
+}
+
+// CartTotalsHandler prices a cart with shipping, promotions and a per-line
+// tax breakdown.
+func CartTotalsHandler(w http.ResponseWriter, r *http.Request) error {
+	req, err := parseCartRequest(r)
+	if err != nil {
+		return err
+	}
+	totals, err := computeTotals(r, req)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	return encoder.Encode(totals)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the runtime settings read from the environment at startup.
+type Config struct {
+	LogLevel  string // debug, info, warn or error
+	LogOutput string // stdout, stderr or a file path
+
+	Addr            string
+	MetricsAddr     string // serves /metrics unless "off"; keep it private
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownGrace   time.Duration // how long /readyz fails before the server stops accepting connections
+	ShutdownTimeout time.Duration // how long in-flight requests may take to drain
+
+	TemplateReload bool // re-parse templates on every request
+
+	BaseURL string // scheme and host used for canonical and Open Graph URLs
+
+	RobotsFile     string   // served verbatim as robots.txt when set
+	RobotsDisallow []string // paths crawlers are asked to skip
+
+	Secret string // signs session cookies and email links
+
+	MailFrom     string
+	SMTPAddr     string // host:port; when empty mail goes to MailOutbox
+	SMTPUser     string
+	SMTPPassword string
+	MailOutbox   string  // directory receiving .eml files
+	MailRate     float64 // emails sent per second
+
+	TrustProxy          bool          // take the client IP from X-Forwarded-For
+	SubmitMinTime       time.Duration // forms posted faster than this are bots
+	IPSubmitLimit       int           // public form posts per IP per hour
+	EmailSubmitLimit    int           // public form posts per email address per hour
+	BlockedEmailDomains []string      // disposable email providers
+
+	PhoneCountryCode string // assumed for phone numbers entered without one
+
+	Currency         string // ISO 4217 code prices are set in; see currencies
+	PricesIncludeTax bool   // catalog prices are shown and stored with tax
+	TaxProvider      string // local or stub, see newTaxProvider
+
+	Locale     string   // the language templates are written in, and the fallback
+	Locales    []string // offered to visitors, see localeFormats
+	LocalesDir string   // message catalogs, one <locale>.json per locale
+}
+
+// maxMailRate keeps the interval of the mail job, one second divided by
+// the rate, well above zero.
+const maxMailRate = 1000
+
+func loadConfig() (Config, error) {
+	cfg := Config{
+		LogLevel:  getEnv("WILDVIEW_LOG_LEVEL", "info"),
+		LogOutput: getEnv("WILDVIEW_LOG_OUTPUT", "stdout"),
+		Addr:      getEnv("WILDVIEW_ADDR", ":80"),
+
+		MetricsAddr: getEnv("WILDVIEW_METRICS_ADDR", "127.0.0.1:9090"),
+
+		TemplateReload: getEnv("WILDVIEW_TEMPLATE_RELOAD", "") == "true",
+
+		BaseURL: strings.TrimSuffix(getEnv("WILDVIEW_BASE_URL", "http://localhost"), "/"),
+
+		RobotsFile:     getEnv("WILDVIEW_ROBOTS_FILE", ""),
+		RobotsDisallow: splitList(getEnv("WILDVIEW_ROBOTS_DISALLOW", "/manage/,/account/,/login/,/logout/,/list/")),
+
+		Secret: os.Getenv("WILDVIEW_SECRET"),
+
+		MailFrom:     getEnv("WILDVIEW_MAIL_FROM", "WildView <wildviewinc@gmail.com>"),
+		SMTPAddr:     getEnv("WILDVIEW_SMTP_ADDR", ""),
+		SMTPUser:     getEnv("WILDVIEW_SMTP_USER", ""),
+		SMTPPassword: getEnv("WILDVIEW_SMTP_PASSWORD", ""),
+		MailOutbox:   getEnv("WILDVIEW_MAIL_OUTBOX", "outbox"),
+
+		TrustProxy:          getEnv("WILDVIEW_TRUST_PROXY", "") == "true",
+		BlockedEmailDomains: splitList(getEnv("WILDVIEW_BLOCKED_EMAIL_DOMAINS", defaultBlockedEmailDomains)),
+
+		PhoneCountryCode: strings.TrimPrefix(getEnv("WILDVIEW_PHONE_COUNTRY_CODE", "1"), "+"),
+
+		Currency:         strings.ToUpper(getEnv("WILDVIEW_CURRENCY", "USD")),
+		PricesIncludeTax: getEnv("WILDVIEW_PRICES_INCLUDE_TAX", "") == "true",
+		TaxProvider:      getEnv("WILDVIEW_TAX_PROVIDER", "local"),
+
+		Locale:     strings.ToLower(getEnv("WILDVIEW_LOCALE", "en")),
+		Locales:    splitList(strings.ToLower(getEnv("WILDVIEW_LOCALES", "en,de,fr"))),
+		LocalesDir: getEnv("WILDVIEW_LOCALES_DIR", "locales"),
+	}
+	durations := []struct {
+		key      string
+		fallback time.Duration
+		dst      *time.Duration
+	}{
+		{"WILDVIEW_READ_TIMEOUT", 10 * time.Second, &cfg.ReadTimeout},
+		{"WILDVIEW_WRITE_TIMEOUT", 30 * time.Second, &cfg.WriteTimeout},
+		{"WILDVIEW_IDLE_TIMEOUT", 120 * time.Second, &cfg.IdleTimeout},
+		{"WILDVIEW_SHUTDOWN_GRACE", 5 * time.Second, &cfg.ShutdownGrace},
+		{"WILDVIEW_SHUTDOWN_TIMEOUT", 20 * time.Second, &cfg.ShutdownTimeout},
+		{"WILDVIEW_SUBMIT_MIN_TIME", 3 * time.Second, &cfg.SubmitMinTime},
+	}
+	ints := []struct {
+		key      string
+		fallback int
+		dst      *int
+	}{
+		{"WILDVIEW_IP_SUBMIT_LIMIT", 20, &cfg.IPSubmitLimit},
+		{"WILDVIEW_EMAIL_SUBMIT_LIMIT", 5, &cfg.EmailSubmitLimit},
+	}
+	rate, err := strconv.ParseFloat(getEnv("WILDVIEW_MAIL_RATE", "5"), 64)
+	if err != nil || !(rate > 0 && rate <= maxMailRate) {
+		return cfg, fmt.Errorf("WILDVIEW_MAIL_RATE: must be a number above 0 and at most %d", maxMailRate)
+	}
+	cfg.MailRate = rate
+	// Anyone knowing the secret can forge sessions and email links, so
+	// there is no default.
+	if len(cfg.Secret) < 16 {
+		return cfg, fmt.Errorf("WILDVIEW_SECRET: must be set to at least 16 random characters")
+	}
+	if _, ok := currencies[cfg.Currency]; !ok {
+		return cfg, fmt.Errorf("WILDVIEW_CURRENCY: unsupported currency %q", cfg.Currency)
+	}
+	if cfg.TaxProvider != "local" && cfg.TaxProvider != "stub" {
+		return cfg, fmt.Errorf("WILDVIEW_TAX_PROVIDER: must be local or stub")
+	}
+	for _, locale := range append([]string{cfg.Locale}, cfg.Locales...) {
+		if _, ok := localeFormats[locale]; !ok {
+			return cfg, fmt.Errorf("WILDVIEW_LOCALES: unsupported locale %q", locale)
+		}
+	}
+	if !contains(cfg.Locales, cfg.Locale) {
+		cfg.Locales = append([]string{cfg.Locale}, cfg.Locales...)
+	}
+	for _, d := range durations {
+		val, err := getEnvDuration(d.key, d.fallback)
+		if err != nil {
+			return cfg, err
+		}
+		*d.dst = val
+	}
+	for _, n := range ints {
+		val, err := getEnvInt(n.key, n.fallback)
+		if err != nil {
+			return cfg, err
+		}
+		*n.dst = val
+	}
+	return cfg, nil
+}
+
+func getEnv(key, fallback string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	return fallback
+}
+
+func getEnvDuration(key string, fallback time.Duration) (time.Duration, error) {
+	val := os.Getenv(key)
+	if val == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", key, err)
+	}
+	return d, nil
+}
+
+func getEnvInt(key string, fallback int) (int, error) {
+	val := os.Getenv(key)
+	if val == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%s: must be a positive whole number", key)
+	}
+	return n, nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	gmux "github.com/gorilla/mux"
+)
+
+// Contact statuses. Every submission starts as new; staff move it along
+// as they work on it.
+const (
+	ContactNew        = "new"
+	ContactInProgress = "in progress"
+	ContactResolved   = "resolved"
+)
+
+var contactStatuses = []string{ContactNew, ContactInProgress, ContactResolved}
+
+// ContactMessage is one entry in the thread of a contact submission:
+// either a reply emailed to the submitter or a note only staff can see.
+type ContactMessage struct {
+	Id        int64     `db:"Id"`
+	ContactId int64     `db:"ContactId"`
+	Kind      string    `db:"Kind,size:16" form:"kind" validate:"required,oneof=reply|note"`
+	Author    string    `db:"Author"`
+	Body      string    `db:"Body,size:65535" form:"body" label:"Message" validate:"required"`
+	Created   time.Time `db:"Created"`
+}
+
+// Paragraphs lets the admin templates show the body as it was typed.
+func (m ContactMessage) Paragraphs() []string {
+	return paragraphs(m.Body)
+}
+
+type contactEmail struct {
+	Name       string
+	Ticket     int64
+	Paragraphs []string
+}
+
+func contactSubject(c *ContactUs) string {
+	return "Re: your message to WildView [#" + strconv.FormatInt(c.Id, 10) + "]"
+}
+
+// queueContactConfirmation lets the submitter know the message arrived
+// and which ticket number it got.
+func queueContactConfirmation(db *meteredDbMap, c *ContactUs) error {
+	body, err := renderEmail("contact_received.html", contactEmail{
+		Name:       c.Name,
+		Ticket:     c.Id,
+		Paragraphs: paragraphs(c.Content),
+	})
+	if err != nil {
+		return err
+	}
+	return queueEmail(db, Email{To: c.Email, Subject: contactSubject(c), HTML: body})
+}
+
+// staffUsers returns the accounts a submission can be assigned to.
+func staffUsers(db *meteredDbMap) ([]string, error) {
+	var roles []Role
+	if _, err := db.Select(&roles, "SELECT * FROM roles WHERE role=0 ORDER BY username"); err != nil {
+		return nil, err
+	}
+	staff := make([]string, len(roles))
+	for i, role := range roles {
+		staff[i] = role.Username
+	}
+	return staff, nil
+}
+
+type ContactInbox struct {
+	Counts   []StatusCount
+	Status   string
+	Assignee string
+	Query    string
+	Statuses []string
+	Staff    []string
+	Contacts []ContactUs
+}
+
+type ContactInboxPage struct {
+	User    string
+	Content ContactInbox
+}
+
+// ManageContactsHandler lists contact submissions, newest first, filtered
+// by status, assignee and a free text search.
+func ManageContactsHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	inbox := ContactInbox{
+		Status:   r.FormValue("status"),
+		Assignee: r.FormValue("assignee"),
+		Query:    strings.TrimSpace(r.FormValue("q")),
+		Statuses: contactStatuses,
+	}
+	for _, status := range contactStatuses {
+		count, err := dbFor(r).SelectInt("SELECT count(*) FROM contactinfos WHERE Status=?", status)
+		if err != nil {
+			return Internal(err, "The inbox is unavailable right now.")
+		}
+		inbox.Counts = append(inbox.Counts, StatusCount{status, count})
+	}
+	staff, err := staffUsers(dbFor(r))
+	if err != nil {
+		return Internal(err, "The inbox is unavailable right now.")
+	}
+	inbox.Staff = staff
+
+	var where []string
+	var args []interface{}
+	if inbox.Status != "" {
+		where, args = append(where, "Status=?"), append(args, inbox.Status)
+	}
+	if inbox.Assignee != "" {
+		where, args = append(where, "Assignee=?"), append(args, inbox.Assignee)
+	}
+	if inbox.Query != "" {
+		like := "%" + inbox.Query + "%"
+		where = append(where, "(Name LIKE ? OR Email LIKE ? OR Content LIKE ?)")
+		args = append(args, like, like, like)
+	}
+	query := "SELECT * FROM contactinfos"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	if _, err := dbFor(r).Select(&inbox.Contacts, query+" ORDER BY Id DESC LIMIT 200", args...); err != nil {
+		return Internal(err, "The inbox is unavailable right now.")
+	}
+	return renderer.Render(w, r, "manage_contacts", ContactInboxPage{User: getStringFromSession(r, "User"), Content: inbox})
+}
+
+func loadContact(r *http.Request) (*ContactUs, error) {
+	id, _ := strconv.ParseInt(gmux.Vars(r)["id"], 10, 64)
+	obj, err := dbFor(r).Get(ContactUs{}, id)
+	if err != nil {
+		return nil, Internal(err, "The message could not be loaded.")
+	}
+	if obj == nil {
+		return nil, NotFound("Message %d does not exist.", id)
+	}
+	return obj.(*ContactUs), nil
+}
+
+func contactURL(c *ContactUs) string {
+	return "/manage/contacts/" + strconv.FormatInt(c.Id, 10) + "/"
+}
+
+type ContactThread struct {
+	Contact  ContactUs
+	Messages []ContactMessage
+	Statuses []string
+	Staff    []string
+	Error    string
+}
+
+type ContactThreadPage struct {
+	User    string
+	Content ContactThread
+}
+
+func contactThread(r *http.Request, c *ContactUs) (ContactThread, error) {
+	t := ContactThread{Contact: *c, Statuses: contactStatuses}
+	if _, err := dbFor(r).Select(&t.Messages, "SELECT * FROM contactmessages WHERE ContactId=? ORDER BY Id", c.Id); err != nil {
+		return t, err
+	}
+	staff, err := staffUsers(dbFor(r))
+	t.Staff = staff
+	return t, err
+}
+
+// ManageContactHandler shows a submission with its replies and notes.
+func ManageContactHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	c, err := loadContact(r)
+	if err != nil {
+		return err
+	}
+	t, err := contactThread(r, c)
+	if err != nil {
+		return Internal(err, "The message could not be loaded.")
+	}
+	return renderer.Render(w, r, "manage_contact", ContactThreadPage{User: getStringFromSession(r, "User"), Content: t})
+}
+
+// UpdateContactHandler changes the status or assignee of a submission.
+func UpdateContactHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	c, err := loadContact(r)
+	if err != nil {
+		return err
+	}
+	status := r.FormValue("status")
+	if !contains(contactStatuses, status) {
+		return Validation("Unknown status %q.", status)
+	}
+	assignee := r.FormValue("assignee")
+	if assignee != "" {
+		staff, err := staffUsers(dbFor(r))
+		if err != nil {
+			return Internal(err, "The message could not be updated.")
+		}
+		if !contains(staff, assignee) {
+			return Validation("%s is not a member of staff.", assignee)
+		}
+	}
+	c.Status, c.Assignee, c.Updated = status, assignee, time.Now()
+	if _, err := dbFor(r).Update(c); err != nil {
+		return Internal(err, "The message could not be updated.")
+	}
+	http.Redirect(w, r, contactURL(c), http.StatusSeeOther)
+	return nil
+}
+
+// ReplyContactHandler adds to the thread of a submission. Replies are
+// emailed to the submitter; notes stay internal.
+func ReplyContactHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	c, err := loadContact(r)
+	if err != nil {
+		return err
+	}
+	user := getStringFromSession(r, "User")
+	m := ContactMessage{ContactId: c.Id, Author: user, Created: time.Now()}
+	if err := bind(r, &m); err != nil {
+		t, terr := contactThread(r, c)
+		if terr != nil {
+			return Internal(terr, "The message could not be loaded.")
+		}
+		t.Error = asAppError(err).Message
+		return renderer.RenderStatus(w, r, http.StatusBadRequest, "manage_contact", ContactThreadPage{User: user, Content: t})
+	}
+	var reply *Email
+	if m.Kind == "reply" {
+		body, err := renderEmail("contact_reply.html", contactEmail{Name: c.Name, Ticket: c.Id, Paragraphs: paragraphs(m.Body)})
+		if err != nil {
+			return Internal(err, "The reply could not be rendered.")
+		}
+		reply = &Email{To: c.Email, Subject: contactSubject(c), HTML: body}
+	}
+	// Answering a new submission means someone has picked it up.
+	c.Updated = m.Created
+	if c.Status == ContactNew && m.Kind == "reply" {
+		c.Status = ContactInProgress
+	}
+	if c.Assignee == "" {
+		c.Assignee = user
+	}
+	if err := addContactMessage(dbFor(r), c, &m, reply); err != nil {
+		return err
+	}
+	http.Redirect(w, r, contactURL(c), http.StatusSeeOther)
+	return nil
+}
+
+// addContactMessage stores m on the thread of c and queues reply, if
+// any, in one transaction, so the thread shows every email that was sent
+// and nothing that was not.
+func addContactMessage(db *meteredDbMap, c *ContactUs, m *ContactMessage, reply *Email) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return Internal(err, "The message could not be saved.")
+	}
+	if reply != nil {
+		if err := queueEmail(tx, *reply); err != nil {
+			tx.Rollback()
+			return Internal(err, "The reply could not be sent.")
+		}
+	}
+	if err := tx.Insert(m); err != nil {
+		tx.Rollback()
+		return Internal(err, "The message could not be saved.")
+	}
+	if _, err := tx.Update(c); err != nil {
+		tx.Rollback()
+		return Internal(err, "The message could not be updated.")
+	}
+	if err := tx.Commit(); err != nil {
+		return Internal(err, "The message could not be saved.")
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
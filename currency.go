@@ -0,0 +1,542 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goincremental/negroni-sessions"
+	gmux "github.com/gorilla/mux"
+)
+
+// ExchangeRate converts prices from the base currency (config.Currency)
+// into Currency, and says how converted prices are rounded.
+type ExchangeRate struct {
+	Currency  string    `db:"Currency,size:3" form:"currency" validate:"required"`
+	Rate      float64   `db:"Rate" form:"rate" validate:"required"`                                      // units of Currency per unit of the base currency
+	Step      int64     `db:"Step" form:"step" label:"Rounding step"`                                    // converted prices are multiples of this many minor units
+	Rounding  string    `db:"Rounding,size:8" form:"rounding" validate:"required,oneof=nearest|up|down"` // which way to the step
+	Enabled   bool      `db:"Enabled" form:"enabled"`                                                    // offered to shoppers
+	Updated   time.Time `db:"Updated"`
+	UpdatedBy string    `db:"UpdatedBy"`
+}
+
+func (x *ExchangeRate) Validate() map[string]string {
+	x.Currency = strings.ToUpper(x.Currency)
+	problems := map[string]string{}
+	if _, ok := currencies[x.Currency]; !ok || x.Currency == config.Currency {
+		problems["currency"] = "Currency must be one of " + strings.Join(foreignCurrencies(), ", ") + "."
+	}
+	if x.Rate <= 0 {
+		problems["rate"] = "Rate must be more than 0."
+	}
+	if x.Step < 0 {
+		problems["step"] = "Rounding step must be at least 1."
+	}
+	if x.Step == 0 {
+		x.Step = 1
+	}
+	return problems
+}
+
+// round rounds an amount of minor units to the step of x.
+func (x ExchangeRate) round(minor float64) int64 {
+	step := float64(x.Step)
+	if step < 1 {
+		step = 1
+	}
+	switch x.Rounding {
+	case "up":
+		return int64(math.Ceil(minor/step-1e-9) * step)
+	case "down":
+		return int64(math.Floor(minor/step+1e-9) * step)
+	}
+	return int64(math.Round(minor/step) * step)
+}
+
+// exchangeRates caches the exchangerates table; prices are converted on
+// every page that shows one.
+var exchangeRates struct {
+	sync.RWMutex
+	byCurrency map[string]ExchangeRate
+}
+
+// loadExchangeRates refreshes the cache. It runs at start up, after every
+// change and as a job, so other instances pick changes up too.
+func loadExchangeRates(ctx context.Context) error {
+	var list []ExchangeRate
+	if _, err := dbmap.WithContext(ctx).Select(&list, "SELECT * FROM exchangerates"); err != nil {
+		return err
+	}
+	byCurrency := map[string]ExchangeRate{}
+	for _, x := range list {
+		byCurrency[x.Currency] = x
+	}
+	exchangeRates.Lock()
+	exchangeRates.byCurrency = byCurrency
+	exchangeRates.Unlock()
+	return nil
+}
+
+// exchangeRate returns the rate of currency; the base currency always has
+// one.
+func exchangeRate(currency string) (ExchangeRate, bool) {
+	if currency == config.Currency {
+		return ExchangeRate{Currency: currency, Rate: 1, Step: 1, Rounding: "nearest", Enabled: true}, true
+	}
+	exchangeRates.RLock()
+	defer exchangeRates.RUnlock()
+	x, ok := exchangeRates.byCurrency[currency]
+	return x, ok
+}
+
+// convert turns m into currency at the current rates, rounded by the rule
+// of currency. ok is false when either currency has no rate.
+func convert(m Money, currency string) (Money, bool) {
+	if m.Currency == currency {
+		return m, true
+	}
+	from, ok := exchangeRate(m.Currency)
+	if !ok {
+		return Money{}, false
+	}
+	to, ok := exchangeRate(currency)
+	if !ok {
+		return Money{}, false
+	}
+	major := float64(m.Amount) / float64(minorUnits(m.Currency)) / from.Rate * to.Rate
+	return Money{to.round(major * float64(minorUnits(currency))), currency}, true
+}
+
+// shopperCurrencies are the base currency and every enabled one, sorted.
+func shopperCurrencies() []string {
+	list := []string{config.Currency}
+	exchangeRates.RLock()
+	for code, x := range exchangeRates.byCurrency {
+		if x.Enabled && code != config.Currency {
+			list = append(list, code)
+		}
+	}
+	exchangeRates.RUnlock()
+	sort.Strings(list)
+	return list
+}
+
+// foreignCurrencies are the currencies admins can add a rate for.
+func foreignCurrencies() []string {
+	var list []string
+	for code := range currencies {
+		if code != config.Currency {
+			list = append(list, code)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// currencyFor returns the currency the visitor picked, or the base one.
+func currencyFor(r *http.Request) string {
+	if c := getStringFromSession(r, "Currency"); c != "" && contains(shopperCurrencies(), c) {
+		return c
+	}
+	return config.Currency
+}
+
+// CurrencyChoice feeds the currency picker on pages showing prices.
+type CurrencyChoice struct {
+	Current string
+	Options []string
+}
+
+func currencyChoice(r *http.Request) CurrencyChoice {
+	return CurrencyChoice{Current: currencyFor(r), Options: shopperCurrencies()}
+}
+
+// ProductPrice sets the price of a product in one currency, instead of
+// converting its own price.
+type ProductPrice struct {
+	Id        int64     `db:"Id"`
+	ProductId int64     `db:"ProductId"`
+	Currency  string    `db:"Currency,size:3"`
+	Amount    int64     `db:"Amount"` // minor units
+	Updated   time.Time `db:"Updated"`
+	UpdatedBy string    `db:"UpdatedBy"`
+}
+
+// Pricer prices products in one currency: from its price list when the
+// product is on it, by conversion otherwise.
+type Pricer struct {
+	Currency string
+	list     map[int64]int64
+}
+
+func newPricer(db *meteredDbMap, currency string) (*Pricer, error) {
+	var prices []ProductPrice
+	if _, err := db.Select(&prices, "SELECT * FROM productprices WHERE Currency=?", currency); err != nil {
+		return nil, err
+	}
+	pr := &Pricer{Currency: currency, list: map[int64]int64{}}
+	for _, p := range prices {
+		pr.list[p.ProductId] = p.Amount
+	}
+	return pr, nil
+}
+
+// pricerFor prices in the currency of the visitor.
+func pricerFor(r *http.Request) (*Pricer, error) {
+	pr, err := newPricer(dbFor(r), currencyFor(r))
+	if err != nil {
+		return nil, Internal(err, "Prices are unavailable right now, please try again later.")
+	}
+	return pr, nil
+}
+
+// Regular is what p costs when it is not on sale.
+func (pr *Pricer) Regular(p Product) Money {
+	if amount, ok := pr.list[p.Id]; ok {
+		return Money{amount, pr.Currency}
+	}
+	if m, ok := convert(p.RegularPrice(), pr.Currency); ok {
+		return m
+	}
+	// The rate went away since the visitor picked the currency.
+	return p.RegularPrice()
+}
+
+// Price is what p costs now. A sale takes the same share off a listed
+// price as it takes off the product's own price.
+func (pr *Pricer) Price(p Product) Money {
+	if !p.OnSale() {
+		return pr.Regular(p)
+	}
+	if _, listed := pr.list[p.Id]; !listed {
+		if m, ok := convert(p.Price(), pr.Currency); ok {
+			return m
+		}
+		return p.Price()
+	}
+	x, ok := exchangeRate(pr.Currency)
+	if !ok {
+		x = ExchangeRate{Step: 1}
+	}
+	share := float64(p.SaleAmount) / float64(p.PriceAmount)
+	return Money{x.round(float64(pr.list[p.Id]) * share), pr.Currency}
+}
+
+// Was is the regular price of p while it is on sale, for showing what a
+// sale saves, and nil otherwise.
+func (pr *Pricer) Was(p Product) *Money {
+	if !p.OnSale() {
+		return nil
+	}
+	m := pr.Regular(p)
+	return &m
+}
+
+// PricedProduct is a product with its price in the visitor's currency, as
+// the JSON endpoints return it. Was and SaleEnds are only set during a
+// sale.
+type PricedProduct struct {
+	Product
+	Price    Money
+	Was      *Money     `json:",omitempty"`
+	SaleEnds *time.Time `json:",omitempty"`
+}
+
+func (pr *Pricer) PriceAll(products []Product) []PricedProduct {
+	priced := make([]PricedProduct, 0, len(products))
+	for _, p := range products {
+		pp := PricedProduct{Product: p, Price: pr.Price(p), Was: pr.Was(p)}
+		if pp.Was != nil {
+			pp.SaleEnds = p.SaleEnds
+		}
+		priced = append(priced, pp)
+	}
+	return priced
+}
+
+// SetCurrencyHandler remembers the currency the visitor picked and sends
+// them back to the page they came from.
+func SetCurrencyHandler(w http.ResponseWriter, r *http.Request) error {
+	currency := strings.ToUpper(r.FormValue("currency"))
+	if !contains(shopperCurrencies(), currency) {
+		return Validation("Prices cannot be shown in %q.", r.FormValue("currency"))
+	}
+	sessions.GetSession(r).Set("Currency", currency)
+	http.Redirect(w, r, backPath(r), http.StatusSeeOther)
+	return nil
+}
+
+// backPath is the page r was posted from, or "/". Only the path and query
+// are kept so a redirect to it cannot leave the site.
+func backPath(r *http.Request) string {
+	ref, err := url.Parse(r.Referer())
+	if err != nil || !strings.HasPrefix(ref.Path, "/") || strings.HasPrefix(ref.Path, "//") {
+		return "/"
+	}
+	if ref.RawQuery != "" {
+		return ref.Path + "?" + ref.RawQuery
+	}
+	return ref.Path
+}
+
+// defaultExchangeRates are seeded into an empty exchangerates table when
+// the base currency is the US dollar. Admins are expected to keep them
+// up to date.
+var defaultExchangeRates = []ExchangeRate{
+	{Currency: "EUR", Rate: 0.92, Step: 1, Rounding: "nearest", Enabled: true},
+	{Currency: "GBP", Rate: 0.79, Step: 1, Rounding: "nearest", Enabled: true},
+	{Currency: "CAD", Rate: 1.36, Step: 1, Rounding: "nearest", Enabled: true},
+	{Currency: "AUD", Rate: 1.52, Step: 1, Rounding: "nearest", Enabled: true},
+	{Currency: "JPY", Rate: 150, Step: 10, Rounding: "up", Enabled: true},
+}
+
+type CurrencyAdmin struct {
+	Base    string
+	Rates   []ExchangeRate
+	Options []string
+	Edit    ExchangeRate
+	Error   string
+	Fields  map[string]string
+}
+
+type CurrencyAdminPage struct {
+	User    string
+	Content CurrencyAdmin
+}
+
+func renderCurrencyAdmin(w http.ResponseWriter, r *http.Request, status int, edit ExchangeRate, err error) error {
+	a := CurrencyAdmin{Base: config.Currency, Options: foreignCurrencies(), Edit: edit}
+	if _, lerr := dbFor(r).Select(&a.Rates, "SELECT * FROM exchangerates ORDER BY Currency"); lerr != nil {
+		return Internal(lerr, "Exchange rates are unavailable right now.")
+	}
+	if err != nil {
+		errs := formErrors(err)
+		a.Error, a.Fields = errs.Error, errs.Fields
+	}
+	return renderer.RenderStatus(w, r, status, "manage_currencies", CurrencyAdminPage{User: getStringFromSession(r, "User"), Content: a})
+}
+
+func loadExchangeRate(r *http.Request) (*ExchangeRate, error) {
+	code := gmux.Vars(r)["code"]
+	obj, err := dbFor(r).Get(ExchangeRate{}, code)
+	if err != nil {
+		return nil, Internal(err, "The exchange rate could not be loaded.")
+	}
+	if obj == nil {
+		return nil, NotFound("There is no exchange rate for %s.", code)
+	}
+	return obj.(*ExchangeRate), nil
+}
+
+// ManageCurrenciesHandler lists the exchange rates next to a form for
+// adding one, or for editing the one given by {code}.
+func ManageCurrenciesHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	edit := ExchangeRate{Step: 1, Rounding: "nearest", Enabled: true}
+	if gmux.Vars(r)["code"] != "" {
+		x, err := loadExchangeRate(r)
+		if err != nil {
+			return err
+		}
+		edit = *x
+	}
+	return renderCurrencyAdmin(w, r, http.StatusOK, edit, nil)
+}
+
+// SaveExchangeRateHandler adds the rate of a currency or replaces it.
+func SaveExchangeRateHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	x := &ExchangeRate{}
+	if err := bind(r, x); err != nil {
+		return renderCurrencyAdmin(w, r, http.StatusBadRequest, *x, err)
+	}
+	x.Updated, x.UpdatedBy = time.Now(), getStringFromSession(r, "User")
+	count, err := dbFor(r).SelectInt("SELECT count(*) FROM exchangerates WHERE Currency=?", x.Currency)
+	if err == nil {
+		if count == 0 {
+			err = dbFor(r).Insert(x)
+		} else {
+			_, err = dbFor(r).Update(x)
+		}
+	}
+	if err != nil {
+		return Internal(err, "The exchange rate could not be saved.")
+	}
+	if err := loadExchangeRates(r.Context()); err != nil {
+		return Internal(err, "The exchange rate was saved but is not in use yet.")
+	}
+	http.Redirect(w, r, "/manage/currencies/", http.StatusSeeOther)
+	return nil
+}
+
+func DeleteExchangeRateHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	x, err := loadExchangeRate(r)
+	if err != nil {
+		return err
+	}
+	if _, err := dbFor(r).Delete(x); err != nil {
+		return Internal(err, "The exchange rate could not be deleted.")
+	}
+	if err := loadExchangeRates(r.Context()); err != nil {
+		return Internal(err, "The exchange rate was deleted but is still in use.")
+	}
+	http.Redirect(w, r, "/manage/currencies/", http.StatusSeeOther)
+	return nil
+}
+
+// PriceListEntry is a product on the price list page of one currency.
+type PriceListEntry struct {
+	Product   Product
+	Converted Money  // what the product costs without a listed price
+	Listed    string // the listed price as typed, empty when there is none
+}
+
+type PriceList struct {
+	Currency string
+	Entries  []PriceListEntry
+	Error    string
+	Fields   map[string]string
+}
+
+type PriceListPage struct {
+	User    string
+	Content PriceList
+}
+
+// priceList loads every product with its price in currency; typed holds
+// the values of a rejected post.
+func priceList(r *http.Request, currency string, typed map[string]string) (PriceList, error) {
+	l := PriceList{Currency: currency}
+	var products []Product
+	if _, err := dbFor(r).Select(&products, "SELECT * FROM products ORDER BY Name"); err != nil {
+		return l, err
+	}
+	pr, err := newPricer(dbFor(r), currency)
+	if err != nil {
+		return l, err
+	}
+	for _, p := range products {
+		e := PriceListEntry{Product: p}
+		e.Converted, _ = convert(p.RegularPrice(), currency)
+		if amount, ok := pr.list[p.Id]; ok {
+			e.Listed = Money{amount, currency}.Decimal()
+		}
+		if v, ok := typed[priceField(p.Id)]; ok {
+			e.Listed = v
+		}
+		l.Entries = append(l.Entries, e)
+	}
+	return l, nil
+}
+
+func priceField(id int64) string {
+	return "price_" + strconv.FormatInt(id, 10)
+}
+
+// PriceListHandler shows the price list of {code}: every product with its
+// converted price and the price set for the currency, if any.
+func PriceListHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	x, err := loadExchangeRate(r)
+	if err != nil {
+		return err
+	}
+	l, err := priceList(r, x.Currency, nil)
+	if err != nil {
+		return Internal(err, "The price list is unavailable right now.")
+	}
+	return renderer.Render(w, r, "manage_prices", PriceListPage{User: getStringFromSession(r, "User"), Content: l})
+}
+
+// SavePriceListHandler stores the listed prices of {code}. An empty price
+// takes the product off the list, so its price is converted again.
+func SavePriceListHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	x, err := loadExchangeRate(r)
+	if err != nil {
+		return err
+	}
+	if err := r.ParseForm(); err != nil {
+		return Validation("The form could not be read.")
+	}
+	var products []Product
+	if _, err := dbFor(r).Select(&products, "SELECT * FROM products ORDER BY Name"); err != nil {
+		return Internal(err, "The price list could not be saved.")
+	}
+	typed, fields := map[string]string{}, map[string]string{}
+	prices := map[int64]*Money{}
+	for _, p := range products {
+		name := priceField(p.Id)
+		v := strings.TrimSpace(r.PostFormValue(name))
+		typed[name] = v
+		if v == "" {
+			prices[p.Id] = nil
+			continue
+		}
+		m, err := parseMoney(v, x.Currency)
+		if err != nil {
+			fields[name] = p.Name + ": " + err.Error() + "."
+			continue
+		}
+		prices[p.Id] = &m
+	}
+	if len(fields) > 0 {
+		l, lerr := priceList(r, x.Currency, typed)
+		if lerr != nil {
+			return Internal(lerr, "The price list is unavailable right now.")
+		}
+		var msgs []string
+		for _, p := range products {
+			if msg, ok := fields[priceField(p.Id)]; ok {
+				msgs = append(msgs, msg)
+			}
+		}
+		l.Error, l.Fields = strings.Join(msgs, " "), fields
+		return renderer.RenderStatus(w, r, http.StatusBadRequest, "manage_prices", PriceListPage{User: getStringFromSession(r, "User"), Content: l})
+	}
+	db, user, now := dbFor(r), getStringFromSession(r, "User"), time.Now()
+	current, err := newPricer(db, x.Currency)
+	if err != nil {
+		return Internal(err, "The price list could not be saved.")
+	}
+	for id, m := range prices {
+		// Leave unchanged prices alone so they keep who set them and when.
+		amount, listed := current.list[id]
+		if m == nil && !listed || m != nil && listed && m.Amount == amount {
+			continue
+		}
+		if _, err := db.Exec("DELETE FROM productprices WHERE ProductId=? AND Currency=?", id, x.Currency); err != nil {
+			return Internal(err, "The price list could not be saved.")
+		}
+		change := PriceChange{ProductId: id, Kind: "list", Currency: x.Currency, Old: amount, ChangedBy: user, Changed: now}
+		if m != nil {
+			if err := db.Insert(&ProductPrice{ProductId: id, Currency: x.Currency, Amount: m.Amount, Updated: now, UpdatedBy: user}); err != nil {
+				return Internal(err, "The price list could not be saved.")
+			}
+			change.New = m.Amount
+		}
+		if err := db.Insert(&change); err != nil {
+			return Internal(err, "The price list could not be saved.")
+		}
+	}
+	http.Redirect(w, r, "/manage/currencies/"+x.Currency+"/prices/", http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+
+	"gopkg.in/gorp.v2"
+)
+
+// meteredDbMap wraps gorp.DbMap so that every query issued by the handlers
+// is timed, counted and logged. Schema helpers (AddTableWithName,
+// CreateTables...) are passed through untouched.
+type meteredDbMap struct {
+	*gorp.DbMap
+	exec gorp.SqlExecutor
+	ctx  context.Context
+}
+
+func newMeteredDbMap(m *gorp.DbMap) *meteredDbMap {
+	return &meteredDbMap{DbMap: m, exec: m, ctx: context.Background()}
+}
+
+// WithContext binds queries to ctx, so they are cancelled with the request
+// and logged with its request ID.
+func (m *meteredDbMap) WithContext(ctx context.Context) *meteredDbMap {
+	return &meteredDbMap{DbMap: m.DbMap, exec: m.DbMap.WithContext(ctx), ctx: ctx}
+}
+
+// dbFor returns dbmap bound to the context of r.
+func dbFor(r *http.Request) *meteredDbMap {
+	return dbmap.WithContext(r.Context())
+}
+
+func (m *meteredDbMap) observe(operation, query string, start time.Time, err error) {
+	observeDbQuery(operation, start, err)
+	fields := Fields{
+		"operation":  operation,
+		"latency_ms": float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if query != "" {
+		fields["query"] = query
+	}
+	if err != nil && err != sql.ErrNoRows {
+		fields["error"] = err
+		logger.Error(m.ctx, "db call failed", fields)
+		return
+	}
+	logger.Debug(m.ctx, "db call", fields)
+}
+
+func (m *meteredDbMap) Get(i interface{}, keys ...interface{}) (interface{}, error) {
+	start := time.Now()
+	obj, err := m.exec.Get(i, keys...)
+	m.observe("get", "", start, err)
+	return obj, err
+}
+
+func (m *meteredDbMap) Insert(list ...interface{}) error {
+	start := time.Now()
+	err := m.exec.Insert(list...)
+	m.observe("insert", "", start, err)
+	return err
+}
+
+func (m *meteredDbMap) Update(list ...interface{}) (int64, error) {
+	start := time.Now()
+	count, err := m.exec.Update(list...)
+	m.observe("update", "", start, err)
+	return count, err
+}
+
+func (m *meteredDbMap) Delete(list ...interface{}) (int64, error) {
+	start := time.Now()
+	count, err := m.exec.Delete(list...)
+	m.observe("delete", "", start, err)
+	return count, err
+}
+
+func (m *meteredDbMap) Select(i interface{}, query string, args ...interface{}) ([]interface{}, error) {
+	start := time.Now()
+	list, err := m.exec.Select(i, query, args...)
+	m.observe("select", query, start, err)
+	return list, err
+}
+
+func (m *meteredDbMap) SelectOne(holder interface{}, query string, args ...interface{}) error {
+	start := time.Now()
+	err := m.exec.SelectOne(holder, query, args...)
+	m.observe("select", query, start, err)
+	return err
+}
+
+func (m *meteredDbMap) SelectInt(query string, args ...interface{}) (int64, error) {
+	start := time.Now()
+	val, err := m.exec.SelectInt(query, args...)
+	m.observe("select", query, start, err)
+	return val, err
+}
+
+func (m *meteredDbMap) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := m.exec.Query(query, args...)
+	m.observe("query", query, start, err)
+	return rows, err
+}
+
+func (m *meteredDbMap) Exec(query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	res, err := m.exec.Exec(query, args...)
+	m.observe("exec", query, start, err)
+	return res, err
+}
+
+// meteredTx is a transaction begun by meteredDbMap.Begin. Its queries are
+// metered like the others; only the query methods run in the transaction,
+// not the schema helpers, Begin or WithContext.
+type meteredTx struct {
+	*meteredDbMap
+	tx *gorp.Transaction
+}
+
+// Begin starts a transaction bound to the context of m.
+func (m *meteredDbMap) Begin() (*meteredTx, error) {
+	start := time.Now()
+	tx, err := m.DbMap.Begin()
+	m.observe("begin", "", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &meteredTx{meteredDbMap: &meteredDbMap{DbMap: m.DbMap, exec: tx.WithContext(m.ctx), ctx: m.ctx}, tx: tx}, nil
+}
+
+func (t *meteredTx) Commit() error {
+	start := time.Now()
+	err := t.tx.Commit()
+	t.observe("commit", "", start, err)
+	return err
+}
+
+func (t *meteredTx) Rollback() error {
+	start := time.Now()
+	err := t.tx.Rollback()
+	t.observe("rollback", "", start, err)
+	return err
+}
+
+// columnMigration is a column added to a table after it was first created.
+// gorp only creates missing tables, so existing databases need an ALTER.
+type columnMigration struct {
+	Table      string
+	Column     string
+	Definition string
+}
+
+var columnMigrations = []columnMigration{
+	{"products", "Category", "varchar(255) NOT NULL DEFAULT ''"},
+	{"products", "Updated", "datetime NOT NULL DEFAULT CURRENT_TIMESTAMP"},
+	{"products", "Weight", "int NOT NULL DEFAULT 0"},
+	{"products", "Length", "int NOT NULL DEFAULT 0"},
+	{"products", "Width", "int NOT NULL DEFAULT 0"},
+	{"products", "Height", "int NOT NULL DEFAULT 0"},
+	{"products", "TaxClass", "varchar(32) NOT NULL DEFAULT 'standard'"},
+	// Prices used to be dollars in a float column.
+	{"products", "PriceAmount", "bigint NOT NULL DEFAULT 0"},
+	{"products", "PriceCurrency", "varchar(3) NOT NULL DEFAULT 'USD'"},
+	{"products", "SaleAmount", "bigint NOT NULL DEFAULT 0"},
+	{"products", "SaleEnds", "datetime NULL"},
+	{"products", "RatingAverage", "double NOT NULL DEFAULT 0"},
+	{"products", "RatingCount", "int NOT NULL DEFAULT 0"},
+	// Subscribers from before double opt-in count as confirmed.
+	{"subscribers", "Status", "varchar(16) NOT NULL DEFAULT 'active'"},
+	{"subscribers", "Created", "datetime NOT NULL DEFAULT CURRENT_TIMESTAMP"},
+	{"faqs", "Topic", "varchar(255) NOT NULL DEFAULT 'General'"},
+	{"faqs", "Position", "int NOT NULL DEFAULT 0"},
+	{"faqs", "Published", "tinyint(1) NOT NULL DEFAULT 1"},
+	{"faqs", "Updated", "datetime NOT NULL DEFAULT CURRENT_TIMESTAMP"},
+	{"contactinfos", "Status", "varchar(16) NOT NULL DEFAULT 'new'"},
+	{"contactinfos", "Assignee", "varchar(255) NOT NULL DEFAULT ''"},
+	{"contactinfos", "Created", "datetime NOT NULL DEFAULT CURRENT_TIMESTAMP"},
+	{"contactinfos", "Updated", "datetime NOT NULL DEFAULT CURRENT_TIMESTAMP"},
+	{"users", "name", "varchar(100) NOT NULL DEFAULT ''"},
+	{"users", "phone", "varchar(16) NOT NULL DEFAULT ''"},
+	{"users", "created", "datetime NOT NULL DEFAULT CURRENT_TIMESTAMP"},
+	{"pages", "PublishedRevision", "int NOT NULL DEFAULT 0"},
+}
+
+// columnBackfills fill a column from older data right after migrateDb
+// adds it, keyed by "table.column".
+var columnBackfills = map[string]string{
+	"products.PriceAmount":    "UPDATE products SET PriceAmount=ROUND(Price*100) WHERE Price IS NOT NULL",
+	"pages.PublishedRevision": "UPDATE pages SET PublishedRevision=Revision WHERE Status='published'",
+}
+
+// droppedColumns are columns no struct maps any more. gorp fails every
+// SELECT * on a table with a column it cannot map, so they are dropped
+// once columnMigrations and their backfills have run.
+var droppedColumns = []columnMigration{
+	// Replaced by PriceAmount and PriceCurrency.
+	{Table: "products", Column: "Price"},
+}
+
+func columnExists(table, column string) (bool, error) {
+	count, err := dbmap.SelectInt("SELECT count(*) FROM information_schema.columns WHERE table_schema = database() AND table_name = ? AND column_name = ?", table, column)
+	return count > 0, err
+}
+
+// migrateDb adds any column from columnMigrations that is missing and
+// drops the droppedColumns that are still there.
+func migrateDb() error {
+	for _, c := range columnMigrations {
+		exists, err := columnExists(c.Table, c.Column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := dbmap.Exec("ALTER TABLE " + c.Table + " ADD COLUMN " + c.Column + " " + c.Definition); err != nil {
+			return err
+		}
+		logger.Info(context.Background(), "column added", Fields{"table": c.Table, "column": c.Column})
+		if backfill, ok := columnBackfills[c.Table+"."+c.Column]; ok {
+			if _, err := dbmap.Exec(backfill); err != nil {
+				return err
+			}
+		}
+	}
+	for _, c := range droppedColumns {
+		exists, err := columnExists(c.Table, c.Column)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if _, err := dbmap.Exec("ALTER TABLE " + c.Table + " DROP COLUMN " + c.Column); err != nil {
+			return err
+		}
+		logger.Info(context.Background(), "column dropped", Fields{"table": c.Table, "column": c.Column})
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+
+	"github.com/urfave/negroni"
+)
+
+type errorKind int
+
+const (
+	KindInternal errorKind = iota
+	KindNotFound
+	KindValidation
+	KindConflict
+	KindUnauthorized
+	KindRateLimited
+)
+
+var errorKindNames = map[errorKind]string{
+	KindInternal:     "internal",
+	KindNotFound:     "not_found",
+	KindValidation:   "validation",
+	KindConflict:     "conflict",
+	KindUnauthorized: "unauthorized",
+	KindRateLimited:  "rate_limited",
+}
+
+var errorKindStatus = map[errorKind]int{
+	KindInternal:     http.StatusInternalServerError,
+	KindNotFound:     http.StatusNotFound,
+	KindValidation:   http.StatusBadRequest,
+	KindConflict:     http.StatusConflict,
+	KindUnauthorized: http.StatusUnauthorized,
+	KindRateLimited:  http.StatusTooManyRequests,
+}
+
+// AppError is an error a handler wants shown to the client. Message is
+// safe to display; Err is the underlying cause and is only logged.
+// Validation errors from bind also say what is wrong with each field.
+type AppError struct {
+	Kind    errorKind
+	Message string
+	Fields  map[string]string // form field name to message
+	Err     error
+}
+
+func (e *AppError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *AppError) Unwrap() error {
+	return e.Err
+}
+
+func NotFound(format string, args ...interface{}) error {
+	return &AppError{Kind: KindNotFound, Message: fmt.Sprintf(format, args...)}
+}
+
+func Validation(format string, args ...interface{}) error {
+	return &AppError{Kind: KindValidation, Message: fmt.Sprintf(format, args...)}
+}
+
+func Conflict(format string, args ...interface{}) error {
+	return &AppError{Kind: KindConflict, Message: fmt.Sprintf(format, args...)}
+}
+
+func Unauthorized(format string, args ...interface{}) error {
+	return &AppError{Kind: KindUnauthorized, Message: fmt.Sprintf(format, args...)}
+}
+
+func RateLimited(format string, args ...interface{}) error {
+	return &AppError{Kind: KindRateLimited, Message: fmt.Sprintf(format, args...)}
+}
+
+// Internal wraps err so that the client only sees msg.
+func Internal(err error, msg string) error {
+	return &AppError{Kind: KindInternal, Message: msg, Err: err}
+}
+
+// asAppError turns any error into an AppError, treating unknown errors as
+// internal ones.
+func asAppError(err error) *AppError {
+	var appErr *AppError
+	if errors.As(err, &appErr) {
+		return appErr
+	}
+	return &AppError{Kind: KindInternal, Message: "Something went wrong, please try again later.", Err: err}
+}
+
+// appHandler is a handler that reports failures by returning an error
+// instead of writing the response itself.
+type appHandler func(w http.ResponseWriter, r *http.Request) error
+
+func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := fn(w, r); err != nil {
+		writeError(w, r, err)
+	}
+}
+
+type ErrorResponse struct {
+	Error     string
+	Kind      string
+	Fields    map[string]string `json:",omitempty"`
+	RequestID string
+}
+
+type ErrorPage struct {
+	User    string
+	Content ContentReturn
+}
+
+// wantsJSON reports whether the client is one of the ajax callers rather
+// than a browser navigating to a page or submitting a form.
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return r.Header.Get("X-Requested-With") == "XMLHttpRequest" ||
+		strings.Contains(accept, "application/json") ||
+		!strings.Contains(accept, "text/html")
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	appErr := asAppError(err)
+	// Only messages without placeholders have a translation.
+	message := T(r, appErr.Message)
+	status := errorKindStatus[appErr.Kind]
+	fields := Fields{"kind": errorKindNames[appErr.Kind], "status": status, "error": appErr.Error()}
+	if appErr.Kind == KindInternal {
+		logger.Error(r.Context(), "request failed", fields)
+	} else {
+		logger.Debug(r.Context(), "request rejected", fields)
+	}
+
+	if nw, ok := w.(negroni.ResponseWriter); ok && nw.Written() {
+		return
+	}
+	var requestID, user string
+	if info := requestInfoFrom(r.Context()); info != nil {
+		requestID, user = info.ID, info.User
+	}
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: message, Kind: errorKindNames[appErr.Kind], Fields: appErr.Fields, RequestID: requestID})
+		return
+	}
+	p := ErrorPage{User: user, Content: ContentReturn{Error: message, Fields: appErr.Fields}}
+	if renderer == nil {
+		http.Error(w, message, status)
+		return
+	}
+	if rerr := renderer.RenderStatus(w, r, status, "error", p); rerr != nil {
+		logger.Error(r.Context(), "error page unavailable", Fields{"error": rerr})
+		http.Error(w, message, status)
+	}
+}
+
+// recoverPanics turns a panicking handler into a logged internal error
+// instead of a dropped connection.
+func recoverPanics(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+			logger.Error(r.Context(), "panic recovered", Fields{
+				"panic": fmt.Sprint(rec),
+				"stack": string(debug.Stack()),
+			})
+			writeError(w, r, Internal(fmt.Errorf("panic: %v", rec), "Something went wrong, please try again later."))
+		}
+	}()
+	next(w, r)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAsAppError(t *testing.T) {
+	cause := errors.New("connection refused")
+	tests := []struct {
+		err         error
+		wantKind    errorKind
+		wantMessage string
+	}{
+		{NotFound("Product %d does not exist.", 3), KindNotFound, "Product 3 does not exist."},
+		{Validation("Bad input."), KindValidation, "Bad input."},
+		{fmt.Errorf("saving: %w", Conflict("Taken.")), KindConflict, "Taken."},
+		{Internal(cause, "Try again later."), KindInternal, "Try again later."},
+		{cause, KindInternal, "Something went wrong, please try again later."},
+	}
+	for _, tt := range tests {
+		got := asAppError(tt.err)
+		if got.Kind != tt.wantKind || got.Message != tt.wantMessage {
+			t.Errorf("asAppError(%v) = %s %q, want %s %q", tt.err, errorKindNames[got.Kind], got.Message, errorKindNames[tt.wantKind], tt.wantMessage)
+		}
+	}
+	// The cause is kept for the log but not shown.
+	if err := Internal(cause, "Try again later."); !errors.Is(err, cause) || err.Error() != "Try again later.: connection refused" {
+		t.Errorf("Internal error %q does not wrap its cause", err)
+	}
+}
+
+func TestWantsJSON(t *testing.T) {
+	tests := []struct {
+		accept, requestedWith string
+		want                  bool
+	}{
+		{"text/html,application/xhtml+xml,*/*;q=0.8", "", false},
+		{"application/json", "", true},
+		{"text/html, */*", "XMLHttpRequest", true},
+		{"*/*", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept", tt.accept)
+		if tt.requestedWith != "" {
+			r.Header.Set("X-Requested-With", tt.requestedWith)
+		}
+		if got := wantsJSON(r); got != tt.want {
+			t.Errorf("wantsJSON(%q, %q) = %v, want %v", tt.accept, tt.requestedWith, got, tt.want)
+		}
+	}
+}
+
+func TestAppHandler(t *testing.T) {
+	captureLog(t, levelError)
+	tests := []struct {
+		err        error
+		wantStatus int
+		wantKind   string
+		wantError  string
+	}{
+		{nil, http.StatusOK, "", ""},
+		{NotFound("No such page."), http.StatusNotFound, "not_found", "No such page."},
+		{&AppError{Kind: KindValidation, Message: "Check the form.", Fields: map[string]string{"email": "Email is required."}}, http.StatusBadRequest, "validation", "Check the form."},
+		{Unauthorized("Please log in first."), http.StatusUnauthorized, "unauthorized", "Please log in first."},
+		{RateLimited("Slow down."), http.StatusTooManyRequests, "rate_limited", "Slow down."},
+		{Internal(errors.New("secret detail"), "Try again later."), http.StatusInternalServerError, "internal", "Try again later."},
+	}
+	for _, tt := range tests {
+		h := appHandler(func(w http.ResponseWriter, r *http.Request) error { return tt.err })
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%v: status %d, want %d", tt.err, w.Code, tt.wantStatus)
+		}
+		if tt.err == nil {
+			continue
+		}
+		var resp ErrorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Errorf("%v: body %q: %v", tt.err, w.Body.String(), err)
+			continue
+		}
+		if resp.Kind != tt.wantKind || resp.Error != tt.wantError {
+			t.Errorf("%v: got %s %q, want %s %q", tt.err, resp.Kind, resp.Error, tt.wantKind, tt.wantError)
+		}
+		if fields := asAppError(tt.err).Fields; len(fields) != len(resp.Fields) {
+			t.Errorf("%v: fields %v, want %v", tt.err, resp.Fields, fields)
+		}
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	captureLog(t, levelError)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	recoverPanics(w, r, func(w http.ResponseWriter, r *http.Request) { panic("nil map") })
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
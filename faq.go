@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	gmux "github.com/gorilla/mux"
+)
+
+// FAQTopic is a group of questions on the FAQ page. Topics appear in the
+// order of their first question.
+type FAQTopic struct {
+	Name   string
+	Anchor string
+	FAQs   []FAQ
+}
+
+type FAQList struct {
+	Query  string
+	Intro  template.HTML // the "faq" content page
+	Topics []FAQTopic
+}
+
+type FAQPage struct {
+	User    string
+	Content FAQList
+}
+
+// Anchor is the fragment linking straight to one question.
+func (f FAQ) Anchor() string {
+	return "faq-" + strconv.FormatInt(f.Id, 10)
+}
+
+// publishedFAQs returns the published questions in display order,
+// optionally only those mentioning query in English or in locale.
+func publishedFAQs(db *meteredDbMap, query, locale string) ([]FAQ, error) {
+	stmt, args := "SELECT * FROM faqs WHERE Published=1", []interface{}{}
+	if query != "" {
+		like := "%" + query + "%"
+		stmt = stmt + " AND (Question LIKE ? OR Answer LIKE ? OR Id IN " +
+			"(SELECT FAQId FROM faqtranslations WHERE Locale=? AND (Question LIKE ? OR Answer LIKE ?)))"
+		args = append(args, like, like, locale, like, like)
+	}
+	var faqs []FAQ
+	_, err := db.Select(&faqs, stmt+" ORDER BY Position, Id", args...)
+	return faqs, err
+}
+
+func groupFAQs(faqs []FAQ) []FAQTopic {
+	var topics []FAQTopic
+	index := map[string]int{}
+	for _, f := range faqs {
+		i, ok := index[f.Topic]
+		if !ok {
+			i = len(topics)
+			index[f.Topic] = i
+			topics = append(topics, FAQTopic{Name: f.Topic, Anchor: "topic-" + slugify(f.Topic)})
+		}
+		topics[i].FAQs = append(topics[i].FAQs, f)
+	}
+	return topics
+}
+
+func FAQHandler(w http.ResponseWriter, r *http.Request) error {
+	query := strings.TrimSpace(r.FormValue("q"))
+	faqs, err := publishedFAQs(dbFor(r), query, localeFor(r))
+	if err == nil {
+		err = localizeFAQs(r, faqs)
+	}
+	if err != nil {
+		return Internal(err, "FAQs are unavailable right now, please try again later.")
+	}
+	intro, err := publishedPage(dbFor(r), "faq")
+	if err != nil {
+		return Internal(err, "FAQs are unavailable right now, please try again later.")
+	}
+	p := FAQPage{User: getStringFromSession(r, "User"), Content: FAQList{Query: query, Topics: groupFAQs(faqs)}}
+	if intro != nil {
+		p.Content.Intro = intro.HTML()
+	}
+	return renderer.Render(w, r, "FAQ", p)
+}
+
+func FAQDataHandler(w http.ResponseWriter, r *http.Request) error {
+	results, err := publishedFAQs(dbFor(r), "", localeFor(r))
+	if err == nil {
+		err = localizeFAQs(r, results)
+	}
+	if err != nil {
+		return Internal(err, "FAQs are unavailable right now, please try again later.")
+	}
+	if results == nil {
+		results = []FAQ{}
+	}
+	encoder := json.NewEncoder(w)
+	return encoder.Encode(results)
+}
+
+type FAQAdmin struct {
+	FAQs   []FAQ
+	Topics []string
+	Edit   FAQ
+	Error  string
+}
+
+type FAQAdminPage struct {
+	User    string
+	Content FAQAdmin
+}
+
+func faqAdmin(r *http.Request, edit FAQ) (FAQAdmin, error) {
+	a := FAQAdmin{Edit: edit}
+	if _, err := dbFor(r).Select(&a.FAQs, "SELECT * FROM faqs ORDER BY Position, Id"); err != nil {
+		return a, err
+	}
+	seen := map[string]bool{}
+	for _, f := range a.FAQs {
+		if !seen[f.Topic] {
+			seen[f.Topic] = true
+			a.Topics = append(a.Topics, f.Topic)
+		}
+	}
+	return a, nil
+}
+
+// ManageFAQsHandler lists every question, drafts included, next to a
+// form for adding a new one or editing the one given by {id}.
+func ManageFAQsHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	edit := FAQ{Topic: "General", Published: true}
+	if gmux.Vars(r)["id"] != "" {
+		f, err := loadFAQ(r)
+		if err != nil {
+			return err
+		}
+		edit = *f
+	}
+	a, err := faqAdmin(r, edit)
+	if err != nil {
+		return Internal(err, "The FAQ admin is unavailable right now.")
+	}
+	if edit.Id == 0 {
+		// New questions go to the end unless the admin says otherwise.
+		if n := len(a.FAQs); n > 0 {
+			a.Edit.Position = a.FAQs[n-1].Position + 1
+		}
+	}
+	return renderer.Render(w, r, "manage_faqs", FAQAdminPage{User: getStringFromSession(r, "User"), Content: a})
+}
+
+func loadFAQ(r *http.Request) (*FAQ, error) {
+	id, _ := strconv.ParseInt(gmux.Vars(r)["id"], 10, 64)
+	obj, err := dbFor(r).Get(FAQ{}, id)
+	if err != nil {
+		return nil, Internal(err, "The question could not be loaded.")
+	}
+	if obj == nil {
+		return nil, NotFound("Question %d does not exist.", id)
+	}
+	return obj.(*FAQ), nil
+}
+
+// SaveFAQHandler creates a question, or updates it when the route has an
+// {id}.
+func SaveFAQHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	f := &FAQ{}
+	if gmux.Vars(r)["id"] != "" {
+		var err error
+		if f, err = loadFAQ(r); err != nil {
+			return err
+		}
+	}
+	f.Updated = time.Now()
+	if err := bind(r, f); err != nil {
+		a, aerr := faqAdmin(r, *f)
+		if aerr != nil {
+			return Internal(aerr, "The FAQ admin is unavailable right now.")
+		}
+		a.Error = asAppError(err).Message
+		return renderer.RenderStatus(w, r, http.StatusBadRequest, "manage_faqs", FAQAdminPage{User: getStringFromSession(r, "User"), Content: a})
+	}
+	var err error
+	if f.Id == 0 {
+		err = dbFor(r).Insert(f)
+	} else {
+		_, err = dbFor(r).Update(f)
+	}
+	if err != nil {
+		return Internal(err, "The question could not be saved.")
+	}
+	http.Redirect(w, r, "/manage/faqs/", http.StatusSeeOther)
+	return nil
+}
+
+func DeleteFAQHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	f, err := loadFAQ(r)
+	if err != nil {
+		return err
+	}
+	if err := deleteFAQ(dbFor(r), f); err != nil {
+		return Internal(err, "The question could not be deleted.")
+	}
+	http.Redirect(w, r, "/manage/faqs/", http.StatusSeeOther)
+	return nil
+}
+
+// deleteFAQ deletes f with its translations in one transaction.
+func deleteFAQ(db *meteredDbMap, f *FAQ) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM faqtranslations WHERE FAQId=?", f.Id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Delete(f); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
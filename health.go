@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// shuttingDown is set once SIGTERM arrives so that the load balancer stops
+// sending new traffic while in-flight requests drain.
+var shuttingDown int32
+
+type HealthStatus struct {
+	Status string
+	Checks map[string]string `json:",omitempty"`
+}
+
+// HealthzHandler reports that the process is up. It never touches the
+// database so a slow DB does not get the instance restarted.
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(HealthStatus{Status: "ok"})
+}
+
+// ReadyzHandler reports whether this instance can serve traffic.
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	p := HealthStatus{Status: "ok", Checks: map[string]string{}}
+	ready := true
+
+	if atomic.LoadInt32(&shuttingDown) == 1 {
+		p.Checks["shutdown"] = "in progress"
+		ready = false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	// The reasons are logged rather than shown, as /readyz is public.
+	if err := db.PingContext(ctx); err != nil {
+		logger.Error(r.Context(), "readiness check failed", Fields{"check": "database", "error": err})
+		p.Checks["database"] = "unavailable"
+		ready = false
+	} else {
+		p.Checks["database"] = "ok"
+	}
+
+	if err := renderer.Check(); err != nil {
+		logger.Error(r.Context(), "readiness check failed", Fields{"check": "templates", "error": err})
+		p.Checks["templates"] = "unavailable"
+		ready = false
+	} else {
+		p.Checks["templates"] = "ok"
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if !ready {
+		p.Status = "unavailable"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	sessions "github.com/goincremental/negroni-sessions"
+)
+
+// localeFormat is how a locale writes numbers and prices.
+type localeFormat struct {
+	Name        string // in its own language, for the picker
+	Group       string // thousands separator
+	Decimal     string
+	SymbolAfter bool // "14,99 €" rather than "€14.99"
+}
+
+// localeFormats are the locales the shop can be shown in. Which of them
+// visitors are offered is configured with WILDVIEW_LOCALES.
+var localeFormats = map[string]localeFormat{
+	"en": {"English", ",", ".", false},
+	"de": {"Deutsch", ".", ",", true},
+	"fr": {"Français", "\u202f", ",", true}, // narrow no-break space
+	"es": {"Español", ".", ",", true},
+}
+
+// catalogs hold the translations of every locale but config.Locale,
+// keyed by the message as written in the templates and handlers.
+// Messages with placeholders are keyed by their fmt format.
+var catalogs = map[string]map[string]string{}
+
+// loadCatalogs reads <locale>.json from dir for every offered locale.
+// A locale without a file shows the original messages.
+func loadCatalogs(dir string) error {
+	loaded := map[string]map[string]string{}
+	for _, locale := range config.Locales {
+		if locale == config.Locale {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, locale+".json"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		catalog := map[string]string{}
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			return fmt.Errorf("%s.json: %v", locale, err)
+		}
+		loaded[locale] = catalog
+	}
+	catalogs = loaded
+	return nil
+}
+
+// translate returns msg in locale, or msg itself when it has no
+// translation.
+func translate(locale, msg string) string {
+	if t, ok := catalogs[locale][msg]; ok && t != "" {
+		return t
+	}
+	return msg
+}
+
+// T translates msg into the request's locale and fills in args like
+// fmt.Sprintf.
+func T(r *http.Request, msg string, args ...interface{}) string {
+	msg = translate(localeFor(r), msg)
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+type localeKey struct{}
+
+// localeFor returns the locale negotiateLocale picked for r.
+func localeFor(r *http.Request) string {
+	if locale, ok := r.Context().Value(localeKey{}).(string); ok {
+		return locale
+	}
+	return config.Locale
+}
+
+// negotiateLocale picks the locale of each request: a /{locale}/ prefix
+// on the path, which is removed before routing and remembered in the
+// session, then the session, then Accept-Language, then config.Locale.
+// It must run after the session middleware.
+func negotiateLocale(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	locale := ""
+	if parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2); len(parts) == 2 && contains(config.Locales, parts[0]) {
+		locale = parts[0]
+		r.URL.Path, r.URL.RawPath = "/"+parts[1], ""
+		sessions.GetSession(r).Set("Locale", locale)
+	} else if l := getStringFromSession(r, "Locale"); contains(config.Locales, l) {
+		locale = l
+	} else {
+		locale = acceptedLocale(r.Header.Get("Accept-Language"))
+	}
+	w.Header().Set("Content-Language", locale)
+	// Without a prefix the same URL is served in the language of the
+	// session or of Accept-Language, so caches must tell them apart.
+	w.Header().Add("Vary", "Accept-Language, Cookie")
+	next(w, r.WithContext(context.WithValue(r.Context(), localeKey{}, locale)))
+}
+
+// acceptedLocale returns the offered locale the Accept-Language header
+// prefers, e.g. "de" for "de-CH, en;q=0.8", or config.Locale.
+func acceptedLocale(header string) string {
+	type choice struct {
+		locale string
+		q      float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		lang := strings.ToLower(strings.TrimSpace(fields[0]))
+		if i := strings.IndexAny(lang, "-_"); i >= 0 {
+			lang = lang[:i]
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			if v := strings.TrimSpace(f); strings.HasPrefix(v, "q=") {
+				if n, err := strconv.ParseFloat(v[2:], 64); err == nil {
+					q = n
+				}
+			}
+		}
+		if q > 0 && contains(config.Locales, lang) {
+			choices = append(choices, choice{lang, q})
+		}
+	}
+	if len(choices) == 0 {
+		return config.Locale
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+	return choices[0].locale
+}
+
+// SetLocaleHandler remembers the language the visitor picked and sends
+// them back to the page they came from.
+func SetLocaleHandler(w http.ResponseWriter, r *http.Request) error {
+	locale := strings.ToLower(r.FormValue("locale"))
+	if !contains(config.Locales, locale) {
+		return Validation("The shop is not available in %q.", r.FormValue("locale"))
+	}
+	sessions.GetSession(r).Set("Locale", locale)
+	back := backPath(r)
+	// A locale prefix is dropped so it does not override the choice.
+	if parts := strings.SplitN(strings.TrimPrefix(back, "/"), "/", 2); len(parts) == 2 && contains(config.Locales, parts[0]) {
+		back = "/" + parts[1]
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+	return nil
+}
+
+// LocaleChoice feeds the language picker.
+type LocaleChoice struct {
+	Current string
+	Options []LocaleOption
+}
+
+type LocaleOption struct {
+	Locale string
+	Name   string
+}
+
+func localeChoice(locale string) LocaleChoice {
+	c := LocaleChoice{Current: locale}
+	for _, l := range config.Locales {
+		c.Options = append(c.Options, LocaleOption{Locale: l, Name: localeFormats[l].Name})
+	}
+	return c
+}
+
+// localizedURL adds the /{locale}/ prefix to a path or to an absolute URL
+// on config.BaseURL. The default locale has no prefix.
+func localizedURL(locale, u string) string {
+	if locale == config.Locale || u == "" {
+		return u
+	}
+	base := ""
+	if strings.HasPrefix(u, config.BaseURL+"/") {
+		base, u = config.BaseURL, strings.TrimPrefix(u, config.BaseURL)
+	}
+	if !strings.HasPrefix(u, "/") {
+		return base + u
+	}
+	return base + "/" + locale + u
+}
+
+// Alternate is a <link rel="alternate" hreflang> of a page.
+type Alternate struct {
+	Lang string // a locale or x-default
+	URL  string
+}
+
+// alternates lists the page at u in every offered locale, and the
+// unprefixed URL as x-default.
+func alternates(u string) []Alternate {
+	list := []Alternate{}
+	for _, l := range config.Locales {
+		list = append(list, Alternate{Lang: l, URL: localizedURL(l, u)})
+	}
+	return append(list, Alternate{Lang: "x-default", URL: u})
+}
+
+// formatNumber writes a plain decimal such as "-1234.5" the way locale
+// does, e.g. "-1.234,5" in German.
+func formatNumber(locale, decimal string) string {
+	f, ok := localeFormats[locale]
+	if !ok {
+		f = localeFormats["en"]
+	}
+	sign := ""
+	if strings.HasPrefix(decimal, "-") {
+		sign, decimal = "-", decimal[1:]
+	}
+	whole, frac := decimal, ""
+	if i := strings.Index(decimal, "."); i >= 0 {
+		whole, frac = decimal[:i], decimal[i+1:]
+	}
+	var b strings.Builder
+	for i, digit := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteString(f.Group)
+		}
+		b.WriteRune(digit)
+	}
+	if frac != "" {
+		b.WriteString(f.Decimal + frac)
+	}
+	return sign + b.String()
+}
+
+// formatMoney writes m the way locale does, e.g. "$1,234.50" in English
+// and "1.234,50 $" in German.
+func formatMoney(locale string, m Money) string {
+	symbol := m.Currency + " "
+	if info, ok := currencies[m.Currency]; ok {
+		symbol = info.Symbol
+	}
+	s := formatNumber(locale, m.Decimal())
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	if localeFormats[locale].SymbolAfter {
+		return sign + s + " " + strings.TrimSpace(symbol)
+	}
+	return sign + symbol + s
+}
+
+// localeFuncs are the template functions that depend on the locale of
+// the request; Renderer adds them to every page it renders.
+func localeFuncs(locale string) template.FuncMap {
+	return template.FuncMap{
+		"t": func(msg string, args ...interface{}) string {
+			msg = translate(locale, msg)
+			if len(args) > 0 {
+				return fmt.Sprintf(msg, args...)
+			}
+			return msg
+		},
+		"lang": func() string { return locale },
+		"number": func(v interface{}) string {
+			switch n := v.(type) {
+			case float64:
+				return formatNumber(locale, strconv.FormatFloat(n, 'f', 1, 64))
+			default:
+				return formatNumber(locale, fmt.Sprint(n))
+			}
+		},
+		"price": func(v interface{}) string {
+			switch m := v.(type) {
+			case Money:
+				return formatMoney(locale, m)
+			case *Money:
+				if m != nil {
+					return formatMoney(locale, *m)
+				}
+			}
+			return ""
+		},
+		"productName": func(p Product) string { return productName(locale, p) },
+		"locales":     func() LocaleChoice { return localeChoice(locale) },
+		"localized":   func(u string) string { return localizedURL(locale, u) },
+		"alternates":  alternates,
+	}
+}
+
+// ProductTranslation is a product's name in another locale.
+type ProductTranslation struct {
+	Id        int64  `db:"Id"`
+	ProductId int64  `db:"ProductId"`
+	Locale    string `db:"Locale,size:8"`
+	Name      string `db:"Name"`
+}
+
+// FAQTranslation is a question and answer in another locale.
+type FAQTranslation struct {
+	Id       int64  `db:"Id"`
+	FAQId    int64  `db:"FAQId"`
+	Locale   string `db:"Locale,size:8"`
+	Question string `db:"Question"`
+	Answer   string `db:"Answer"`
+}
+
+// productNames caches the producttranslations table, as product names are
+// on almost every page.
+var productNames struct {
+	sync.RWMutex
+	byLocale map[string]map[int64]string
+}
+
+// loadProductNames refreshes the cache. It runs at start up, after every
+// change and as a job, like loadExchangeRates.
+func loadProductNames(ctx context.Context) error {
+	var list []ProductTranslation
+	if _, err := dbmap.WithContext(ctx).Select(&list, "SELECT * FROM producttranslations"); err != nil {
+		return err
+	}
+	byLocale := map[string]map[int64]string{}
+	for _, t := range list {
+		if byLocale[t.Locale] == nil {
+			byLocale[t.Locale] = map[int64]string{}
+		}
+		byLocale[t.Locale][t.ProductId] = t.Name
+	}
+	productNames.Lock()
+	productNames.byLocale = byLocale
+	productNames.Unlock()
+	return nil
+}
+
+// productName is the name of p in locale. Product URLs keep the original
+// name, so they stay the same in every language.
+func productName(locale string, p Product) string {
+	productNames.RLock()
+	defer productNames.RUnlock()
+	if name := productNames.byLocale[locale][p.Id]; name != "" {
+		return name
+	}
+	return p.Name
+}
+
+// localizeProducts translates the names of products in place, for the
+// JSON endpoints.
+func localizeProducts(r *http.Request, products []Product) {
+	locale := localeFor(r)
+	for i := range products {
+		products[i].Name = productName(locale, products[i])
+	}
+}
+
+// localizeFAQs translates faqs in place into the request's locale.
+func localizeFAQs(r *http.Request, faqs []FAQ) error {
+	locale := localeFor(r)
+	if locale == config.Locale || len(faqs) == 0 {
+		return nil
+	}
+	var list []FAQTranslation
+	if _, err := dbFor(r).Select(&list, "SELECT * FROM faqtranslations WHERE Locale=?", locale); err != nil {
+		return err
+	}
+	byFAQ := map[int64]FAQTranslation{}
+	for _, t := range list {
+		byFAQ[t.FAQId] = t
+	}
+	for i := range faqs {
+		if t, ok := byFAQ[faqs[i].Id]; ok {
+			if t.Question != "" {
+				faqs[i].Question = t.Question
+			}
+			if t.Answer != "" {
+				faqs[i].Answer = t.Answer
+			}
+		}
+	}
+	return nil
+}
+
+type TranslationRow struct {
+	Id          int64
+	Original    string
+	Translation string
+}
+
+type FAQTranslationRow struct {
+	FAQ         FAQ
+	Translation FAQTranslation
+}
+
+type TranslationAdmin struct {
+	Locale   string
+	Locales  []LocaleOption // every offered locale but config.Locale
+	Products []TranslationRow
+	FAQs     []FAQTranslationRow
+	Saved    bool
+	Error    string
+}
+
+type TranslationAdminPage struct {
+	User    string
+	Content TranslationAdmin
+}
+
+// translationLocale is the locale the translations admin edits, from the
+// locale parameter, or the first offered locale that needs translating.
+func translationLocale(r *http.Request) (string, []LocaleOption, error) {
+	var options []LocaleOption
+	for _, o := range localeChoice(config.Locale).Options {
+		if o.Locale != config.Locale {
+			options = append(options, o)
+		}
+	}
+	if len(options) == 0 {
+		return "", nil, NotFound("The shop is only offered in one language, so there is nothing to translate.")
+	}
+	locale := r.FormValue("locale")
+	if locale == "" {
+		return options[0].Locale, options, nil
+	}
+	for _, o := range options {
+		if o.Locale == locale {
+			return locale, options, nil
+		}
+	}
+	return "", nil, Validation("The shop is not translated into %q.", locale)
+}
+
+func renderTranslationAdmin(w http.ResponseWriter, r *http.Request, status int, a TranslationAdmin) error {
+	db := dbFor(r)
+	var products []Product
+	if _, err := db.Select(&products, "SELECT * FROM products ORDER BY Name"); err != nil {
+		return Internal(err, "Translations are unavailable right now.")
+	}
+	var faqs []FAQ
+	if _, err := db.Select(&faqs, "SELECT * FROM faqs ORDER BY Position, Id"); err != nil {
+		return Internal(err, "Translations are unavailable right now.")
+	}
+	var faqTranslations []FAQTranslation
+	if _, err := db.Select(&faqTranslations, "SELECT * FROM faqtranslations WHERE Locale=?", a.Locale); err != nil {
+		return Internal(err, "Translations are unavailable right now.")
+	}
+	byFAQ := map[int64]FAQTranslation{}
+	for _, t := range faqTranslations {
+		byFAQ[t.FAQId] = t
+	}
+	for _, p := range products {
+		row := TranslationRow{Id: p.Id, Original: p.Name}
+		if name := productName(a.Locale, p); name != p.Name {
+			row.Translation = name
+		}
+		a.Products = append(a.Products, row)
+	}
+	for _, f := range faqs {
+		a.FAQs = append(a.FAQs, FAQTranslationRow{FAQ: f, Translation: byFAQ[f.Id]})
+	}
+	return renderer.RenderStatus(w, r, status, "manage_translations", TranslationAdminPage{User: getStringFromSession(r, "User"), Content: a})
+}
+
+// ManageTranslationsHandler lists the product names and FAQs next to their
+// translations into one locale.
+func ManageTranslationsHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	locale, options, err := translationLocale(r)
+	if err != nil {
+		return err
+	}
+	a := TranslationAdmin{Locale: locale, Locales: options, Saved: r.FormValue("saved") != ""}
+	return renderTranslationAdmin(w, r, http.StatusOK, a)
+}
+
+// SaveTranslationsHandler replaces the translations into one locale with
+// the posted name_<id>, question_<id> and answer_<id> fields. A field left
+// empty shows the original text.
+func SaveTranslationsHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	locale, options, err := translationLocale(r)
+	if err != nil {
+		return err
+	}
+	db := dbFor(r)
+	var products []Product
+	if _, err := db.Select(&products, "SELECT * FROM products"); err != nil {
+		return Internal(err, "The translations could not be saved.")
+	}
+	var faqs []FAQ
+	if _, err := db.Select(&faqs, "SELECT * FROM faqs"); err != nil {
+		return Internal(err, "The translations could not be saved.")
+	}
+	var names []ProductTranslation
+	for _, p := range products {
+		if name := strings.TrimSpace(r.FormValue("name_" + strconv.FormatInt(p.Id, 10))); name != "" {
+			names = append(names, ProductTranslation{ProductId: p.Id, Locale: locale, Name: name})
+		}
+	}
+	var entries []FAQTranslation
+	for _, f := range faqs {
+		id := strconv.FormatInt(f.Id, 10)
+		t := FAQTranslation{FAQId: f.Id, Locale: locale, Question: strings.TrimSpace(r.FormValue("question_" + id)), Answer: strings.TrimSpace(r.FormValue("answer_" + id))}
+		if utf8.RuneCountInString(t.Question) > 255 || utf8.RuneCountInString(t.Answer) > 255 {
+			a := TranslationAdmin{Locale: locale, Locales: options, Error: "Questions and answers must be at most 255 characters."}
+			return renderTranslationAdmin(w, r, http.StatusBadRequest, a)
+		}
+		if t.Question != "" || t.Answer != "" {
+			entries = append(entries, t)
+		}
+	}
+	if err := replaceTranslations(db, locale, names, entries); err != nil {
+		return Internal(err, "The translations could not be saved.")
+	}
+	if err := loadProductNames(r.Context()); err != nil {
+		logger.Error(r.Context(), "product translations not reloaded", Fields{"error": err})
+	}
+	http.Redirect(w, r, "/manage/translations/?locale="+url.QueryEscape(locale)+"&saved=1", http.StatusSeeOther)
+	return nil
+}
+
+func replaceTranslations(db *meteredDbMap, locale string, names []ProductTranslation, faqs []FAQTranslation) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"producttranslations", "faqtranslations"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE Locale=?", locale); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for i := range names {
+		if err := tx.Insert(&names[i]); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for i := range faqs {
+		if err := tx.Insert(&faqs[i]); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
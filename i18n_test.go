@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func setLocales(t *testing.T) {
+	t.Helper()
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.Locale, config.Locales, config.BaseURL = "en", []string{"en", "de", "fr"}, "http://example.com"
+}
+
+func TestAcceptedLocale(t *testing.T) {
+	setLocales(t)
+	tests := []struct {
+		header, want string
+	}{
+		{"de-CH, en;q=0.8", "de"},
+		{"fr;q=0.5, de;q=0.9", "de"},
+		{"en-US,en;q=0.9", "en"},
+		{"DE", "de"},
+		{"xx, fr;q=0.2", "fr"},
+		{"de;q=0, fr;q=0.1", "fr"},
+		{"es", "en"},
+		{"*", "en"},
+		{"", "en"},
+	}
+	for _, tt := range tests {
+		if got := acceptedLocale(tt.header); got != tt.want {
+			t.Errorf("acceptedLocale(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestFormatNumber(t *testing.T) {
+	tests := []struct {
+		locale, decimal, want string
+	}{
+		{"en", "1234567.5", "1,234,567.5"},
+		{"en", "-1234.5", "-1,234.5"},
+		{"en", "12", "12"},
+		{"de", "1234567.5", "1.234.567,5"},
+		{"de", "0.5", "0,5"},
+		{"fr", "-1234.5", "-1\u202f234,5"},
+	}
+	for _, tt := range tests {
+		if got := formatNumber(tt.locale, tt.decimal); got != tt.want {
+			t.Errorf("formatNumber(%s, %q) = %q, want %q", tt.locale, tt.decimal, got, tt.want)
+		}
+	}
+}
+
+func TestFormatMoney(t *testing.T) {
+	tests := []struct {
+		locale string
+		m      Money
+		want   string
+	}{
+		{"en", Money{123450, "USD"}, "$1,234.50"},
+		{"en", Money{-500, "EUR"}, "-€5.00"},
+		{"en", Money{150000, "JPY"}, "¥150,000"},
+		{"de", Money{123450, "USD"}, "1.234,50 $"},
+		{"de", Money{-500, "EUR"}, "-5,00 €"},
+		{"fr", Money{150000, "JPY"}, "150\u202f000 ¥"},
+		{"fr", Money{99, "GBP"}, "0,99 £"},
+	}
+	for _, tt := range tests {
+		if got := formatMoney(tt.locale, tt.m); got != tt.want {
+			t.Errorf("formatMoney(%s, %v) = %q, want %q", tt.locale, tt.m, got, tt.want)
+		}
+	}
+}
+
+func TestLocalizedURL(t *testing.T) {
+	setLocales(t)
+	tests := []struct {
+		locale, u, want string
+	}{
+		{"en", "http://example.com/products/", "http://example.com/products/"},
+		{"de", "http://example.com/products/", "http://example.com/de/products/"},
+		{"fr", "/product/3-tool-set/", "/fr/product/3-tool-set/"},
+		{"de", "https://elsewhere.com/", "https://elsewhere.com/"},
+		{"de", "", ""},
+	}
+	for _, tt := range tests {
+		if got := localizedURL(tt.locale, tt.u); got != tt.want {
+			t.Errorf("localizedURL(%s, %q) = %q, want %q", tt.locale, tt.u, got, tt.want)
+		}
+	}
+}
+
+// templateMessage matches the message of a {{t}} call.
+var templateMessage = regexp.MustCompile("{{t (\"(?:[^\"\\\\]|\\\\.)*\"|`[^`]*`)")
+
+// TestCatalogsCoverTemplates checks every message of the visitor pages
+// has a translation. The admin pages are only shown in English.
+func TestCatalogsCoverTemplates(t *testing.T) {
+	setLocales(t)
+	saved := catalogs
+	t.Cleanup(func() { catalogs = saved })
+	if err := loadCatalogs("locales"); err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob("templates/*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		name := filepath.Base(f)
+		if strings.HasPrefix(name, "manage") || name == "header_admin.html" {
+			continue
+		}
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range templateMessage.FindAllStringSubmatch(string(data), -1) {
+			msg, err := strconv.Unquote(m[1])
+			if err != nil {
+				t.Errorf("%s: %s: %v", name, m[1], err)
+				continue
+			}
+			for _, locale := range []string{"de", "fr"} {
+				if catalogs[locale][msg] == "" {
+					t.Errorf("%s: %q has no %s translation", name, msg, locale)
+				}
+			}
+		}
+	}
+}
+
+func TestTemplatesParse(t *testing.T) {
+	setLocales(t)
+	if _, err := NewRenderer("templates", false); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Background jobs run for the life of the process and are stopped by
+// serve once the HTTP server has drained.
+var (
+	jobsCtx, stopJobs = context.WithCancel(context.Background())
+	jobs              sync.WaitGroup
+)
+
+// startJob calls fn every interval until shutdown. A panicking run is
+// logged and the job carries on with the next tick.
+func startJob(name string, interval time.Duration, fn func(ctx context.Context) error) {
+	jobs.Add(1)
+	go func() {
+		defer jobs.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-jobsCtx.Done():
+				return
+			case <-ticker.C:
+				runJob(name, fn)
+			}
+		}
+	}()
+}
+
+func runJob(name string, fn func(ctx context.Context) error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			logger.Error(jobsCtx, "job panicked", Fields{"job": name, "panic": fmt.Sprint(rec)})
+		}
+	}()
+	if err := fn(jobsCtx); err != nil && jobsCtx.Err() == nil {
+		logger.Error(jobsCtx, "job failed", Fields{"job": name, "error": err})
+	}
+}
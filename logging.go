@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	gmux "github.com/gorilla/mux"
+	"github.com/urfave/negroni"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+func parseLogLevel(name string) (logLevel, error) {
+	for level, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return level, nil
+		}
+	}
+	return levelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+// Fields are the extra key/value pairs attached to a log entry.
+type Fields map[string]interface{}
+
+// Logger writes one JSON object per line. Entries logged with a request
+// context carry that request's ID.
+type Logger struct {
+	mu    sync.Mutex
+	out   io.Writer
+	level logLevel
+}
+
+var logger = &Logger{out: os.Stdout, level: levelInfo}
+
+// initLogger applies the configured level and output to the package logger.
+func initLogger(cfg Config) error {
+	level, err := parseLogLevel(cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+	var out io.Writer
+	switch cfg.LogOutput {
+	case "", "stdout":
+		out = os.Stdout
+	case "stderr":
+		out = os.Stderr
+	default:
+		f, err := os.OpenFile(cfg.LogOutput, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		out = f
+	}
+	logger.mu.Lock()
+	logger.out, logger.level = out, level
+	logger.mu.Unlock()
+	return nil
+}
+
+func (l *Logger) log(ctx context.Context, level logLevel, msg string, fields Fields) {
+	if level < l.level {
+		return
+	}
+	entry := Fields{}
+	for k, v := range fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		entry[k] = v
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = levelNames[level]
+	entry["msg"] = msg
+	if info := requestInfoFrom(ctx); info != nil {
+		entry["request_id"] = info.ID
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(Fields{"time": entry["time"], "level": "error", "msg": "unencodable log entry: " + err.Error()})
+	}
+	l.mu.Lock()
+	l.out.Write(append(line, '\n'))
+	l.mu.Unlock()
+}
+
+func (l *Logger) Debug(ctx context.Context, msg string, fields Fields) {
+	l.log(ctx, levelDebug, msg, fields)
+}
+
+func (l *Logger) Info(ctx context.Context, msg string, fields Fields) {
+	l.log(ctx, levelInfo, msg, fields)
+}
+
+func (l *Logger) Warn(ctx context.Context, msg string, fields Fields) {
+	l.log(ctx, levelWarn, msg, fields)
+}
+
+func (l *Logger) Error(ctx context.Context, msg string, fields Fields) {
+	l.log(ctx, levelError, msg, fields)
+}
+
+// requestInfo is shared by the middleware chain through the request
+// context. Later middleware fill in what they learn about the request.
+type requestInfo struct {
+	ID   string
+	User string
+}
+
+type requestInfoKey struct{}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	if ctx == nil {
+		return nil
+	}
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestLogger assigns every request an ID, taken from X-Request-ID when
+// the caller supplied one, and logs the request once it has been served.
+// It must run before the session middleware because it replaces r.
+func requestLogger(router *gmux.Router) negroni.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		start := time.Now()
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 128 {
+			id = newRequestID()
+		}
+		info := &requestInfo{ID: id}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+		w.Header().Set("X-Request-ID", id)
+
+		next(w, r)
+
+		status := http.StatusOK
+		if nw, ok := w.(negroni.ResponseWriter); ok && nw.Status() != 0 {
+			status = nw.Status()
+		}
+		logger.Info(r.Context(), "request", Fields{
+			"method":     r.Method,
+			"path":       r.URL.Path,
+			"route":      routeTemplate(router, r),
+			"status":     status,
+			"latency_ms": float64(time.Since(start).Microseconds()) / 1000,
+			"user":       info.User,
+			"remote":     r.RemoteAddr,
+		})
+	}
+}
+
+// tagRequestUser records the session user on the request info so that the
+// request log line can include it.
+func tagRequestUser(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if info := requestInfoFrom(r.Context()); info != nil {
+		info.User = getStringFromSession(r, "User")
+	}
+	next(w, r)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gmux "github.com/gorilla/mux"
+	"github.com/urfave/negroni"
+)
+
+// captureLog sends the package logger to a buffer at level until the test
+// ends.
+func captureLog(t *testing.T, level logLevel) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	logger.mu.Lock()
+	out, saved := logger.out, logger.level
+	logger.out, logger.level = &buf, level
+	logger.mu.Unlock()
+	t.Cleanup(func() {
+		logger.mu.Lock()
+		logger.out, logger.level = out, saved
+		logger.mu.Unlock()
+	})
+	return &buf
+}
+
+func logEntries(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    logLevel
+		wantErr bool
+	}{
+		{"debug", levelDebug, false},
+		{"INFO", levelInfo, false},
+		{"Warn", levelWarn, false},
+		{"error", levelError, false},
+		{"verbose", levelInfo, true},
+		{"", levelInfo, true},
+	}
+	for _, tt := range tests {
+		got, err := parseLogLevel(tt.name)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("parseLogLevel(%q) = %v, %v; want %v, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestLoggerLevels(t *testing.T) {
+	tests := []struct {
+		level logLevel
+		want  []string
+	}{
+		{levelDebug, []string{"debug", "info", "warn", "error"}},
+		{levelInfo, []string{"info", "warn", "error"}},
+		{levelError, []string{"error"}},
+	}
+	for _, tt := range tests {
+		buf := captureLog(t, tt.level)
+		logger.Debug(context.Background(), "debug", nil)
+		logger.Info(context.Background(), "info", nil)
+		logger.Warn(context.Background(), "warn", nil)
+		logger.Error(context.Background(), "error", nil)
+		entries := logEntries(t, buf)
+		var got []string
+		for _, e := range entries {
+			if e["level"] != e["msg"] {
+				t.Errorf("level %q logged with msg %q", e["level"], e["msg"])
+			}
+			got = append(got, e["msg"].(string))
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("at %s logged %v, want %v", levelNames[tt.level], got, tt.want)
+		}
+	}
+}
+
+func TestLoggerFields(t *testing.T) {
+	buf := captureLog(t, levelInfo)
+	ctx := context.WithValue(context.Background(), requestInfoKey{}, &requestInfo{ID: "abc"})
+	logger.Info(ctx, "saved", Fields{"error": errors.New("boom"), "count": 3})
+	entries := logEntries(t, buf)
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(entries))
+	}
+	e := entries[0]
+	want := map[string]interface{}{"msg": "saved", "level": "info", "error": "boom", "count": float64(3), "request_id": "abc"}
+	for k, v := range want {
+		if e[k] != v {
+			t.Errorf("%s = %v, want %v", k, e[k], v)
+		}
+	}
+	if _, ok := e["time"]; !ok {
+		t.Error("entry has no time")
+	}
+}
+
+func TestRequestLogger(t *testing.T) {
+	tests := []struct {
+		header string
+		keep   bool // the ID is taken from the header
+	}{
+		{"", false},
+		{"from-proxy-1", true},
+		{strings.Repeat("x", 129), false},
+	}
+	for _, tt := range tests {
+		buf := captureLog(t, levelInfo)
+		router := gmux.NewRouter()
+		var seen string
+		router.HandleFunc("/product/{id}/", func(w http.ResponseWriter, r *http.Request) {
+			seen = requestInfoFrom(r.Context()).ID
+			w.WriteHeader(http.StatusTeapot)
+		})
+		n := negroni.New()
+		n.Use(requestLogger(router))
+		n.UseHandler(router)
+
+		r := httptest.NewRequest("GET", "/product/3/", nil)
+		if tt.header != "" {
+			r.Header.Set("X-Request-ID", tt.header)
+		}
+		w := httptest.NewRecorder()
+		n.ServeHTTP(w, r)
+
+		id := w.Header().Get("X-Request-ID")
+		if id == "" || id != seen {
+			t.Errorf("X-Request-ID %q: response ID %q, handler saw %q", tt.header, id, seen)
+		}
+		if (id == tt.header) != tt.keep {
+			t.Errorf("X-Request-ID %q: got ID %q, keep %v", tt.header, id, tt.keep)
+		}
+		entries := logEntries(t, buf)
+		if len(entries) != 1 {
+			t.Fatalf("got %d entries, want 1", len(entries))
+		}
+		e := entries[0]
+		if e["request_id"] != id || e["status"] != float64(http.StatusTeapot) || e["route"] != "/product/{id}/" {
+			t.Errorf("X-Request-ID %q: logged %v", tt.header, e)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const maxMailAttempts = 5
+
+// Email is a single outgoing HTML message.
+type Email struct {
+	To      string
+	Subject string
+	HTML    string
+	Headers map[string]string
+}
+
+// Mailer delivers email. Errors wrapped in permanentError mean the
+// recipient address is bad and retrying is pointless.
+type Mailer interface {
+	Send(msg Email) error
+}
+
+type permanentError struct {
+	error
+}
+
+var mailer Mailer
+
+// mailTemplates are the email bodies in templates/email, kept apart from
+// the page templates because they do not use the site layout.
+var mailTemplates *template.Template
+
+func initMail() error {
+	var err error
+	if mailTemplates, err = template.ParseGlob("templates/email/*.html"); err != nil {
+		return err
+	}
+	if config.SMTPAddr != "" {
+		var auth smtp.Auth
+		if config.SMTPUser != "" {
+			host := strings.Split(config.SMTPAddr, ":")[0]
+			auth = smtp.PlainAuth("", config.SMTPUser, config.SMTPPassword, host)
+		}
+		mailer = smtpMailer{addr: config.SMTPAddr, from: config.MailFrom, auth: auth}
+	} else {
+		if err := os.MkdirAll(config.MailOutbox, 0755); err != nil {
+			return err
+		}
+		mailer = outboxMailer{dir: config.MailOutbox}
+	}
+	// Messages being sent when the process last stopped are retried.
+	_, err = dbmap.Exec("UPDATE mailqueue SET Status='queued' WHERE Status='sending'")
+	return err
+}
+
+// renderEmail executes one of the templates in templates/email.
+func renderEmail(name string, data interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := mailTemplates.ExecuteTemplate(&buf, name, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// headerValue strips line breaks so user input cannot add headers.
+var headerValue = strings.NewReplacer("\r", "", "\n", "")
+
+func formatMessage(from string, msg Email) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", headerValue.Replace(from))
+	fmt.Fprintf(&buf, "To: %s\r\n", headerValue.Replace(msg.To))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", headerValue.Replace(msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	keys := make([]string, 0, len(msg.Headers))
+	for k := range msg.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "%s: %s\r\n", headerValue.Replace(k), headerValue.Replace(msg.Headers[k]))
+	}
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/html; charset=UTF-8\r\n\r\n")
+	buf.WriteString(msg.HTML)
+	return buf.Bytes()
+}
+
+// outboxMailer writes each message to a .eml file instead of sending it,
+// for development and tests.
+type outboxMailer struct {
+	dir string
+}
+
+func (m outboxMailer) Send(msg Email) error {
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405.000000000"), slugify(msg.To))
+	return ioutil.WriteFile(filepath.Join(m.dir, name), formatMessage(config.MailFrom, msg), 0644)
+}
+
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (m smtpMailer) Send(msg Email) error {
+	err := smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, formatMessage(m.from, msg))
+	if tpErr, ok := err.(*textproto.Error); ok && tpErr.Code >= 500 {
+		return permanentError{err}
+	}
+	return err
+}
+
+// QueuedEmail is a row of the outgoing mail queue. Emails are queued by
+// the request handlers and sent by the mail job at a limited rate.
+type QueuedEmail struct {
+	Id        int64     `db:"Id"`
+	Recipient string    `db:"Recipient"`
+	Subject   string    `db:"Subject"`
+	Body      string    `db:"Body,size:65535"`
+	Headers   string    `db:"Headers,size:1024"` // JSON object
+	Status    string    `db:"Status,size:16"`    // queued, sending, sent or failed
+	Attempts  int       `db:"Attempts"`
+	Error     string    `db:"Error"`
+	Created   time.Time `db:"Created"`
+	Updated   time.Time `db:"Updated"`
+}
+
+// inserter is a database handle or a transaction.
+type inserter interface {
+	Insert(list ...interface{}) error
+}
+
+// queueEmail stores msg for the mail job to send. Given a transaction, the
+// email is only queued if it commits.
+func queueEmail(db inserter, msg Email) error {
+	headers, err := json.Marshal(msg.Headers)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return db.Insert(&QueuedEmail{
+		Recipient: msg.To,
+		Subject:   msg.Subject,
+		Body:      msg.HTML,
+		Headers:   string(headers),
+		Status:    "queued",
+		Created:   now,
+		Updated:   now,
+	})
+}
+
+// sendNextEmail sends the oldest queued email. It runs once per tick of
+// the mail job, which is what limits the send rate.
+func sendNextEmail(ctx context.Context) error {
+	db := dbmap.WithContext(ctx)
+	var next []QueuedEmail
+	if _, err := db.Select(&next, "SELECT * FROM mailqueue WHERE Status='queued' ORDER BY Id LIMIT 1"); err != nil {
+		return err
+	}
+	if len(next) == 0 {
+		return nil
+	}
+	q := next[0]
+	// Claim the row so that a second instance does not send it too.
+	res, err := db.Exec("UPDATE mailqueue SET Status='sending' WHERE Id=? AND Status='queued'", q.Id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return nil
+	}
+
+	msg := Email{To: q.Recipient, Subject: q.Subject, HTML: q.Body}
+	json.Unmarshal([]byte(q.Headers), &msg.Headers)
+	err = mailer.Send(msg)
+
+	q.Attempts++
+	q.Updated = time.Now()
+	switch err.(type) {
+	case nil:
+		q.Status, q.Error = "sent", ""
+		emailsSent.WithLabelValues("sent").Inc()
+	case permanentError:
+		q.Status, q.Error = "failed", truncate(err.Error(), 255)
+		emailsSent.WithLabelValues("bounced").Inc()
+		if berr := markBounced(db, q.Recipient); berr != nil {
+			return berr
+		}
+	default:
+		q.Status, q.Error = "queued", truncate(err.Error(), 255)
+		if q.Attempts >= maxMailAttempts {
+			q.Status = "failed"
+		}
+		emailsSent.WithLabelValues("error").Inc()
+	}
+	if _, uerr := db.Update(&q); uerr != nil {
+		return uerr
+	}
+	if err != nil {
+		logger.Warn(ctx, "email not sent", Fields{"id": q.Id, "attempts": q.Attempts, "error": err})
+	}
+	return nil
+}
+
+// truncate cuts s to at most n bytes so it fits a varchar column.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
-	"html/template"
-	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"database/sql"
 	_ "github.com/go-sql-driver/mysql"
@@ -23,8 +27,12 @@ type Role struct {
 }
 
 type User struct {
-	Username string `db:"username"`
-	Secret   []byte `db:"secret"`
+	Username string    `db:"username" form:"username" label:"Username" validate:"required,email,max=255"`
+	Secret   []byte    `db:"secret"`
+	Password string    `db:"-" form:"password" validate:"required,password"` // only set while registering
+	Name     string    `db:"name,size:100"`                                  // see Profile
+	Phone    string    `db:"phone,size:16"`
+	Created  time.Time `db:"created"`
 }
 
 type SearchResult struct {
@@ -33,63 +41,253 @@ type SearchResult struct {
 }
 
 type Favourite struct {
-	Id   int64  `db:Id`
-	Name string `db:Name`
+	Id   int64  `db:"Id"`
+	Name string `db:"Name"`
 }
 
 type Product struct {
-	Id    int64   `db:Id`
-	Name  string  `db:Name`
-	Image string  `db:Image`
-	Price float64 `db:Price`
-	Brand string  `db:Brand`
+	Id            int64      `db:"Id"`
+	Name          string     `db:"Name"`
+	Image         string     `db:"Image"`
+	PriceAmount   int64      `db:"PriceAmount" json:"-"` // minor units, see Price and Pricer
+	PriceCurrency string     `db:"PriceCurrency,size:3" json:"-"`
+	SaleAmount    int64      `db:"SaleAmount" json:"-"` // while on sale, set by the price scheduler
+	SaleEnds      *time.Time `db:"SaleEnds" json:"-"`
+	Brand         string     `db:"Brand"`
+	Category      string     `db:"Category"`
+	TaxClass      string     `db:"TaxClass,size:32"` // see taxClasses
+	Weight        int        `db:"Weight"`           // grams
+	Length        int        `db:"Length"`           // millimetres, packed
+	Width         int        `db:"Width"`
+	Height        int        `db:"Height"`
+	RatingAverage float64    `db:"RatingAverage"` // of the approved reviews, see updateProductRating
+	RatingCount   int        `db:"RatingCount"`
+	Updated       time.Time  `db:"Updated"`
+}
+
+// Price is what the product costs now in its own currency, on sale or not.
+func (p Product) Price() Money {
+	if p.OnSale() {
+		return Money{p.SaleAmount, p.PriceCurrency}
+	}
+	return p.RegularPrice()
+}
+
+// RegularPrice is what the product costs when it is not on sale.
+func (p Product) RegularPrice() Money {
+	return Money{p.PriceAmount, p.PriceCurrency}
+}
+
+// OnSale reports whether a sale price applies. The end time is checked
+// here too, so a sale stops on time even before the scheduler clears it.
+func (p Product) OnSale() bool {
+	return p.SaleAmount > 0 && p.SaleAmount < p.PriceAmount && (p.SaleEnds == nil || time.Now().Before(*p.SaleEnds))
+}
+
+func (p *Product) PreInsert(s gorp.SqlExecutor) error {
+	p.Updated = time.Now()
+	return nil
+}
+
+func (p *Product) PreUpdate(s gorp.SqlExecutor) error {
+	p.Updated = time.Now()
+	return nil
+}
+
+// Any change to the catalog makes the cached sitemap stale.
+func (p *Product) PostInsert(s gorp.SqlExecutor) error {
+	sitemaps.invalidate()
+	return nil
+}
+
+func (p *Product) PostUpdate(s gorp.SqlExecutor) error {
+	sitemaps.invalidate()
+	return nil
+}
+
+func (p *Product) PostDelete(s gorp.SqlExecutor) error {
+	sitemaps.invalidate()
+	return nil
 }
 
 type Subscriber struct {
-	Id    int64  `db:Id`
-	Email string `db:Email`
+	Id      int64     `db:"Id"`
+	Email   string    `db:"Email" form:"emailsub" label:"Email" validate:"required,email,max=255"`
+	Status  string    `db:"Status,size:16"` // see subscriberStatuses
+	Created time.Time `db:"Created"`
 }
 
 type ContactUs struct {
-	Id      int64  `db:"Id"`
-	Name    string `db:"Name"`
-	Email   string `db:"Email"`
-	Phone   string `db:"Phone"`
-	Content string `db:"Content"`
+	Id       int64     `db:"Id"`
+	Name     string    `db:"Name" form:"name" validate:"required,max=100"`
+	Email    string    `db:"Email" form:"email" validate:"required,email,max=255"`
+	Phone    string    `db:"Phone" form:"phone" validate:"phone"`
+	Content  string    `db:"Content" form:"content" label:"Information" validate:"required,max=255"`
+	Status   string    `db:"Status,size:16"` // see contactStatuses
+	Assignee string    `db:"Assignee"`
+	Created  time.Time `db:"Created"`
+	Updated  time.Time `db:"Updated"`
 }
 
 type FAQ struct {
-	Id       int64  `db:"Id"`
-	Question string `db:"Question"`
-	Answer   string `db:"Answer"`
+	Id        int64     `db:"Id"`
+	Question  string    `db:"Question" form:"question" validate:"required,max=255"`
+	Answer    string    `db:"Answer" form:"answer" validate:"required,max=255"`
+	Topic     string    `db:"Topic" form:"topic" validate:"required,max=255"`
+	Position  int       `db:"Position" form:"position"` // display order, lowest first
+	Published bool      `db:"Published" form:"published"`
+	Updated   time.Time `db:"Updated"`
 }
 
 var db *sql.DB
-var dbmap *gorp.DbMap
+var dbmap *meteredDbMap
+var config Config
 
 func main() {
 	mux := gmux.NewRouter().StrictSlash(true)
 
+	var err error
+	config, err = loadConfig()
+	checkErr(err, "Invalid configuration")
+	checkErr(initLogger(config), "Logger setup failed")
 	initDb()
+	taxProvider = newTaxProvider(config.TaxProvider)
+	checkErr(loadExchangeRates(context.Background()), "Loading exchange rates failed")
+	checkErr(applyScheduledPrices(context.Background()), "Applying scheduled prices failed")
+	checkErr(loadCatalogs(config.LocalesDir), "Loading message catalogs failed")
+	checkErr(loadProductNames(context.Background()), "Loading product translations failed")
+	renderer, err = NewRenderer("templates", config.TemplateReload)
+	checkErr(err, "Loading templates failed")
+	checkErr(initMail(), "Mail setup failed")
+	startJob("mail", time.Duration(float64(time.Second)/config.MailRate), sendNextEmail)
+	startJob("rate-limits", 10*time.Minute, pruneRateLimits)
+	startJob("exchange-rates", 5*time.Minute, loadExchangeRates)
+	startJob("price-schedule", time.Minute, applyScheduledPrices)
+	startJob("recommendations", time.Hour, computeRecommendations)
+	startJob("translations", 5*time.Minute, loadProductNames)
 
 	// router setting
-	mux.HandleFunc("/", HomePageHandler).Methods("GET")
-	mux.HandleFunc("/home/", HomePageHandler).Methods("GET")
-	mux.HandleFunc("/login/", LoginPageHandler).Methods("GET")
+	mux.Handle("/", appHandler(HomePageHandler)).Methods("GET")
+	mux.Handle("/home/", appHandler(HomePageHandler)).Methods("GET")
+	mux.Handle("/login/", appHandler(LoginPageHandler)).Methods("GET")
 	mux.HandleFunc("/logout/", LogoutHandler).Methods("GET")
-	mux.HandleFunc("/search/", SearchPageHandler).Methods("GET")
-	mux.HandleFunc("/about/", AboutHandler).Methods("GET")
-	mux.HandleFunc("/contact/", ContactHandler).Methods("GET")
-	mux.HandleFunc("/FAQ/", FAQHandler).Methods("GET")
-	mux.HandleFunc("/manage/", ManageHandler).Methods("GET")
-	mux.HandleFunc("/list/", ListHandler).Methods("PUT")
-
-	mux.HandleFunc("/search/", SearchHandler).Methods("POST")
-	mux.HandleFunc("/product/", ProductHandler).Methods("POST")
-	mux.HandleFunc("/subscribe/", SubscribeHandler).Methods("POST")
-	mux.HandleFunc("/contact/", ContactUsHandler).Methods("POST")
-	mux.HandleFunc("/FAQ/", FAQDataHandler).Methods("POST")
-	//mux.HandleFunc("/order/", OrderHandler).Methods("POST")
+	mux.Handle("/search/", appHandler(SearchPageHandler)).Methods("GET")
+	mux.Handle("/about/", appHandler(AboutHandler)).Methods("GET")
+	mux.Handle("/contact/", appHandler(ContactHandler)).Methods("GET")
+	mux.Handle("/FAQ/", appHandler(FAQHandler)).Methods("GET")
+	mux.Handle("/products/", appHandler(ProductListHandler)).Methods("GET")
+	mux.Handle("/category/{category}/", appHandler(ProductListHandler)).Methods("GET")
+	mux.Handle("/product/{id:[0-9]+}-{slug}/", appHandler(ProductPageHandler)).Methods("GET")
+	mux.Handle("/product/{id:[0-9]+}/", appHandler(ProductPageHandler)).Methods("GET")
+	mux.Handle("/product/{id:[0-9]+}/reviews/", appHandler(SubmitReviewHandler)).Methods("POST")
+	mux.Handle("/reviews/{id:[0-9]+}/helpful/", appHandler(HelpfulReviewHandler)).Methods("POST")
+	mux.Handle("/product/{id:[0-9]+}/questions/", appHandler(AskQuestionHandler)).Methods("POST")
+	mux.Handle("/questions/{id:[0-9]+}/answers/", appHandler(AnswerQuestionHandler)).Methods("POST")
+	mux.Handle("/answers/{id:[0-9]+}/accept/", appHandler(AcceptAnswerHandler)).Methods("POST")
+	mux.Handle("/answers/{id:[0-9]+}/vote/", appHandler(VoteAnswerHandler)).Methods("POST")
+	mux.Handle("/account/", appHandler(AccountHandler)).Methods("GET")
+	mux.Handle("/account/profile/", appHandler(SaveProfileHandler)).Methods("POST")
+	mux.Handle("/account/password/", appHandler(ChangePasswordHandler)).Methods("POST")
+	mux.Handle("/account/newsletter/", appHandler(AccountNewsletterHandler)).Methods("POST")
+	mux.Handle("/account/wishlist/", appHandler(AddToWishlistHandler)).Methods("POST")
+	mux.Handle("/account/wishlist/{id:[0-9]+}/delete/", appHandler(RemoveFromWishlistHandler)).Methods("POST")
+	mux.Handle("/account/addresses/", appHandler(AddressBookHandler)).Methods("GET")
+	mux.Handle("/account/addresses/", appHandler(SaveAddressHandler)).Methods("POST")
+	mux.Handle("/account/addresses/{id:[0-9]+}/", appHandler(AddressBookHandler)).Methods("GET")
+	mux.Handle("/account/addresses/{id:[0-9]+}/", appHandler(SaveAddressHandler)).Methods("POST")
+	mux.Handle("/account/addresses/{id:[0-9]+}/default/", appHandler(DefaultAddressHandler)).Methods("POST")
+	mux.Handle("/account/addresses/{id:[0-9]+}/delete/", appHandler(DeleteAddressHandler)).Methods("POST")
+	mux.Handle("/manage/", appHandler(ManageHandler)).Methods("GET")
+	mux.Handle("/manage/newsletter/", appHandler(ManageNewsletterHandler)).Methods("GET")
+	mux.Handle("/manage/newsletter/", appHandler(CreateCampaignHandler)).Methods("POST")
+	mux.Handle("/manage/newsletter/{id:[0-9]+}/", appHandler(CampaignHandler)).Methods("GET")
+	mux.Handle("/manage/newsletter/{id:[0-9]+}/send/", appHandler(SendCampaignHandler)).Methods("POST")
+	mux.Handle("/manage/newsletter/subscribers/{id:[0-9]+}/", appHandler(SubscriberStatusHandler)).Methods("POST")
+	mux.Handle("/manage/faqs/", appHandler(ManageFAQsHandler)).Methods("GET")
+	mux.Handle("/manage/faqs/", appHandler(SaveFAQHandler)).Methods("POST")
+	mux.Handle("/manage/faqs/{id:[0-9]+}/", appHandler(ManageFAQsHandler)).Methods("GET")
+	mux.Handle("/manage/faqs/{id:[0-9]+}/", appHandler(SaveFAQHandler)).Methods("POST")
+	mux.Handle("/manage/faqs/{id:[0-9]+}/delete/", appHandler(DeleteFAQHandler)).Methods("POST")
+	mux.Handle("/manage/abuse/", appHandler(ManageAbuseHandler)).Methods("GET")
+	mux.Handle("/manage/currencies/", appHandler(ManageCurrenciesHandler)).Methods("GET")
+	mux.Handle("/manage/currencies/", appHandler(SaveExchangeRateHandler)).Methods("POST")
+	mux.Handle("/manage/currencies/{code:[A-Z]{3}}/", appHandler(ManageCurrenciesHandler)).Methods("GET")
+	mux.Handle("/manage/currencies/{code:[A-Z]{3}}/delete/", appHandler(DeleteExchangeRateHandler)).Methods("POST")
+	mux.Handle("/manage/currencies/{code:[A-Z]{3}}/prices/", appHandler(PriceListHandler)).Methods("GET")
+	mux.Handle("/manage/currencies/{code:[A-Z]{3}}/prices/", appHandler(SavePriceListHandler)).Methods("POST")
+	mux.Handle("/manage/banners/", appHandler(ManageBannersHandler)).Methods("GET")
+	mux.Handle("/manage/banners/", appHandler(SaveBannerHandler)).Methods("POST")
+	mux.Handle("/manage/banners/{id:[0-9]+}/", appHandler(ManageBannersHandler)).Methods("GET")
+	mux.Handle("/manage/banners/{id:[0-9]+}/", appHandler(SaveBannerHandler)).Methods("POST")
+	mux.Handle("/manage/banners/{id:[0-9]+}/delete/", appHandler(DeleteBannerHandler)).Methods("POST")
+	mux.Handle("/manage/collections/", appHandler(ManageCollectionsHandler)).Methods("GET")
+	mux.Handle("/manage/collections/", appHandler(SaveCollectionHandler)).Methods("POST")
+	mux.Handle("/manage/collections/{id:[0-9]+}/", appHandler(ManageCollectionsHandler)).Methods("GET")
+	mux.Handle("/manage/collections/{id:[0-9]+}/", appHandler(SaveCollectionHandler)).Methods("POST")
+	mux.Handle("/manage/collections/{id:[0-9]+}/delete/", appHandler(DeleteCollectionHandler)).Methods("POST")
+	mux.Handle("/manage/promotions/", appHandler(ManagePromotionsHandler)).Methods("GET")
+	mux.Handle("/manage/promotions/", appHandler(SavePromotionHandler)).Methods("POST")
+	mux.Handle("/manage/promotions/{id:[0-9]+}/", appHandler(ManagePromotionsHandler)).Methods("GET")
+	mux.Handle("/manage/promotions/{id:[0-9]+}/", appHandler(SavePromotionHandler)).Methods("POST")
+	mux.Handle("/manage/promotions/{id:[0-9]+}/delete/", appHandler(DeletePromotionHandler)).Methods("POST")
+	mux.Handle("/manage/pages/", appHandler(ManagePagesHandler)).Methods("GET")
+	mux.Handle("/manage/pages/", appHandler(SavePageHandler)).Methods("POST")
+	mux.Handle("/manage/pages/{id:[0-9]+}/", appHandler(ManagePagesHandler)).Methods("GET")
+	mux.Handle("/manage/pages/{id:[0-9]+}/", appHandler(SavePageHandler)).Methods("POST")
+	mux.Handle("/manage/pages/{id:[0-9]+}/revisions/{rev:[0-9]+}/restore/", appHandler(RestorePageRevisionHandler)).Methods("POST")
+	mux.Handle("/manage/pages/{id:[0-9]+}/unpublish/", appHandler(UnpublishPageHandler)).Methods("POST")
+	mux.Handle("/manage/pages/{id:[0-9]+}/delete/", appHandler(DeletePageHandler)).Methods("POST")
+	mux.Handle("/manage/translations/", appHandler(ManageTranslationsHandler)).Methods("GET")
+	mux.Handle("/manage/translations/", appHandler(SaveTranslationsHandler)).Methods("POST")
+	mux.Handle("/manage/products/", appHandler(ManageProductsHandler)).Methods("GET")
+	mux.Handle("/manage/products/{id:[0-9]+}/prices/", appHandler(ProductPricesHandler)).Methods("GET")
+	mux.Handle("/manage/products/{id:[0-9]+}/prices/", appHandler(SaveScheduledPriceHandler)).Methods("POST")
+	mux.Handle("/manage/products/{id:[0-9]+}/prices/{change:[0-9]+}/cancel/", appHandler(CancelScheduledPriceHandler)).Methods("POST")
+	mux.Handle("/manage/questions/", appHandler(ManageQuestionsHandler)).Methods("GET")
+	mux.Handle("/manage/questions/{id:[0-9]+}/delete/", appHandler(DeleteQuestionHandler)).Methods("POST")
+	mux.Handle("/manage/answers/{id:[0-9]+}/delete/", appHandler(DeleteAnswerHandler)).Methods("POST")
+	mux.Handle("/manage/reviews/", appHandler(ManageReviewsHandler)).Methods("GET")
+	mux.Handle("/manage/reviews/{id:[0-9]+}/", appHandler(ModerateReviewHandler)).Methods("POST")
+	mux.Handle("/manage/tax/", appHandler(ManageTaxHandler)).Methods("GET")
+	mux.Handle("/manage/tax/", appHandler(SaveTaxRateHandler)).Methods("POST")
+	mux.Handle("/manage/tax/{id:[0-9]+}/", appHandler(ManageTaxHandler)).Methods("GET")
+	mux.Handle("/manage/tax/{id:[0-9]+}/", appHandler(SaveTaxRateHandler)).Methods("POST")
+	mux.Handle("/manage/tax/{id:[0-9]+}/delete/", appHandler(DeleteTaxRateHandler)).Methods("POST")
+	mux.Handle("/manage/contacts/", appHandler(ManageContactsHandler)).Methods("GET")
+	mux.Handle("/manage/contacts/{id:[0-9]+}/", appHandler(ManageContactHandler)).Methods("GET")
+	mux.Handle("/manage/contacts/{id:[0-9]+}/", appHandler(UpdateContactHandler)).Methods("POST")
+	mux.Handle("/manage/contacts/{id:[0-9]+}/replies/", appHandler(ReplyContactHandler)).Methods("POST")
+	mux.Handle("/subscribe/confirm/", appHandler(ConfirmSubscriptionHandler)).Methods("GET")
+	mux.Handle("/unsubscribe/", appHandler(UnsubscribeHandler)).Methods("GET", "POST")
+	mux.Handle("/list/", appHandler(ListHandler)).Methods("PUT")
+
+	mux.Handle("/search/", appHandler(SearchHandler)).Methods("POST")
+	mux.Handle("/product/", appHandler(ProductHandler)).Methods("POST")
+	mux.Handle("/product/recent/", appHandler(RecentlyViewedHandler)).Methods("POST")
+	mux.Handle("/product/similar/", appHandler(RecommendationsHandler(RecommendSimilar))).Methods("POST")
+	mux.Handle("/product/together/", appHandler(RecommendationsHandler(RecommendTogether))).Methods("POST")
+	mux.Handle("/form/token/", appHandler(FormTokenHandler)).Methods("GET")
+	mux.Handle("/subscribe/", appHandler(SubscribeHandler)).Methods("POST")
+	mux.Handle("/shipping/quote/", appHandler(ShippingQuoteHandler)).Methods("POST")
+	mux.Handle("/cart/totals/", appHandler(CartTotalsHandler)).Methods("POST")
+	mux.Handle("/cart/order/", appHandler(PlaceOrderHandler)).Methods("POST")
+	mux.Handle("/currency/", appHandler(SetCurrencyHandler)).Methods("POST")
+	mux.Handle("/locale/", appHandler(SetLocaleHandler)).Methods("POST")
+	mux.Handle("/contact/", appHandler(ContactUsHandler)).Methods("POST")
+	mux.Handle("/FAQ/", appHandler(FAQDataHandler)).Methods("POST")
+	//mux.Handle("/order/", appHandler(OrderHandler)).Methods("POST")
+	mux.NotFoundHandler = appHandler(func(w http.ResponseWriter, r *http.Request) error {
+		return NotFound("The page you are looking for does not exist.")
+	})
+
+	// crawlers
+	mux.Handle("/sitemap.xml", appHandler(SitemapHandler)).Methods("GET")
+	mux.Handle("/sitemap-{part:[0-9]+}.xml", appHandler(SitemapHandler)).Methods("GET")
+	mux.Handle("/robots.txt", appHandler(RobotsHandler)).Methods("GET")
+
+	// monitoring
+	mux.HandleFunc("/healthz", HealthzHandler).Methods("GET")
+	mux.HandleFunc("/readyz", ReadyzHandler).Methods("GET")
 
 	// static file
 	cssPath := http.FileServer(http.Dir("./static/css"))
@@ -99,17 +297,75 @@ func main() {
 	mux.PathPrefix("/img/").Handler(http.StripPrefix("/img/", imgPath))
 	mux.PathPrefix("/rjs/").Handler(http.StripPrefix("/rjs/", rjsPath))
 
-	n := negroni.Classic()
-	n.Use(sessions.Sessions("wildview-session", cookiestore.New([]byte("my-secret-wildview"))))
+	// content pages, after every other route so those take precedence
+	mux.Handle("/{slug:[a-z0-9-]+}/", appHandler(ContentPageHandler)).Methods("GET")
+
+	n := negroni.New()
+	n.Use(requestLogger(mux))
+	n.Use(negroni.HandlerFunc(recoverPanics))
+	n.Use(sessions.Sessions("wildview-session", cookiestore.New([]byte(config.Secret))))
+	n.Use(negroni.HandlerFunc(tagRequestUser))
+	n.Use(negroni.HandlerFunc(negotiateLocale))
 	n.Use(negroni.HandlerFunc(verifyUser))
-	n.Use(negroni.HandlerFunc(trafficCount))
+	n.Use(trafficCount(mux))
 	n.UseHandler(mux)
-	n.Run(":80")
+
+	server := &http.Server{
+		Addr:         config.Addr,
+		Handler:      n,
+		ReadTimeout:  config.ReadTimeout,
+		WriteTimeout: config.WriteTimeout,
+		IdleTimeout:  config.IdleTimeout,
+	}
+	var metrics *http.Server
+	if config.MetricsAddr != "off" {
+		metrics = serveMetrics(config.MetricsAddr)
+	}
+	serve(server, metrics, config.ShutdownGrace, config.ShutdownTimeout)
+}
+
+// serve runs server until SIGTERM or SIGINT. It then fails /readyz for
+// grace, still serving, before it stops accepting new connections and
+// waits up to drain for in-flight requests to finish. The metrics
+// server, if any, stops last so the drain can still be scraped.
+func serve(server, metrics *http.Server, grace, drain time.Duration) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+
+	errs := make(chan error, 1)
+	go func() {
+		logger.Info(context.Background(), "listening", Fields{"addr": server.Addr})
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		checkErr(err, "Server stopped")
+	case sig := <-stop:
+		atomic.StoreInt32(&shuttingDown, 1)
+		logger.Info(context.Background(), "shutting down", Fields{"signal": sig.String(), "grace": grace.String(), "drain": drain.String()})
+		time.Sleep(grace)
+		ctx, cancel := context.WithTimeout(context.Background(), drain)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Error(context.Background(), "shutdown did not complete", Fields{"error": err})
+		}
+		if metrics != nil {
+			if err := metrics.Shutdown(ctx); err != nil {
+				logger.Error(context.Background(), "metrics shutdown did not complete", Fields{"error": err})
+			}
+		}
+		stopJobs()
+		jobs.Wait()
+		db.Close()
+		logger.Info(context.Background(), "stopped", nil)
+	}
 }
 
 func checkErr(err error, msg string) {
 	if err != nil {
-		log.Fatalln(msg, err)
+		logger.Error(context.Background(), msg, Fields{"error": err})
+		os.Exit(1)
 	}
 }
 
@@ -129,36 +385,98 @@ func initDb() {
 	server = "tcp(127.0.0.1)"
 	database = "wildviewdb"
 
-	db, err := sql.Open("mysql", user+":"+password+"@"+server+"/"+database)
+	var err error
+	db, err = sql.Open("mysql", user+":"+password+"@"+server+"/"+database+"?parseTime=true")
 	checkErr(err, "sql.Open failed")
 
-	dbmap = &gorp.DbMap{Db: db, Dialect: gorp.MySQLDialect{"InnoDB", "UTF8"}}
+	dbmap = newMeteredDbMap(&gorp.DbMap{Db: db, Dialect: gorp.MySQLDialect{Engine: "InnoDB", Encoding: "UTF8"}})
+	dbmap.AddTableWithName(Address{}, "addresses").SetKeys(true, "Id")
 	dbmap.AddTableWithName(Favourite{}, "favourites").SetKeys(true, "Id")
 	dbmap.AddTableWithName(User{}, "users").SetKeys(false, "username")
 	dbmap.AddTableWithName(Role{}, "roles").SetKeys(false, "username")
 	dbmap.AddTableWithName(Product{}, "products").SetKeys(true, "Id")
 	dbmap.AddTableWithName(Subscriber{}, "subscribers").SetKeys(true, "Id")
 	dbmap.AddTableWithName(ContactUs{}, "contactinfos").SetKeys(true, "Id")
+	dbmap.AddTableWithName(ContactMessage{}, "contactmessages").SetKeys(true, "Id")
 	dbmap.AddTableWithName(FAQ{}, "faqs").SetKeys(true, "Id")
+	dbmap.AddTableWithName(Campaign{}, "campaigns").SetKeys(true, "Id")
+	dbmap.AddTableWithName(QueuedEmail{}, "mailqueue").SetKeys(true, "Id")
+	dbmap.AddTableWithName(AbuseRejection{}, "abuserejections").SetKeys(true, "Id")
+	dbmap.AddTableWithName(TaxRate{}, "taxrates").SetKeys(true, "Id")
+	dbmap.AddTableWithName(ExchangeRate{}, "exchangerates").SetKeys(false, "Currency")
+	dbmap.AddTableWithName(ProductPrice{}, "productprices").SetKeys(true, "Id")
+	dbmap.AddTableWithName(Promotion{}, "promotions").SetKeys(true, "Id")
+	dbmap.AddTableWithName(PromotionUse{}, "promotionuses").SetKeys(true, "Id")
+	dbmap.AddTableWithName(Order{}, "orders").SetKeys(true, "Id")
+	dbmap.AddTableWithName(OrderItem{}, "orderitems").SetKeys(true, "Id")
+	dbmap.AddTableWithName(ScheduledPrice{}, "scheduledprices").SetKeys(true, "Id")
+	dbmap.AddTableWithName(PriceChange{}, "pricehistory").SetKeys(true, "Id")
+	dbmap.AddTableWithName(Review{}, "reviews").SetKeys(true, "Id")
+	dbmap.AddTableWithName(ReviewVote{}, "reviewvotes").SetKeys(true, "Id")
+	dbmap.AddTableWithName(Question{}, "questions").SetKeys(true, "Id")
+	dbmap.AddTableWithName(Answer{}, "answers").SetKeys(true, "Id")
+	dbmap.AddTableWithName(AnswerVote{}, "answervotes").SetKeys(true, "Id")
+	dbmap.AddTableWithName(ProductView{}, "productviews").SetKeys(true, "Id")
+	dbmap.AddTableWithName(BasketItem{}, "basketitems").SetKeys(true, "Id")
+	dbmap.AddTableWithName(Recommendation{}, "recommendations").SetKeys(true, "Id")
+	dbmap.AddTableWithName(Banner{}, "banners").SetKeys(true, "Id")
+	dbmap.AddTableWithName(Collection{}, "collections").SetKeys(true, "Id")
+	dbmap.AddTableWithName(CollectionProduct{}, "collectionproducts").SetKeys(true, "Id")
+	dbmap.AddTableWithName(ContentPage{}, "pages").SetKeys(true, "Id")
+	dbmap.AddTableWithName(PageRevision{}, "pagerevisions").SetKeys(true, "Id")
+	dbmap.AddTableWithName(ProductTranslation{}, "producttranslations").SetKeys(true, "Id")
+	dbmap.AddTableWithName(FAQTranslation{}, "faqtranslations").SetKeys(true, "Id")
+	dbmap.AddTableWithName(WishlistItem{}, "wishlist").SetKeys(true, "Id")
 	err = dbmap.CreateTablesIfNotExists()
 	checkErr(err, "Create tables failed")
+	checkErr(migrateDb(), "Migrating tables failed")
 
 	initDBValues()
 }
 
 func initDBValues() {
 	products := []Product{
-		Product{0, "Dinasour Kid T-shirt Grey", "/img/0.jpg", 14.99, "WarmTip"},
-		Product{1, "39 Pcs Tool Set", "/img/5.jpg", 0.0, "SuperTool"},
-		Product{2, "54 Pcs Tool Set", "/img/2.jpg", 0.0, "SuperTool"},
-		Product{3, "59 Pcs Tool Set", "/img/3.jpg", 0.0, "SuperTool"},
-		Product{4, "148 Pcs Tool Set", "/img/4.jpg", 0.0, "SuperTool"},
+		Product{0, "Dinasour Kid T-shirt Grey", "/img/0.jpg", 1499, "USD", 0, nil, "WarmTip", "Children Clothes", "clothing", 150, 250, 200, 30, 0, 0, time.Now()},
+		Product{1, "39 Pcs Tool Set", "/img/5.jpg", 2999, "USD", 0, nil, "SuperTool", "Tools", "standard", 2100, 320, 250, 70, 0, 0, time.Now()},
+		Product{2, "54 Pcs Tool Set", "/img/2.jpg", 3999, "USD", 0, nil, "SuperTool", "Tools", "standard", 2600, 350, 260, 80, 0, 0, time.Now()},
+		Product{3, "59 Pcs Tool Set", "/img/3.jpg", 4499, "USD", 0, nil, "SuperTool", "Tools", "standard", 2900, 360, 270, 80, 0, 0, time.Now()},
+		Product{4, "148 Pcs Tool Set", "/img/4.jpg", 8999, "USD", 0, nil, "SuperTool", "Tools", "standard", 6800, 450, 330, 110, 0, 0, time.Now()},
 	}
 	for i := 0; i < len(products); i++ {
 		var r = []Product{}
 		if _, _ = dbmap.Select(&r, "SELECT Id FROM products WHERE Name=?", products[i].Name); len(r) == 0 {
 			err := dbmap.Insert(&products[i])
 			checkErr(err, "Insertion of initial products fails!")
+		} else {
+			_, err := dbmap.Exec("UPDATE products SET Category=? WHERE Name=? AND Category=''", products[i].Category, products[i].Name)
+			checkErr(err, "Categorising initial products fails!")
+			_, err = dbmap.Exec("UPDATE products SET Weight=?, Length=?, Width=?, Height=? WHERE Name=? AND Weight=0",
+				products[i].Weight, products[i].Length, products[i].Width, products[i].Height, products[i].Name)
+			checkErr(err, "Weighing initial products fails!")
+			_, err = dbmap.Exec("UPDATE products SET PriceAmount=?, PriceCurrency=? WHERE Name=? AND PriceAmount=0",
+				products[i].PriceAmount, products[i].PriceCurrency, products[i].Name)
+			checkErr(err, "Pricing initial products fails!")
+		}
+	}
+	if count, err := dbmap.SelectInt("SELECT count(*) FROM taxrates"); err == nil && count == 0 {
+		for i := range defaultTaxRates {
+			defaultTaxRates[i].Updated = time.Now()
+			err := dbmap.Insert(&defaultTaxRates[i])
+			checkErr(err, "Insertion of initial tax rates fails!")
+		}
+	}
+	if count, err := dbmap.SelectInt("SELECT count(*) FROM banners"); err == nil && count == 0 {
+		for i := range defaultBanners {
+			defaultBanners[i].Starts, defaultBanners[i].Updated = time.Now(), time.Now()
+			err := dbmap.Insert(&defaultBanners[i])
+			checkErr(err, "Insertion of initial banners fails!")
+		}
+	}
+	if count, err := dbmap.SelectInt("SELECT count(*) FROM exchangerates"); err == nil && count == 0 && config.Currency == "USD" {
+		for i := range defaultExchangeRates {
+			defaultExchangeRates[i].Updated = time.Now()
+			err := dbmap.Insert(&defaultExchangeRates[i])
+			checkErr(err, "Insertion of initial exchange rates fails!")
 		}
 	}
 	roles := []Role{
@@ -169,7 +487,7 @@ func initDBValues() {
 		var r = []Role{}
 		if _, _ = dbmap.Select(&t, "SELECT username FROM roles WHERE username=?", roles[i].Username); len(t) == 0 {
 			secret, _ := bcrypt.GenerateFromPassword([]byte("iloveyou"), bcrypt.DefaultCost)
-			user := User{roles[i].Username, secret}
+			user := User{Username: roles[i].Username, Secret: secret}
 			err := dbmap.Insert(&user)
 			checkErr(err, "Insertion of initial role fails!")
 			if _, _ = dbmap.Select(&r, "SELECT username FROM roles WHERE username=?", roles[i].Username); len(r) == 0 {
@@ -179,9 +497,9 @@ func initDBValues() {
 		}
 	}
 	FAQs := []FAQ{
-		FAQ{0, "WILL MY CREDIT CARD BE CHARGED IMMEDIATELY?", "This is a fraud website on developing!"},
-		FAQ{0, "WHY DID YOU CALL OR E-MAIL ME TO VERIFY MY ORDER?", "Please stop now. Once you place your order, we will disappear and you will never reach us!"},
-		FAQ{0, "HOW DO I KNOW THAT MY ORDER HAS BEEN SHIPPED?", "Kidding me? Fraud website never ships goods!"},
+		FAQ{0, "WILL MY CREDIT CARD BE CHARGED IMMEDIATELY?", "This is a fraud website on developing!", "Payment", 1, true, time.Now()},
+		FAQ{0, "WHY DID YOU CALL OR E-MAIL ME TO VERIFY MY ORDER?", "Please stop now. Once you place your order, we will disappear and you will never reach us!", "Orders", 2, true, time.Now()},
+		FAQ{0, "HOW DO I KNOW THAT MY ORDER HAS BEEN SHIPPED?", "Kidding me? Fraud website never ships goods!", "Shipping", 3, true, time.Now()},
 	}
 	for i := 0; i < len(FAQs); i++ {
 		var r = []FAQ{}
@@ -193,7 +511,18 @@ func initDBValues() {
 }
 
 type ContentReturn struct {
-	Error string
+	Error  string
+	Fields map[string]string `json:",omitempty"` // per form field, see bind
+}
+
+type Message struct {
+	Title string
+	Text  string
+}
+
+type MessagePage struct {
+	User    string
+	Content Message
 }
 
 type Page struct {
@@ -203,71 +532,58 @@ type Page struct {
 }
 
 // Handlers begin here
-func HomePageHandler(w http.ResponseWriter, r *http.Request) {
-	p := Page{Favourites: []Favourite{}, User: getStringFromSession(r, "User"), Content: ContentReturn{}}
-	if _, err := dbmap.Select(&p.Favourites, "select * from favourites"); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	var tmpl *template.Template
-	if tmpl = VerifyAdminResponse(w, r, "templates/home.html"); tmpl == nil {
-		tmpl, _ = template.New("").ParseFiles("templates/header.html",
-			"templates/footer.html",
-			"templates/home.html",
-			"templates/base.html")
-	}
-	if err := tmpl.ExecuteTemplate(w, "base", p); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
-}
-
 type LoginPage struct {
 	User    string
 	Content ContentReturn
 }
 
-func LoginPageHandler(w http.ResponseWriter, r *http.Request) {
+func LoginPageHandler(w http.ResponseWriter, r *http.Request) error {
 	p := LoginPage{}
 	if r.FormValue("register") != "" {
-		secret, _ := bcrypt.GenerateFromPassword([]byte(r.FormValue("password")), bcrypt.DefaultCost)
-		user := User{r.FormValue("username"), secret}
-		if err := dbmap.Insert(&user); err != nil {
-			p.Content.Error = "Username is already taken, pick another one!"
+		user := User{Created: time.Now()}
+		if err := bind(r, &user); err != nil {
+			p.Content = formErrors(err)
+			return renderer.RenderStatus(w, r, http.StatusBadRequest, "login", p)
+		}
+		if err := checkAbuse(newSubmission(r, "register", user.Username, "")); err != nil {
+			return err
+		}
+		secret, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return Internal(err, "Registration failed, please try again later.")
+		}
+		user.Secret = secret
+		if err := dbFor(r).Insert(&user); err != nil {
+			p.Content.Error = T(r, "Username is already taken, pick another one!")
 		} else {
+			registrationsTotal.Inc()
 			sessions.GetSession(r).Set("User", user.Username)
 			http.Redirect(w, r, "/", http.StatusFound)
-			return
+			return nil
 		}
 	} else if r.FormValue("login") != "" {
-		user, err := dbmap.Get(User{}, r.FormValue("username"))
+		user, err := dbFor(r).Get(User{}, r.FormValue("username"))
 		if err != nil {
-			p.Content.Error = "Either " + r.FormValue("username") + " or your password is invalid!"
+			p.Content.Error = T(r, "Either %s or your password is invalid!", r.FormValue("username"))
 		} else if user == nil {
-			p.Content.Error = "Either " + r.FormValue("username") + " or your password is invalid!"
+			p.Content.Error = T(r, "Either %s or your password is invalid!", r.FormValue("username"))
 		} else {
 			u := user.(*User)
 			if err = bcrypt.CompareHashAndPassword(u.Secret, []byte(r.FormValue("password"))); err != nil {
-				p.Content.Error = "Either " + r.FormValue("username") + " or your password is invalid!"
+				p.Content.Error = T(r, "Either %s or your password is invalid!", r.FormValue("username"))
 			} else {
+				loginsTotal.Inc()
 				sessions.GetSession(r).Set("User", u.Username)
 				http.Redirect(w, r, "/", http.StatusFound)
-				return
+				return nil
 			}
 		}
 	}
-	var tmpl *template.Template
-	if tmpl = VerifyAdminResponse(w, r, "templates/login.html"); tmpl == nil {
-		tmpl, _ = template.New("").ParseFiles("templates/header.html",
-			"templates/footer.html",
-			"templates/login.html",
-			"templates/base.html")
-	}
-	if err := tmpl.ExecuteTemplate(w, "base", p); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
+	return renderer.Render(w, r, "login", p)
 }
 
 func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	activeSessions.forget(getStringFromSession(r, "User"))
 	sessions.GetSession(r).Set("User", nil)
 	http.Redirect(w, r, "/", http.StatusFound)
 }
@@ -278,109 +594,42 @@ type ProductPage struct {
 	Content  ContentReturn
 }
 
-func SearchPageHandler(w http.ResponseWriter, r *http.Request) {
-	p := Page{Favourites: []Favourite{}, User: getStringFromSession(r, "User"), Content: ContentReturn{}}
-	if _, err := dbmap.Select(&p.Favourites, "select * from favourites"); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	var tmpl *template.Template
-	if tmpl = VerifyAdminResponse(w, r, "templates/search.html"); tmpl == nil {
-		tmpl, _ = template.New("").ParseFiles("templates/header.html",
-			"templates/footer.html",
-			"templates/search.html",
-			"templates/base.html")
-	}
-	if err := tmpl.ExecuteTemplate(w, "base", p); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
-}
-
-func AboutHandler(w http.ResponseWriter, r *http.Request) {
-	p := Page{Favourites: []Favourite{}, User: getStringFromSession(r, "User"), Content: ContentReturn{}}
-	if _, err := dbmap.Select(&p.Favourites, "select * from favourites"); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	var tmpl *template.Template
-	if tmpl = VerifyAdminResponse(w, r, "templates/about.html"); tmpl == nil {
-		tmpl, _ = template.New("").ParseFiles("templates/header.html",
-			"templates/footer.html",
-			"templates/about.html",
-			"templates/base.html")
-	}
-	if err := tmpl.ExecuteTemplate(w, "base", p); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
-}
-
-func ContactHandler(w http.ResponseWriter, r *http.Request) {
+func SearchPageHandler(w http.ResponseWriter, r *http.Request) error {
 	p := Page{Favourites: []Favourite{}, User: getStringFromSession(r, "User"), Content: ContentReturn{}}
-	if _, err := dbmap.Select(&p.Favourites, "select * from favourites"); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	var tmpl *template.Template
-	if tmpl = VerifyAdminResponse(w, r, "templates/contact.html"); tmpl == nil {
-		tmpl, _ = template.New("").ParseFiles("templates/header.html",
-			"templates/footer.html",
-			"templates/contact.html",
-			"templates/base.html")
-	}
-	if err := tmpl.ExecuteTemplate(w, "base", p); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if _, err := dbFor(r).Select(&p.Favourites, "select * from favourites"); err != nil {
+		return err
 	}
+	return renderer.Render(w, r, "search", p)
 }
 
-func FAQHandler(w http.ResponseWriter, r *http.Request) {
+func ContactHandler(w http.ResponseWriter, r *http.Request) error {
 	p := Page{Favourites: []Favourite{}, User: getStringFromSession(r, "User"), Content: ContentReturn{}}
-	if _, err := dbmap.Select(&p.Favourites, "select * from favourites"); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	var tmpl *template.Template
-	if tmpl = VerifyAdminResponse(w, r, "templates/FAQ.html"); tmpl == nil {
-		tmpl, _ = template.New("").ParseFiles("templates/header.html",
-			"templates/footer.html",
-			"templates/FAQ.html",
-			"templates/base.html")
-	}
-	if err := tmpl.ExecuteTemplate(w, "base", p); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if _, err := dbFor(r).Select(&p.Favourites, "select * from favourites"); err != nil {
+		return err
 	}
+	return renderer.Render(w, r, "contact", p)
 }
 
-func ManageHandler(w http.ResponseWriter, r *http.Request) {
+func ManageHandler(w http.ResponseWriter, r *http.Request) error {
 	if !VerifyAdmin(w, r) {
-		http.Error(w, "You are in big trouble!", http.StatusInternalServerError)
-		return
+		return Unauthorized("You are in big trouble!")
 	}
 	p := Page{Favourites: []Favourite{}, User: getStringFromSession(r, "User"), Content: ContentReturn{}}
-	if _, err := dbmap.Select(&p.Favourites, "select * from favourites"); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	var tmpl *template.Template
-	if tmpl = VerifyAdminResponse(w, r, "templates/manage.html"); tmpl == nil {
-		tmpl, _ = template.New("").ParseFiles("templates/header.html",
-			"templates/footer.html",
-			"templates/manage.html",
-			"templates/base.html")
-	}
-	if err := tmpl.ExecuteTemplate(w, "base", p); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if _, err := dbFor(r).Select(&p.Favourites, "select * from favourites"); err != nil {
+		return err
 	}
+	return renderer.Render(w, r, "manage", p)
 }
 
-func ListHandler(w http.ResponseWriter, r *http.Request) {
+func ListHandler(w http.ResponseWriter, r *http.Request) error {
 	//initDb()
 
 	inv1 := &Favourite{0, "He"}
 	inv2 := &Favourite{0, "sdfasdfa"}
 
-	err := dbmap.Insert(inv1, inv2)
+	err := dbFor(r).Insert(inv1, inv2)
 
-	fmt.Printf("inv1.Id=%d  inv2.Id=%d\n", inv1.Id, inv2.Id)
+	logger.Debug(r.Context(), "favourites inserted", Fields{"ids": []int64{inv1.Id, inv2.Id}})
 	/*stmt, err := db.Prepare("INSERT INTO likes (Name) values(?);")
 	checkErr(err, "Prepare insertion failed")
 
@@ -388,90 +637,72 @@ func ListHandler(w http.ResponseWriter, r *http.Request) {
 	checkErr(err, "Execute insertion failed")
 	*/
 
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
+	return err
 }
 
-func SearchHandler(w http.ResponseWriter, r *http.Request) {
+func SearchHandler(w http.ResponseWriter, r *http.Request) error {
 	results := []Product{}
-	rows, err := dbmap.Query("select * from products WHERE Name LIKE '%" + r.FormValue("search") + "%'")
-	checkErr(err, "Query db for products fails!")
-	for rows.Next() {
-		var prod Product
-		rows.Scan(&prod.Id, &prod.Name, &prod.Image, &prod.Price, &prod.Brand)
-		results = append(results, prod)
+	// Visitors search in their own language, so translated names match too.
+	search := "%" + r.FormValue("search") + "%"
+	if _, err := dbFor(r).Select(&results, "select * from products WHERE Name LIKE ? OR Id IN (SELECT ProductId FROM producttranslations WHERE Locale=? AND Name LIKE ?)", search, localeFor(r), search); err != nil {
+		return Internal(err, "Search is unavailable right now, please try again later.")
 	}
-	encoder := json.NewEncoder(w)
-	if err := encoder.Encode(results); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	localizeProducts(r, results)
+	pr, err := pricerFor(r)
+	if err != nil {
+		return err
 	}
+	encoder := json.NewEncoder(w)
+	return encoder.Encode(pr.PriceAll(results))
 }
 
-func ProductHandler(w http.ResponseWriter, r *http.Request) {
+func ProductHandler(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.ParseInt(r.FormValue("Id"), 10, 64)
+	if err != nil {
+		return Validation("Invalid product id %q.", r.FormValue("Id"))
+	}
 	results := []Product{}
-	rows, err := dbmap.Query("select * from products WHERE Id LIKE " + r.FormValue("Id"))
-	checkErr(err, "Query db for products fails!")
-	for rows.Next() {
-		var prod Product
-		rows.Scan(&prod.Id, &prod.Name, &prod.Image, &prod.Price, &prod.Brand)
-		results = append(results, prod)
+	if _, err := dbFor(r).Select(&results, "select * from products WHERE Id = ?", id); err != nil {
+		return Internal(err, "Product details are unavailable right now, please try again later.")
 	}
-	encoder := json.NewEncoder(w)
-	if err := encoder.Encode(results); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if len(results) == 0 {
+		return NotFound("Product %d does not exist.", id)
 	}
-}
-
-//PUT
-func SubscribeHandler(w http.ResponseWriter, r *http.Request) {
-	results := []ContentReturn{}
-	rows, err := dbmap.Query("select * from subscribers WHERE Email = '" + r.FormValue("emailsub") + "'")
-	checkErr(err, "Query db for products fails!")
-	for rows.Next() {
-		results = append(results, ContentReturn{Error: "Failure"})
-		encoder := json.NewEncoder(w)
-		if err := encoder.Encode(results); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-		return
+	pr, err := pricerFor(r)
+	if err != nil {
+		return err
 	}
-	subs := Subscriber{Id: 0, Email: r.FormValue("emailsub")}
-	err = dbmap.Insert(&subs)
-	checkErr(err, "Insertion of initial products fails!")
-	results = append(results, ContentReturn{Error: "success"})
-	encoder := json.NewEncoder(w)
-	if err := encoder.Encode(results); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	questions, err := answeredQuestions(dbFor(r), id)
+	if err != nil {
+		return Internal(err, "Product details are unavailable right now, please try again later.")
 	}
+	recordView(r, id)
+	localizeProducts(r, results)
+	encoder := json.NewEncoder(w)
+	return encoder.Encode([]ProductJSON{{PricedProduct: pr.PriceAll(results)[0], Questions: questions}})
 }
 
 //PUT
-func ContactUsHandler(w http.ResponseWriter, r *http.Request) {
-	results := []ContentReturn{}
-	contactus := ContactUs{Id: 0, Name: r.FormValue("name"), Email: r.FormValue("email"), Phone: r.FormValue("phone"), Content: r.FormValue("content")}
-	err := dbmap.Insert(&contactus)
-	checkErr(err, "Insertion of initial products fails!")
-	results = append(results, ContentReturn{Error: "success"})
-	encoder := json.NewEncoder(w)
-	if err = encoder.Encode(results); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+func ContactUsHandler(w http.ResponseWriter, r *http.Request) error {
+	now := time.Now()
+	contactus := ContactUs{Status: ContactNew, Created: now, Updated: now}
+	if err := bind(r, &contactus); err != nil {
+		return err
 	}
-}
-
-func FAQDataHandler(w http.ResponseWriter, r *http.Request) {
-	results := []FAQ{}
-	rows, err := dbmap.Query("select * from faqs")
-	checkErr(err, "Query db for products fails!")
-	for rows.Next() {
-		var faq FAQ
-		rows.Scan(&faq.Id, &faq.Question, &faq.Answer)
-		results = append(results, faq)
+	if err := checkAbuse(newSubmission(r, "contact", contactus.Email, contactus.Name+"\n"+contactus.Content)); err != nil {
+		return err
 	}
-	encoder := json.NewEncoder(w)
-	if err := encoder.Encode(results); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := dbFor(r).Insert(&contactus); err != nil {
+		return Internal(err, "Your message could not be sent, please try again later.")
+	}
+	if err := queueContactConfirmation(dbFor(r), &contactus); err != nil {
+		// The message is stored, so staff will still see it.
+		logger.Error(r.Context(), "contact confirmation not queued", Fields{"contact": contactus.Id, "error": err})
 	}
+	contactSubmissionsTotal.Inc()
+	results := []ContentReturn{{Error: T(r, "Thank you, your message has been sent.")}}
+	encoder := json.NewEncoder(w)
+	return encoder.Encode(results)
 }
 
 // Middleware Functions begin here
@@ -481,7 +712,7 @@ func verifyUser(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 		return
 	}
 	if username := getStringFromSession(r, "User"); username != "" {
-		if user, _ := dbmap.Get(User{}, username); user != nil {
+		if user, _ := dbFor(r).Get(User{}, username); user != nil {
 			http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 			return
 		}
@@ -492,28 +723,30 @@ func verifyUser(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 	return
 }
 
-func VerifyAdmin(w http.ResponseWriter, r *http.Request) bool {
-	if username := getStringFromSession(r, "User"); username != "" {
-		if _, err := dbmap.Get(User{}, username); err == nil {
-			if role, err := dbmap.Get(Role{}, username); err == nil && role != nil && role.(*Role).Role == 0 {
-				return true
-			}
-		}
+// requireUser returns the logged in user, or an error for visitors.
+func requireUser(r *http.Request) (string, error) {
+	username := getStringFromSession(r, "User")
+	if username == "" {
+		return "", Unauthorized("Please log in first.")
 	}
-	return false
+	return username, nil
 }
 
-func VerifyAdminResponse(w http.ResponseWriter, r *http.Request, pageName string) *template.Template {
-	if VerifyAdmin(w, r) {
-		tmpl, _ := template.New("").ParseFiles("templates/header_admin.html",
-			"templates/footer.html",
-			pageName,
-			"templates/base.html")
-		return tmpl
+// requireAdmin is VerifyAdmin for appHandlers.
+func requireAdmin(w http.ResponseWriter, r *http.Request) error {
+	if !VerifyAdmin(w, r) {
+		return Unauthorized("Only administrators can do that.")
 	}
 	return nil
 }
 
-func trafficCount(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-	next(w, r)
+func VerifyAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if username := getStringFromSession(r, "User"); username != "" {
+		if _, err := dbFor(r).Get(User{}, username); err == nil {
+			if role, err := dbFor(r).Get(Role{}, username); err == nil && role != nil && role.(*Role).Role == 0 {
+				return true
+			}
+		}
+	}
+	return false
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"html"
+	"html/template"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// renderMarkdown turns the Markdown admins write for content pages into
+// HTML. Only a small subset is understood: # headings, paragraphs, - and
+// 1. lists, > quotes, ``` code blocks, --- rules, **bold**, *italics*,
+// `code` and [links](/path). Any HTML in the source is escaped rather
+// than passed through, and links may only point to site paths, http(s)
+// and mailto addresses, so the result is safe to show as is.
+func renderMarkdown(src string) template.HTML {
+	var out strings.Builder
+	lines := strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+	var para, items []string
+	list := "" // "ul" or "ol" while inside a list
+	flush := func() {
+		if len(para) > 0 {
+			out.WriteString("<p>" + markdownInline(strings.Join(para, " ")) + "</p>\n")
+			para = nil
+		}
+		if list != "" {
+			out.WriteString("<" + list + ">\n")
+			for _, item := range items {
+				out.WriteString("<li>" + markdownInline(item) + "</li>\n")
+			}
+			out.WriteString("</" + list + ">\n")
+			list, items = "", nil
+		}
+	}
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], " \t")
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			flush()
+		case strings.HasPrefix(trimmed, "```"):
+			flush()
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, lines[i])
+			}
+			out.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+		case markdownRule.MatchString(trimmed):
+			flush()
+			out.WriteString("<hr>\n")
+		case markdownHeading.MatchString(trimmed):
+			flush()
+			m := markdownHeading.FindStringSubmatch(trimmed)
+			level := strconv.Itoa(len(m[1]))
+			out.WriteString("<h" + level + ">" + markdownInline(m[2]) + "</h" + level + ">\n")
+		case strings.HasPrefix(trimmed, ">"):
+			flush()
+			var quote []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				quote = append(quote, strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")))
+			}
+			i--
+			out.WriteString("<blockquote>" + string(renderMarkdown(strings.Join(quote, "\n"))) + "</blockquote>\n")
+		case markdownBullet.MatchString(trimmed) || markdownNumber.MatchString(trimmed):
+			kind, item := "ul", markdownBullet.FindStringSubmatch(trimmed)
+			if item == nil {
+				kind, item = "ol", markdownNumber.FindStringSubmatch(trimmed)
+			}
+			if list != kind {
+				flush()
+				list = kind
+			}
+			items = append(items, item[1])
+		case list != "" && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")):
+			// An indented line continues the previous list item.
+			items[len(items)-1] += " " + trimmed
+		default:
+			if list != "" {
+				flush()
+			}
+			para = append(para, trimmed)
+		}
+	}
+	flush()
+	return template.HTML(out.String())
+}
+
+var (
+	markdownHeading = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*$`)
+	markdownRule    = regexp.MustCompile(`^(-{3,}|\*{3,}|_{3,})$`)
+	markdownBullet  = regexp.MustCompile(`^[-*+]\s+(.*)$`)
+	markdownNumber  = regexp.MustCompile(`^\d+[.)]\s+(.*)$`)
+	markdownLink    = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	markdownBold    = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	markdownItalic  = regexp.MustCompile(`\*([^*]+)\*|\b_([^_]+)_\b`)
+)
+
+// markdownInline escapes text and then applies the inline markup. Code
+// spans are left alone.
+func markdownInline(text string) string {
+	parts := strings.Split(text, "`")
+	for i, part := range parts {
+		part = html.EscapeString(part)
+		if i%2 == 1 && i < len(parts)-1 {
+			parts[i] = "<code>" + part + "</code>"
+			continue
+		}
+		part = markdownLink.ReplaceAllStringFunc(part, func(m string) string {
+			sub := markdownLink.FindStringSubmatch(m)
+			if !safeMarkdownURL(html.UnescapeString(sub[2])) {
+				return sub[1]
+			}
+			return `<a href="` + sub[2] + `">` + sub[1] + `</a>`
+		})
+		part = markdownBold.ReplaceAllString(part, "<strong>$1$2</strong>")
+		part = markdownItalic.ReplaceAllString(part, "<em>$1$2</em>")
+		if i%2 == 1 {
+			// An unmatched backtick is shown as typed.
+			part = "`" + part
+		}
+		parts[i] = part
+	}
+	return strings.Join(parts, "")
+}
+
+func safeMarkdownURL(u string) bool {
+	return isWebLink(u) || strings.HasPrefix(u, "#") || strings.HasPrefix(u, "mailto:")
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestRenderMarkdownLinks(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"[home](/)", "<p><a href=\"/\">home</a></p>\n"},
+		{"[top](#top)", "<p><a href=\"#top\">top</a></p>\n"},
+		{"[mail](mailto:a@b.c)", "<p><a href=\"mailto:a@b.c\">mail</a></p>\n"},
+		{"[x](https://e.com/?a=1&b=2)", "<p><a href=\"https://e.com/?a=1&amp;b=2\">x</a></p>\n"},
+		{"[<i>](/)", "<p><a href=\"/\">&lt;i&gt;</a></p>\n"},
+		// Links anywhere but a web page or a mail address keep only their text.
+		{"[x](javascript:void)", "<p>x</p>\n"},
+		{"[x](JavaScript:void)", "<p>x</p>\n"},
+		{"[x](vbscript:x)", "<p>x</p>\n"},
+		{"[x](data:text/html,hi)", "<p>x</p>\n"},
+		{"[x](//evil.com)", "<p>x</p>\n"},
+		{"[x](&#106;avascript:void)", "<p>x</p>\n"},
+	}
+	for _, tt := range tests {
+		if got := string(renderMarkdown(tt.src)); got != tt.want {
+			t.Errorf("renderMarkdown(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestRenderMarkdownEscapesHTML(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"<b>hi</b>", "<p>&lt;b&gt;hi&lt;/b&gt;</p>\n"},
+		{"<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"`<b>` & **bold**", "<p><code>&lt;b&gt;</code> &amp; <strong>bold</strong></p>\n"},
+		{"# <i>Title</i>", "<h1>&lt;i&gt;Title&lt;/i&gt;</h1>\n"},
+	}
+	for _, tt := range tests {
+		if got := string(renderMarkdown(tt.src)); got != tt.want {
+			t.Errorf("renderMarkdown(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
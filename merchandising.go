@@ -0,0 +1,478 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	gmux "github.com/gorilla/mux"
+)
+
+// Banner is a slide on the home page. Live banners are shown by Position,
+// then in the order they were added.
+type Banner struct {
+	Id       int64      `db:"Id"`
+	Title    string     `db:"Title,size:100" form:"title" validate:"required,max=100"`
+	Subtitle string     `db:"Subtitle" form:"subtitle" validate:"max=255"`
+	Image    string     `db:"Image" form:"image" validate:"required,max=255"` // a site path such as /img/h1.jpg, or a URL
+	Link     string     `db:"Link" form:"link" validate:"max=255"`            // where the slide leads, nowhere when empty
+	Position int        `db:"Position" form:"position" validate:"max=999"`
+	Starts   time.Time  `db:"Starts" form:"starts" validate:"required"`
+	Ends     *time.Time `db:"Ends" form:"ends"` // nil for open ended
+	Active   bool       `db:"Active" form:"active"`
+	Updated  time.Time  `db:"Updated"`
+}
+
+// Validate checks the image and link are paths or web addresses and the
+// schedule is in order.
+func (b *Banner) Validate() map[string]string {
+	problems := map[string]string{}
+	if b.Image != "" && !isWebLink(b.Image) {
+		problems["image"] = "Image must be a path starting with / or an http(s) address."
+	}
+	if b.Link != "" && !isWebLink(b.Link) {
+		problems["link"] = "Link must be a path starting with / or an http(s) address."
+	}
+	if b.Ends != nil && !b.Ends.After(b.Starts) {
+		problems["ends"] = "Ends must be after starts."
+	}
+	return problems
+}
+
+// isWebLink accepts a path on this site or an http(s) URL. Browsers read
+// a backslash as a slash and drop tabs and newlines, so "/\evil.com" or
+// "/\t/evil.com" would lead off the site like "//evil.com".
+func isWebLink(s string) bool {
+	if strings.ContainsAny(s, "\\\t\r\n") {
+		return false
+	}
+	return (strings.HasPrefix(s, "/") && !strings.HasPrefix(s, "//")) || strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "http://")
+}
+
+// defaultBanners are the slides the home page had before banners were
+// managed; they are added to an empty banners table.
+var defaultBanners = []Banner{
+	{Title: "Fashion", Image: "/img/h1.jpg", Position: 1, Active: true},
+	{Title: "Passion", Image: "/img/h2.jpg", Position: 2, Active: true},
+	{Title: "Determination", Image: "/img/h3.jpg", Position: 3, Active: true},
+}
+
+// Collection is a named list of products featured on the home page, on
+// the same schedule and ordering rules as banners.
+type Collection struct {
+	Id       int64      `db:"Id"`
+	Name     string     `db:"Name,size:100" form:"name" validate:"required,max=100"`
+	Position int        `db:"Position" form:"position" validate:"max=999"`
+	Starts   time.Time  `db:"Starts" form:"starts" validate:"required"`
+	Ends     *time.Time `db:"Ends" form:"ends"`
+	Active   bool       `db:"Active" form:"active"`
+	Updated  time.Time  `db:"Updated"`
+}
+
+func (c *Collection) Validate() map[string]string {
+	problems := map[string]string{}
+	if c.Ends != nil && !c.Ends.After(c.Starts) {
+		problems["ends"] = "Ends must be after starts."
+	}
+	return problems
+}
+
+// CollectionProduct puts a product in a collection, shown by Position.
+type CollectionProduct struct {
+	Id           int64 `db:"Id"`
+	CollectionId int64 `db:"CollectionId"`
+	ProductId    int64 `db:"ProductId"`
+	Position     int   `db:"Position"`
+}
+
+// scheduleState names where something with an on/off switch and a
+// schedule is at now: paused, scheduled, running or ended.
+func scheduleState(active bool, starts time.Time, ends *time.Time, now time.Time) string {
+	switch {
+	case !active:
+		return "paused"
+	case now.Before(starts):
+		return "scheduled"
+	case ends != nil && !now.Before(*ends):
+		return "ended"
+	}
+	return "running"
+}
+
+// liveSchedule is the WHERE clause picking rows that are running at the
+// time given as its two arguments.
+const liveSchedule = "Active AND Starts<=? AND (Ends IS NULL OR Ends>?)"
+
+type FeaturedCollection struct {
+	Collection Collection
+	Products   []ProductLink
+}
+
+type Home struct {
+	Banners     []Banner
+	Collections []FeaturedCollection
+}
+
+type HomePage struct {
+	User    string
+	Content Home
+}
+
+// HomePageHandler renders the live banners and featured collections.
+func HomePageHandler(w http.ResponseWriter, r *http.Request) error {
+	db, now := dbFor(r), time.Now()
+	var home Home
+	if _, err := db.Select(&home.Banners, "SELECT * FROM banners WHERE "+liveSchedule+" ORDER BY Position, Id", now, now); err != nil {
+		return Internal(err, "The home page is unavailable right now, please try again later.")
+	}
+	var collections []Collection
+	if _, err := db.Select(&collections, "SELECT * FROM collections WHERE "+liveSchedule+" ORDER BY Position, Id", now, now); err != nil {
+		return Internal(err, "The home page is unavailable right now, please try again later.")
+	}
+	pr, err := pricerFor(r)
+	if err != nil {
+		return err
+	}
+	for _, c := range collections {
+		var products []Product
+		if _, err := db.Select(&products, "SELECT p.* FROM products p JOIN collectionproducts cp ON cp.ProductId=p.Id "+
+			"WHERE cp.CollectionId=? ORDER BY cp.Position, p.Name", c.Id); err != nil {
+			return Internal(err, "The home page is unavailable right now, please try again later.")
+		}
+		if len(products) == 0 {
+			continue
+		}
+		fc := FeaturedCollection{Collection: c}
+		for _, p := range products {
+			fc.Products = append(fc.Products, ProductLink{Product: p, Price: pr.Price(p), Was: pr.Was(p), URL: productPath(p)})
+		}
+		home.Collections = append(home.Collections, fc)
+	}
+	return renderer.Render(w, r, "home", HomePage{User: getStringFromSession(r, "User"), Content: home})
+}
+
+// BannerRow is a banner on the admin list.
+type BannerRow struct {
+	Banner Banner
+	State  string
+}
+
+type BannerAdmin struct {
+	Banners []BannerRow
+	Edit    Banner
+	Error   string
+	Fields  map[string]string
+}
+
+type BannerAdminPage struct {
+	User    string
+	Content BannerAdmin
+}
+
+func renderBannerAdmin(w http.ResponseWriter, r *http.Request, status int, edit Banner, err error) error {
+	a := BannerAdmin{Edit: edit}
+	var banners []Banner
+	if _, lerr := dbFor(r).Select(&banners, "SELECT * FROM banners ORDER BY Position, Id"); lerr != nil {
+		return Internal(lerr, "Banners are unavailable right now.")
+	}
+	now := time.Now()
+	for _, b := range banners {
+		a.Banners = append(a.Banners, BannerRow{Banner: b, State: scheduleState(b.Active, b.Starts, b.Ends, now)})
+	}
+	if err != nil {
+		errs := formErrors(err)
+		a.Error, a.Fields = errs.Error, errs.Fields
+	}
+	return renderer.RenderStatus(w, r, status, "manage_banners", BannerAdminPage{User: getStringFromSession(r, "User"), Content: a})
+}
+
+func loadBanner(r *http.Request) (*Banner, error) {
+	id, _ := strconv.ParseInt(gmux.Vars(r)["id"], 10, 64)
+	obj, err := dbFor(r).Get(Banner{}, id)
+	if err != nil {
+		return nil, Internal(err, "The banner could not be loaded.")
+	}
+	if obj == nil {
+		return nil, NotFound("Banner %d does not exist.", id)
+	}
+	return obj.(*Banner), nil
+}
+
+// ManageBannersHandler lists the home page banners next to a form for
+// adding one or editing the one given by {id}.
+func ManageBannersHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	edit := Banner{Starts: time.Now().Truncate(time.Minute), Active: true}
+	if gmux.Vars(r)["id"] != "" {
+		b, err := loadBanner(r)
+		if err != nil {
+			return err
+		}
+		edit = *b
+	}
+	return renderBannerAdmin(w, r, http.StatusOK, edit, nil)
+}
+
+// SaveBannerHandler creates a banner, or updates it when the route has an
+// {id}.
+func SaveBannerHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	b := &Banner{}
+	if gmux.Vars(r)["id"] != "" {
+		var err error
+		if b, err = loadBanner(r); err != nil {
+			return err
+		}
+	}
+	if err := bind(r, b); err != nil {
+		return renderBannerAdmin(w, r, http.StatusBadRequest, *b, err)
+	}
+	b.Updated = time.Now()
+	var err error
+	if b.Id == 0 {
+		err = dbFor(r).Insert(b)
+	} else {
+		_, err = dbFor(r).Update(b)
+	}
+	if err != nil {
+		return Internal(err, "The banner could not be saved.")
+	}
+	http.Redirect(w, r, "/manage/banners/", http.StatusSeeOther)
+	return nil
+}
+
+func DeleteBannerHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	b, err := loadBanner(r)
+	if err != nil {
+		return err
+	}
+	if _, err := dbFor(r).Delete(b); err != nil {
+		return Internal(err, "The banner could not be deleted.")
+	}
+	http.Redirect(w, r, "/manage/banners/", http.StatusSeeOther)
+	return nil
+}
+
+// CollectionRow is a collection on the admin list.
+type CollectionRow struct {
+	Collection Collection
+	State      string
+	Products   int
+}
+
+// CollectionChoice is a product on the collection form, with its place in
+// the collection being edited.
+type CollectionChoice struct {
+	Product  Product
+	Chosen   bool
+	Position int
+}
+
+type CollectionAdmin struct {
+	Collections []CollectionRow
+	Edit        Collection
+	Products    []CollectionChoice
+	Error       string
+	Fields      map[string]string
+}
+
+type CollectionAdminPage struct {
+	User    string
+	Content CollectionAdmin
+}
+
+type collectionSize struct {
+	CollectionId int64
+	Products     int
+}
+
+// renderCollectionAdmin renders the collection list and form. chosen holds
+// the products of the edited collection by id.
+func renderCollectionAdmin(w http.ResponseWriter, r *http.Request, status int, edit Collection, chosen map[int64]CollectionProduct, err error) error {
+	a := CollectionAdmin{Edit: edit}
+	db := dbFor(r)
+	var collections []Collection
+	if _, lerr := db.Select(&collections, "SELECT * FROM collections ORDER BY Position, Id"); lerr != nil {
+		return Internal(lerr, "Collections are unavailable right now.")
+	}
+	var sizes []collectionSize
+	if _, lerr := db.Select(&sizes, "SELECT CollectionId, count(*) AS Products FROM collectionproducts GROUP BY CollectionId"); lerr != nil {
+		return Internal(lerr, "Collections are unavailable right now.")
+	}
+	counts := map[int64]int{}
+	for _, s := range sizes {
+		counts[s.CollectionId] = s.Products
+	}
+	now := time.Now()
+	for _, c := range collections {
+		a.Collections = append(a.Collections, CollectionRow{Collection: c, State: scheduleState(c.Active, c.Starts, c.Ends, now), Products: counts[c.Id]})
+	}
+	var products []Product
+	if _, lerr := db.Select(&products, "SELECT * FROM products ORDER BY Name"); lerr != nil {
+		return Internal(lerr, "Collections are unavailable right now.")
+	}
+	for _, p := range products {
+		cp, ok := chosen[p.Id]
+		a.Products = append(a.Products, CollectionChoice{Product: p, Chosen: ok, Position: cp.Position})
+	}
+	if err != nil {
+		errs := formErrors(err)
+		a.Error, a.Fields = errs.Error, errs.Fields
+	}
+	return renderer.RenderStatus(w, r, status, "manage_collections", CollectionAdminPage{User: getStringFromSession(r, "User"), Content: a})
+}
+
+func loadCollection(r *http.Request) (*Collection, error) {
+	id, _ := strconv.ParseInt(gmux.Vars(r)["id"], 10, 64)
+	obj, err := dbFor(r).Get(Collection{}, id)
+	if err != nil {
+		return nil, Internal(err, "The collection could not be loaded.")
+	}
+	if obj == nil {
+		return nil, NotFound("Collection %d does not exist.", id)
+	}
+	return obj.(*Collection), nil
+}
+
+// collectionProducts returns the products in collection id by product id.
+func collectionProducts(db *meteredDbMap, id int64) (map[int64]CollectionProduct, error) {
+	var cps []CollectionProduct
+	if _, err := db.Select(&cps, "SELECT * FROM collectionproducts WHERE CollectionId=?", id); err != nil {
+		return nil, err
+	}
+	chosen := map[int64]CollectionProduct{}
+	for _, cp := range cps {
+		chosen[cp.ProductId] = cp
+	}
+	return chosen, nil
+}
+
+// ManageCollectionsHandler lists the featured collections next to a form
+// for adding one or editing the one given by {id}.
+func ManageCollectionsHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	edit := Collection{Starts: time.Now().Truncate(time.Minute), Active: true}
+	chosen := map[int64]CollectionProduct{}
+	if gmux.Vars(r)["id"] != "" {
+		c, err := loadCollection(r)
+		if err != nil {
+			return err
+		}
+		edit = *c
+		if chosen, err = collectionProducts(dbFor(r), c.Id); err != nil {
+			return Internal(err, "The collection could not be loaded.")
+		}
+	}
+	return renderCollectionAdmin(w, r, http.StatusOK, edit, chosen, nil)
+}
+
+// SaveCollectionHandler creates a collection, or updates it when the route
+// has an {id}. The ticked product_id boxes become its products, ordered by
+// their position_<product id> inputs.
+func SaveCollectionHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	c := &Collection{}
+	if gmux.Vars(r)["id"] != "" {
+		var err error
+		if c, err = loadCollection(r); err != nil {
+			return err
+		}
+	}
+	err := bind(r, c)
+	chosen := map[int64]CollectionProduct{}
+	for _, raw := range r.Form["product_id"] {
+		id, perr := strconv.ParseInt(raw, 10, 64)
+		if perr != nil {
+			return Validation("Invalid product id %q.", raw)
+		}
+		position, _ := strconv.Atoi(r.FormValue("position_" + raw))
+		chosen[id] = CollectionProduct{ProductId: id, Position: position}
+	}
+	if err == nil && len(chosen) == 0 {
+		msg := "Pick at least one product."
+		err = &AppError{Kind: KindValidation, Message: msg, Fields: map[string]string{"product_id": msg}}
+	}
+	if err != nil {
+		return renderCollectionAdmin(w, r, http.StatusBadRequest, *c, chosen, err)
+	}
+	c.Updated = time.Now()
+	if err := saveCollection(dbFor(r), c, chosen); err != nil {
+		return Internal(err, "The collection could not be saved.")
+	}
+	http.Redirect(w, r, "/manage/collections/", http.StatusSeeOther)
+	return nil
+}
+
+// saveCollection stores c with its products in one transaction, so the
+// home page never shows a collection with half its products.
+func saveCollection(db *meteredDbMap, c *Collection, products map[int64]CollectionProduct) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if c.Id == 0 {
+		err = tx.Insert(c)
+	} else {
+		_, err = tx.Update(c)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM collectionproducts WHERE CollectionId=?", c.Id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, cp := range products {
+		cp.CollectionId = c.Id
+		if err := tx.Insert(&cp); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// deleteCollection deletes c and its products in one transaction.
+func deleteCollection(db *meteredDbMap, c *Collection) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM collectionproducts WHERE CollectionId=?", c.Id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Delete(c); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func DeleteCollectionHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	c, err := loadCollection(r)
+	if err != nil {
+		return err
+	}
+	if err := deleteCollection(dbFor(r), c); err != nil {
+		return Internal(err, "The collection could not be deleted.")
+	}
+	http.Redirect(w, r, "/manage/collections/", http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleState(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	before, after := now.Add(-time.Hour), now.Add(time.Hour)
+	tests := []struct {
+		active bool
+		starts time.Time
+		ends   *time.Time
+		want   string
+	}{
+		{false, before, nil, "paused"},
+		{false, after, nil, "paused"},
+		{true, after, nil, "scheduled"},
+		{true, before, nil, "running"},
+		{true, now, nil, "running"},
+		{true, before, &after, "running"},
+		{true, before, &now, "ended"},
+		{true, before, &before, "ended"},
+	}
+	for _, tt := range tests {
+		if got := scheduleState(tt.active, tt.starts, tt.ends, now); got != tt.want {
+			t.Errorf("scheduleState(%v, %v, %v) = %q, want %q", tt.active, tt.starts, tt.ends, got, tt.want)
+		}
+	}
+}
+
+func TestIsWebLink(t *testing.T) {
+	tests := []struct {
+		link string
+		want bool
+	}{
+		{"/category/tools/", true},
+		{"https://example.com/", true},
+		{"http://example.com/", true},
+		{"", false},
+		{"//evil.com", false},
+		{`/\evil.com`, false},
+		{"/\t/evil.com", false},
+		{"/\n/evil.com", false},
+		{"javascript:alert(1)", false},
+		{"category/tools/", false},
+	}
+	for _, tt := range tests {
+		if got := isWebLink(tt.link); got != tt.want {
+			t.Errorf("isWebLink(%q) = %v, want %v", tt.link, got, tt.want)
+		}
+	}
+}
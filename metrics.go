@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	gmux "github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/urfave/negroni"
+)
+
+// sessionWindow is how long a logged-in user counts as active after
+// their last request.
+const sessionWindow = 30 * time.Minute
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wildview_http_requests_total",
+		Help: "HTTP requests by route template, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "wildview_http_request_duration_seconds",
+		Help:    "HTTP request latency by route template and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	httpResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wildview_http_responses_total",
+		Help: "HTTP responses by status code.",
+	}, []string{"code"})
+
+	dbDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "wildview_db_query_duration_seconds",
+		Help:    "Database call latency by gorp operation.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"operation"})
+
+	dbErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wildview_db_errors_total",
+		Help: "Failed database calls by gorp operation.",
+	}, []string{"operation"})
+
+	loginsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "wildview_logins_total",
+		Help: "Successful logins.",
+	})
+
+	registrationsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "wildview_registrations_total",
+		Help: "New user registrations.",
+	})
+
+	subscriptionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "wildview_subscriptions_total",
+		Help: "Confirmed newsletter subscriptions.",
+	})
+
+	contactSubmissionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "wildview_contact_submissions_total",
+		Help: "Contact form submissions.",
+	})
+
+	emailsSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wildview_emails_total",
+		Help: "Delivery attempts from the mail queue by result.",
+	}, []string{"result"})
+
+	abuseRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wildview_abuse_rejections_total",
+		Help: "Public form posts rejected by the abuse checks, by form and check.",
+	}, []string{"form", "check"})
+)
+
+var activeSessions = &sessionTracker{lastSeen: map[string]time.Time{}}
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpDuration, httpResponses,
+		dbDuration, dbErrors,
+		loginsTotal, registrationsTotal, subscriptionsTotal, contactSubmissionsTotal,
+		emailsSent, abuseRejections)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "wildview_active_sessions",
+		Help: "Logged-in users seen within the last 30 minutes.",
+	}, func() float64 {
+		return float64(activeSessions.count(time.Now()))
+	}))
+}
+
+// sessionTracker remembers when each logged-in user was last seen. The
+// cookie store keeps no server-side state, so this is the only way to
+// tell how many sessions are live.
+type sessionTracker struct {
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+}
+
+func (t *sessionTracker) touch(username string, now time.Time) {
+	t.mu.Lock()
+	t.lastSeen[username] = now
+	t.mu.Unlock()
+}
+
+func (t *sessionTracker) forget(username string) {
+	t.mu.Lock()
+	delete(t.lastSeen, username)
+	t.mu.Unlock()
+}
+
+// count returns the number of active sessions and drops expired ones.
+func (t *sessionTracker) count(now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for username, seen := range t.lastSeen {
+		if now.Sub(seen) > sessionWindow {
+			delete(t.lastSeen, username)
+		}
+	}
+	return len(t.lastSeen)
+}
+
+func observeDbQuery(operation string, start time.Time, err error) {
+	dbDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil && err != sql.ErrNoRows {
+		dbErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+// routeTemplate returns the path template of the route that will serve r,
+// so that /product/1/ and /product/2/ share a label.
+func routeTemplate(router *gmux.Router, r *http.Request) string {
+	var match gmux.RouteMatch
+	if router.Match(r, &match) && match.Route != nil {
+		if tmpl, err := match.Route.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return "unmatched"
+}
+
+// trafficCount records request counts, latency and status codes per route.
+func trafficCount(router *gmux.Router) negroni.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		start := time.Now()
+		route := routeTemplate(router, r)
+		if username := getStringFromSession(r, "User"); username != "" {
+			activeSessions.touch(username, start)
+		}
+
+		next(w, r)
+
+		status := http.StatusOK
+		if nw, ok := w.(negroni.ResponseWriter); ok && nw.Status() != 0 {
+			status = nw.Status()
+		}
+		code := strconv.Itoa(status)
+		httpRequests.WithLabelValues(route, r.Method, code).Inc()
+		httpResponses.WithLabelValues(code).Inc()
+		httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	}
+}
+
+// serveMetrics serves /metrics on a listener of its own, so that it can be
+// kept off the public address of the shop. serve shuts the returned
+// server down with the shop.
+func serveMetrics(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		logger.Info(context.Background(), "metrics listening", Fields{"addr": addr})
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			logger.Error(context.Background(), "metrics server stopped", Fields{"error": err})
+		}
+	}()
+	return server
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Money is an amount in the minor units of a currency, e.g. cents for US
+// dollars. Amounts of different currencies are never added up; convert
+// one of them first.
+type Money struct {
+	Amount   int64
+	Currency string // ISO 4217 code
+}
+
+type currencyInfo struct {
+	Name     string
+	Symbol   string
+	Decimals int // minor units per major unit, as a power of ten
+}
+
+// currencies are the ones prices can be shown in.
+var currencies = map[string]currencyInfo{
+	"USD": {"US dollar", "$", 2},
+	"EUR": {"Euro", "€", 2},
+	"GBP": {"Pound sterling", "£", 2},
+	"CAD": {"Canadian dollar", "CA$", 2},
+	"MXN": {"Mexican peso", "MX$", 2},
+	"AUD": {"Australian dollar", "A$", 2},
+	"NZD": {"New Zealand dollar", "NZ$", 2},
+	"CNY": {"Chinese yuan", "CN¥", 2},
+	"HKD": {"Hong Kong dollar", "HK$", 2},
+	"JPY": {"Japanese yen", "¥", 0},
+}
+
+// decimals is how many digits currency has after the decimal point.
+func decimals(currency string) int {
+	if info, ok := currencies[currency]; ok {
+		return info.Decimals
+	}
+	return 2
+}
+
+// minorUnits is how many minor units make one major unit of currency.
+func minorUnits(currency string) int64 {
+	n := int64(1)
+	for i := 0; i < decimals(currency); i++ {
+		n *= 10
+	}
+	return n
+}
+
+func (m Money) Add(o Money) Money {
+	return Money{m.Amount + o.Amount, m.Currency}
+}
+
+func (m Money) Sub(o Money) Money {
+	return Money{m.Amount - o.Amount, m.Currency}
+}
+
+func (m Money) Mul(n int) Money {
+	return Money{m.Amount * int64(n), m.Currency}
+}
+
+// Percent is rate percent of m, rounded to the nearest minor unit.
+func (m Money) Percent(rate float64) Money {
+	return Money{int64(math.Round(float64(m.Amount) * rate / 100)), m.Currency}
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+// Decimal is m in major units without a symbol, e.g. "14.99".
+func (m Money) Decimal() string {
+	amount, sign := m.Amount, ""
+	if amount < 0 {
+		amount, sign = -amount, "-"
+	}
+	digits, units := decimals(m.Currency), minorUnits(m.Currency)
+	if digits == 0 {
+		return sign + strconv.FormatInt(amount, 10)
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/units, digits, amount%units)
+}
+
+// String formats m for people, e.g. "$14.99" or "-€5.00".
+func (m Money) String() string {
+	symbol := m.Currency + " "
+	if info, ok := currencies[m.Currency]; ok {
+		symbol = info.Symbol
+	}
+	s := m.Decimal()
+	if strings.HasPrefix(s, "-") {
+		return "-" + symbol + s[1:]
+	}
+	return symbol + s
+}
+
+// MarshalJSON adds the formatted amount, so scripts do not need to know
+// how every currency is written.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Amount   int64
+		Currency string
+		Display  string
+	}{m.Amount, m.Currency, m.String()})
+}
+
+// parseMoney reads an amount in major units as an admin types it, e.g.
+// "14.99", into currency.
+func parseMoney(s, currency string) (Money, error) {
+	s = strings.TrimSpace(s)
+	digits := decimals(currency)
+	whole, frac := s, ""
+	if i := strings.Index(s, "."); i >= 0 {
+		whole, frac = s[:i], s[i+1:]
+	}
+	if len(frac) > digits {
+		return Money{}, fmt.Errorf("%s has too many decimals for %s", s, currency)
+	}
+	major, err := strconv.ParseUint(whole, 10, 32)
+	if err != nil {
+		return Money{}, fmt.Errorf("%q is not an amount", s)
+	}
+	minor := int64(0)
+	if frac != "" {
+		n, err := strconv.ParseUint(frac, 10, 32)
+		if err != nil {
+			return Money{}, fmt.Errorf("%q is not an amount", s)
+		}
+		minor = int64(n)
+		for i := len(frac); i < digits; i++ {
+			minor *= 10
+		}
+	}
+	return Money{int64(major)*minorUnits(currency) + minor, currency}, nil
+}
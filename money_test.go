@@ -0,0 +1,96 @@
+package main
+
+import "testing"
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in, currency string
+		want         int64
+	}{
+		{"14.99", "USD", 1499},
+		{"14", "USD", 1400},
+		{"14.9", "USD", 1490},
+		{"0.05", "USD", 5},
+		{" 3.50 ", "EUR", 350},
+		{"1500", "JPY", 1500},
+	}
+	for _, tt := range tests {
+		got, err := parseMoney(tt.in, tt.currency)
+		if err != nil || got != (Money{tt.want, tt.currency}) {
+			t.Errorf("parseMoney(%q, %s) = %v, %v, want %d", tt.in, tt.currency, got, err, tt.want)
+		}
+	}
+	for _, bad := range []string{"", "abc", "-1", "1.x", "14.999", "1,50", "99999999999"} {
+		if got, err := parseMoney(bad, "USD"); err == nil {
+			t.Errorf("parseMoney(%q, USD) = %v, want an error", bad, got)
+		}
+	}
+	if got, err := parseMoney("1.5", "JPY"); err == nil {
+		t.Errorf("parseMoney(1.5, JPY) = %v, want an error", got)
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{Money{1499, "USD"}, "$14.99"},
+		{Money{5, "USD"}, "$0.05"},
+		{Money{-500, "EUR"}, "-€5.00"},
+		{Money{1500, "JPY"}, "¥1500"},
+		{Money{100, "XYZ"}, "XYZ 1.00"},
+	}
+	for _, tt := range tests {
+		if got := tt.m.String(); got != tt.want {
+			t.Errorf("%#v.String() = %q, want %q", tt.m, got, tt.want)
+		}
+	}
+}
+
+func TestMoneyPercent(t *testing.T) {
+	tests := []struct {
+		amount int64
+		rate   float64
+		want   int64
+	}{
+		{1000, 10, 100},
+		{999, 10, 100},
+		{994, 10, 99},
+		{1999, 12.5, 250},
+		{-1000, 15, -150},
+	}
+	for _, tt := range tests {
+		if got := (Money{tt.amount, "USD"}).Percent(tt.rate); got.Amount != tt.want {
+			t.Errorf("Percent(%d, %v) = %d, want %d", tt.amount, tt.rate, got.Amount, tt.want)
+		}
+	}
+}
+
+func TestExchangeRateRound(t *testing.T) {
+	tests := []struct {
+		step     int64
+		rounding string
+		minor    float64
+		want     int64
+	}{
+		{1, "nearest", 1378.6, 1379},
+		{0, "nearest", 1378.4, 1378},
+		{100, "nearest", 1449, 1400},
+		{100, "nearest", 1450, 1500},
+		{100, "up", 1401, 1500},
+		{100, "up", 1400, 1400},
+		{100, "down", 1499, 1400},
+		{100, "down", 1500, 1500},
+		{5, "up", 1376.2, 1380},
+		// Conversions that land a hair off a step stay on it.
+		{100, "up", 1400.0000000001, 1400},
+		{100, "down", 1499.9999999999, 1500},
+	}
+	for _, tt := range tests {
+		x := ExchangeRate{Step: tt.step, Rounding: tt.rounding}
+		if got := x.round(tt.minor); got != tt.want {
+			t.Errorf("round(%v) to %d %s = %d, want %d", tt.minor, tt.step, tt.rounding, got, tt.want)
+		}
+	}
+}
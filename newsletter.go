@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	gmux "github.com/gorilla/mux"
+)
+
+// Subscriber statuses. New subscribers stay pending until they follow the
+// link in the confirmation email.
+const (
+	SubscriberPending      = "pending"
+	SubscriberActive       = "active"
+	SubscriberUnsubscribed = "unsubscribed"
+	SubscriberBounced      = "bounced"
+)
+
+var subscriberStatuses = []string{SubscriberPending, SubscriberActive, SubscriberUnsubscribed, SubscriberBounced}
+
+// Campaign is a newsletter composed in the admin area.
+type Campaign struct {
+	Id         int64     `db:"Id"`
+	Subject    string    `db:"Subject" form:"subject" validate:"required,max=255"`
+	Body       string    `db:"Body,size:65535" form:"body" validate:"required"` // plain text, blank lines separate paragraphs
+	Status     string    `db:"Status,size:16"`                                  // draft, sending or sent
+	Recipients int       `db:"Recipients"`
+	Author     string    `db:"Author"`
+	Created    time.Time `db:"Created"`
+	Updated    time.Time `db:"Updated"`
+}
+
+func subscriptionLink(path, purpose, email string) string {
+	q := url.Values{"email": {email}, "token": {signToken(purpose, email)}}
+	return absoluteURL(path + "?" + q.Encode())
+}
+
+type confirmEmail struct {
+	ConfirmURL string
+}
+
+type campaignEmail struct {
+	Subject        string
+	Paragraphs     []string
+	UnsubscribeURL string
+}
+
+func newCampaignEmail(c Campaign, email string) campaignEmail {
+	return campaignEmail{
+		Subject:        c.Subject,
+		Paragraphs:     paragraphs(c.Body),
+		UnsubscribeURL: subscriptionLink("/unsubscribe/", "unsubscribe", email),
+	}
+}
+
+// paragraphs splits plain text typed into an admin form on blank lines.
+func paragraphs(text string) []string {
+	var paras []string
+	for _, para := range strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n\n") {
+		if para = strings.TrimSpace(para); para != "" {
+			paras = append(paras, para)
+		}
+	}
+	return paras
+}
+
+func queueConfirmation(db *meteredDbMap, email string) error {
+	body, err := renderEmail("confirm_subscription.html", confirmEmail{
+		ConfirmURL: subscriptionLink("/subscribe/confirm/", "subscribe", email),
+	})
+	if err != nil {
+		return err
+	}
+	return queueEmail(db, Email{To: email, Subject: "Please confirm your WildView subscription", HTML: body})
+}
+
+// markBounced stops mailing an address the mail server rejected.
+func markBounced(db *meteredDbMap, email string) error {
+	_, err := db.Exec("UPDATE subscribers SET Status=? WHERE Email=?", SubscriberBounced, email)
+	return err
+}
+
+// SubscribeHandler records a pending subscriber and sends the
+// confirmation email of the double opt-in.
+func SubscribeHandler(w http.ResponseWriter, r *http.Request) error {
+	form := Subscriber{}
+	if err := bind(r, &form); err != nil {
+		return err
+	}
+	email := form.Email
+	if err := checkAbuse(newSubmission(r, "subscribe", email, "")); err != nil {
+		return err
+	}
+	if err := requestSubscription(dbFor(r), email); err != nil {
+		return err
+	}
+	results := []ContentReturn{{Error: T(r, "Almost done! Please check your inbox to confirm your subscription.")}}
+	encoder := json.NewEncoder(w)
+	return encoder.Encode(results)
+}
+
+// requestSubscription makes email a pending subscriber and sends the
+// confirmation email.
+func requestSubscription(db *meteredDbMap, email string) error {
+	var existing []Subscriber
+	if _, err := db.Select(&existing, "select * from subscribers WHERE Email = ?", email); err != nil {
+		return Internal(err, "Subscription failed, please try again later.")
+	}
+	if len(existing) > 0 {
+		subs := existing[0]
+		if subs.Status == SubscriberActive {
+			return Conflict("%s is already subscribed.", email)
+		}
+		subs.Status = SubscriberPending
+		if _, err := db.Update(&subs); err != nil {
+			return Internal(err, "Subscription failed, please try again later.")
+		}
+	} else {
+		subs := Subscriber{Id: 0, Email: email, Status: SubscriberPending, Created: time.Now()}
+		if err := db.Insert(&subs); err != nil {
+			return Internal(err, "Subscription failed, please try again later.")
+		}
+	}
+	if err := queueConfirmation(db, email); err != nil {
+		return Internal(err, "Subscription failed, please try again later.")
+	}
+	return nil
+}
+
+// setSubscriberStatus applies a status change requested through a signed
+// email link.
+func setSubscriberStatus(r *http.Request, purpose, status string) (string, error) {
+	email := r.FormValue("email")
+	if !verifyToken(purpose, email, r.FormValue("token")) {
+		return "", Validation("This link is invalid or has been tampered with.")
+	}
+	res, err := dbFor(r).Exec("UPDATE subscribers SET Status=? WHERE Email=? AND Status<>?", status, email, status)
+	if err != nil {
+		return "", Internal(err, "Your subscription could not be updated, please try again later.")
+	}
+	if n, _ := res.RowsAffected(); n > 0 && status == SubscriberActive {
+		subscriptionsTotal.Inc()
+	}
+	return email, nil
+}
+
+func ConfirmSubscriptionHandler(w http.ResponseWriter, r *http.Request) error {
+	email, err := setSubscriberStatus(r, "subscribe", SubscriberActive)
+	if err != nil {
+		return err
+	}
+	p := MessagePage{User: getStringFromSession(r, "User"), Content: Message{
+		Title: T(r, "You are subscribed!"),
+		Text:  T(r, "%s will now receive our newsletter.", email),
+	}}
+	return renderer.Render(w, r, "message", p)
+}
+
+// UnsubscribeHandler serves the link in every newsletter, and also the
+// one-click POST mail clients send for the List-Unsubscribe header.
+func UnsubscribeHandler(w http.ResponseWriter, r *http.Request) error {
+	email, err := setSubscriberStatus(r, "unsubscribe", SubscriberUnsubscribed)
+	if err != nil {
+		return err
+	}
+	if r.Method == "POST" {
+		return nil
+	}
+	p := MessagePage{User: getStringFromSession(r, "User"), Content: Message{
+		Title: T(r, "You are unsubscribed"),
+		Text:  T(r, "%s will no longer receive our newsletter.", email),
+	}}
+	return renderer.Render(w, r, "message", p)
+}
+
+type StatusCount struct {
+	Status string
+	Count  int64
+}
+
+type NewsletterAdmin struct {
+	Counts      []StatusCount
+	Status      string
+	Statuses    []string
+	Subscribers []Subscriber
+	Campaigns   []Campaign
+	Error       string
+}
+
+type NewsletterPage struct {
+	User    string
+	Content NewsletterAdmin
+}
+
+func newsletterAdmin(r *http.Request) (NewsletterAdmin, error) {
+	a := NewsletterAdmin{Status: r.FormValue("status"), Statuses: subscriberStatuses}
+	for _, status := range subscriberStatuses {
+		count, err := dbFor(r).SelectInt("SELECT count(*) FROM subscribers WHERE Status=?", status)
+		if err != nil {
+			return a, err
+		}
+		a.Counts = append(a.Counts, StatusCount{status, count})
+	}
+	query, args := "SELECT * FROM subscribers", []interface{}{}
+	if a.Status != "" {
+		query, args = query+" WHERE Status=?", append(args, a.Status)
+	}
+	if _, err := dbFor(r).Select(&a.Subscribers, query+" ORDER BY Id DESC LIMIT 200", args...); err != nil {
+		return a, err
+	}
+	if _, err := dbFor(r).Select(&a.Campaigns, "SELECT * FROM campaigns ORDER BY Id DESC"); err != nil {
+		return a, err
+	}
+	return a, nil
+}
+
+// ManageNewsletterHandler lists subscribers and campaigns and lets an
+// admin compose a new campaign.
+func ManageNewsletterHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	a, err := newsletterAdmin(r)
+	if err != nil {
+		return Internal(err, "The newsletter admin is unavailable right now.")
+	}
+	return renderer.Render(w, r, "manage_newsletter", NewsletterPage{User: getStringFromSession(r, "User"), Content: a})
+}
+
+func CreateCampaignHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	now := time.Now()
+	c := Campaign{Status: "draft", Author: getStringFromSession(r, "User"), Created: now, Updated: now}
+	if err := bind(r, &c); err != nil {
+		a, aerr := newsletterAdmin(r)
+		if aerr != nil {
+			return Internal(aerr, "The newsletter admin is unavailable right now.")
+		}
+		a.Error = asAppError(err).Message
+		return renderer.RenderStatus(w, r, http.StatusBadRequest, "manage_newsletter", NewsletterPage{User: c.Author, Content: a})
+	}
+	if err := dbFor(r).Insert(&c); err != nil {
+		return Internal(err, "The campaign could not be saved.")
+	}
+	http.Redirect(w, r, "/manage/newsletter/"+strconv.FormatInt(c.Id, 10)+"/", http.StatusSeeOther)
+	return nil
+}
+
+func loadCampaign(r *http.Request) (*Campaign, error) {
+	id, _ := strconv.ParseInt(gmux.Vars(r)["id"], 10, 64)
+	obj, err := dbFor(r).Get(Campaign{}, id)
+	if err != nil {
+		return nil, Internal(err, "The campaign could not be loaded.")
+	}
+	if obj == nil {
+		return nil, NotFound("Campaign %d does not exist.", id)
+	}
+	return obj.(*Campaign), nil
+}
+
+type CampaignAdmin struct {
+	Campaign   Campaign
+	Preview    template.HTML
+	Recipients int64
+}
+
+type CampaignPage struct {
+	User    string
+	Content CampaignAdmin
+}
+
+// CampaignHandler previews a campaign exactly as subscribers will get it.
+func CampaignHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	c, err := loadCampaign(r)
+	if err != nil {
+		return err
+	}
+	preview, err := renderEmail("campaign.html", newCampaignEmail(*c, "subscriber@example.com"))
+	if err != nil {
+		return Internal(err, "The campaign preview could not be rendered.")
+	}
+	recipients, err := dbFor(r).SelectInt("SELECT count(*) FROM subscribers WHERE Status=?", SubscriberActive)
+	if err != nil {
+		return Internal(err, "The campaign could not be loaded.")
+	}
+	// preview comes from our own email template, which escapes the body.
+	p := CampaignPage{User: getStringFromSession(r, "User"), Content: CampaignAdmin{
+		Campaign:   *c,
+		Preview:    template.HTML(preview),
+		Recipients: recipients,
+	}}
+	return renderer.Render(w, r, "manage_campaign", p)
+}
+
+// queueCampaign queues emails and marks c sent in one transaction, so a
+// campaign is either sent to everyone or still a draft.
+func queueCampaign(db *meteredDbMap, c *Campaign, emails []Email) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return Internal(err, "The campaign could not be sent.")
+	}
+	// Claiming the draft first makes a double click wait for this
+	// transaction and then find nothing to send.
+	res, err := tx.Exec("UPDATE campaigns SET Status='sending' WHERE Id=? AND Status='draft'", c.Id)
+	if err != nil {
+		tx.Rollback()
+		return Internal(err, "The campaign could not be sent.")
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		tx.Rollback()
+		return Conflict("This campaign has already been sent.")
+	}
+	for _, msg := range emails {
+		if err := queueEmail(tx, msg); err != nil {
+			tx.Rollback()
+			return Internal(err, "The campaign could not be queued.")
+		}
+	}
+	if _, err := tx.Update(c); err != nil {
+		tx.Rollback()
+		return Internal(err, "The campaign could not be updated.")
+	}
+	if err := tx.Commit(); err != nil {
+		return Internal(err, "The campaign could not be sent.")
+	}
+	return nil
+}
+
+// SendCampaignHandler queues one email per active subscriber. The mail
+// job sends them at the configured rate.
+func SendCampaignHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	c, err := loadCampaign(r)
+	if err != nil {
+		return err
+	}
+	if c.Status != "draft" {
+		return Conflict("This campaign has already been sent.")
+	}
+	db := dbFor(r)
+	var subs []Subscriber
+	if _, err := db.Select(&subs, "SELECT * FROM subscribers WHERE Status=?", SubscriberActive); err != nil {
+		return Internal(err, "The campaign could not be sent.")
+	}
+	emails := make([]Email, 0, len(subs))
+	for _, s := range subs {
+		data := newCampaignEmail(*c, s.Email)
+		body, err := renderEmail("campaign.html", data)
+		if err != nil {
+			return Internal(err, "The campaign could not be rendered.")
+		}
+		emails = append(emails, Email{
+			To:      s.Email,
+			Subject: c.Subject,
+			HTML:    body,
+			Headers: map[string]string{
+				"List-Unsubscribe":      "<" + data.UnsubscribeURL + ">",
+				"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+			},
+		})
+	}
+	c.Status, c.Recipients, c.Updated = "sent", len(emails), time.Now()
+	if err := queueCampaign(db, c, emails); err != nil {
+		return err
+	}
+	logger.Info(r.Context(), "campaign queued", Fields{"campaign": c.Id, "recipients": c.Recipients})
+	http.Redirect(w, r, "/manage/newsletter/"+strconv.FormatInt(c.Id, 10)+"/", http.StatusSeeOther)
+	return nil
+}
+
+// SubscriberStatusHandler lets an admin correct a subscriber's status,
+// e.g. to record a bounce reported outside the mail server.
+func SubscriberStatusHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	status := r.FormValue("status")
+	if !contains(subscriberStatuses, status) {
+		return Validation("Unknown subscriber status %q.", status)
+	}
+	id, _ := strconv.ParseInt(gmux.Vars(r)["id"], 10, 64)
+	obj, err := dbFor(r).Get(Subscriber{}, id)
+	if err != nil {
+		return Internal(err, "The subscriber could not be loaded.")
+	}
+	if obj == nil {
+		return NotFound("Subscriber %d does not exist.", id)
+	}
+	subs := obj.(*Subscriber)
+	subs.Status = status
+	if _, err := dbFor(r).Update(subs); err != nil {
+		return Internal(err, "The subscriber could not be updated.")
+	}
+	http.Redirect(w, r, "/manage/newsletter/", http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Order is a priced cart a customer committed to. Amounts are minor units
+// of Currency, as they were when the order was placed. There is no payment
+// yet, so every order stays placed.
+type Order struct {
+	Id               int64     `db:"Id"`
+	Username         string    `db:"Username"`
+	Currency         string    `db:"Currency,size:3"`
+	Subtotal         int64     `db:"Subtotal"`
+	Discount         int64     `db:"Discount"`
+	Shipping         int64     `db:"Shipping"`
+	ShippingDiscount int64     `db:"ShippingDiscount"`
+	ShippingMethod   string    `db:"ShippingMethod,size:32"`
+	Tax              int64     `db:"Tax"`
+	Total            int64     `db:"Total"`
+	Country          string    `db:"Country,size:2"`
+	Region           string    `db:"Region"`
+	PostalCode       string    `db:"PostalCode,size:20"`
+	Status           string    `db:"Status,size:16"`
+	Created          time.Time `db:"Created"`
+}
+
+// OrderItem is a line of an order.
+type OrderItem struct {
+	Id        int64  `db:"Id"`
+	OrderId   int64  `db:"OrderId"`
+	ProductId int64  `db:"ProductId"`
+	Name      string `db:"Name"`
+	Quantity  int    `db:"Quantity"`
+	UnitPrice int64  `db:"UnitPrice"`
+	Discount  int64  `db:"Discount"`
+	Tax       int64  `db:"Tax"`
+}
+
+const OrderPlaced = "placed"
+
+// TotalMoney is the order total with its currency.
+func (o Order) TotalMoney() Money {
+	return Money{o.Total, o.Currency}
+}
+
+// newOrder turns priced totals into an order and its items.
+func newOrder(username string, dest Address, t OrderTotals, now time.Time) (Order, []OrderItem) {
+	o := Order{
+		Username:         username,
+		Currency:         t.Currency,
+		Subtotal:         t.Subtotal.Amount,
+		Discount:         t.Discount.Amount,
+		Shipping:         t.Shipping.Rate.Amount,
+		ShippingDiscount: t.ShippingDiscount.Amount,
+		ShippingMethod:   t.Shipping.Code,
+		Tax:              t.Tax.Amount,
+		Total:            t.Total.Amount,
+		Country:          dest.Country,
+		Region:           dest.Region,
+		PostalCode:       dest.PostalCode,
+		Status:           OrderPlaced,
+		Created:          now,
+	}
+	var items []OrderItem
+	for _, line := range t.Lines {
+		items = append(items, OrderItem{ProductId: line.ProductId, Name: line.Name, Quantity: line.Quantity,
+			UnitPrice: line.UnitPrice.Amount, Discount: line.Discount.Amount, Tax: line.Tax.Amount})
+	}
+	return o, items
+}
+
+// placeOrder stores the order for t and counts its promotions against
+// their usage limits in one transaction. The promotions are locked and
+// their limits checked again, so two orders cannot both take the last
+// use of a code.
+func placeOrder(db *meteredDbMap, username string, dest Address, t OrderTotals) (*Order, error) {
+	now := time.Now()
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, Internal(err, "Your order could not be placed.")
+	}
+	for _, d := range t.Discounts {
+		var p Promotion
+		if err := tx.SelectOne(&p, "SELECT * FROM promotions WHERE Id=? FOR UPDATE", d.PromotionId); err != nil {
+			tx.Rollback()
+			return nil, Internal(err, "Your order could not be placed.")
+		}
+		ok, reason, err := p.usable(tx.meteredDbMap, username, now)
+		if err != nil {
+			tx.Rollback()
+			return nil, Internal(err, "Your order could not be placed.")
+		}
+		if !ok {
+			tx.Rollback()
+			return nil, &AppError{Kind: KindConflict, Message: reason, Fields: map[string]string{"coupon": reason}}
+		}
+	}
+	order, items := newOrder(username, dest, t, now)
+	if err := tx.Insert(&order); err != nil {
+		tx.Rollback()
+		return nil, Internal(err, "Your order could not be placed.")
+	}
+	for i := range items {
+		items[i].OrderId = order.Id
+		if err := tx.Insert(&items[i]); err != nil {
+			tx.Rollback()
+			return nil, Internal(err, "Your order could not be placed.")
+		}
+	}
+	if err := recordPromotionUses(tx, t.Discounts, username, strconv.FormatInt(order.Id, 10)); err != nil {
+		tx.Rollback()
+		return nil, Internal(err, "Your order could not be placed.")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, Internal(err, "Your order could not be placed.")
+	}
+	return &order, nil
+}
+
+// PlacedOrder is the response to placing an order.
+type PlacedOrder struct {
+	OrderId int64
+	Totals  OrderTotals
+}
+
+// PlaceOrderHandler prices the cart like CartTotalsHandler and places the
+// order for the logged in customer, which is when promotions count as
+// used.
+func PlaceOrderHandler(w http.ResponseWriter, r *http.Request) error {
+	username, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+	req, err := parseCartRequest(r)
+	if err != nil {
+		return err
+	}
+	dest, err := req.destination(r)
+	if err != nil {
+		return err
+	}
+	totals, err := computeTotals(r, req)
+	if err != nil {
+		return err
+	}
+	order, err := placeOrder(dbFor(r), username, dest, totals)
+	if err != nil {
+		return err
+	}
+	logger.Info(r.Context(), "order placed", Fields{"order": order.Id, "user": username, "total": order.TotalMoney().String()})
+	recordBasket(r, order.Id, totals.Lines)
+	w.WriteHeader(http.StatusCreated)
+	encoder := json.NewEncoder(w)
+	return encoder.Encode(PlacedOrder{OrderId: order.Id, Totals: totals})
+}
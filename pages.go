@@ -0,0 +1,395 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	gmux "github.com/gorilla/mux"
+)
+
+// Content page states. A page is published while one of its revisions is
+// live; saving a draft only adds a revision, so visitors keep seeing the
+// published one while admins look at the draft at the page's address.
+const (
+	PageDraft     = "draft"
+	PagePublished = "published"
+)
+
+var pageStatuses = []string{PageDraft, PagePublished}
+
+var pageSlugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// builtinPagePaths are the slugs whose page is shown by an existing
+// route rather than at /{slug}/: "about" replaces the timeline on the
+// About page and "faq" is the introduction above the FAQs.
+var builtinPagePaths = map[string]string{
+	"about": "/about/",
+	"faq":   "/FAQ/",
+}
+
+// reservedPageSlugs are taken by other routes and cannot name a page.
+// Locale codes cannot either, as they prefix paths.
+var reservedPageSlugs = map[string]bool{
+	"home": true, "login": true, "logout": true, "search": true, "contact": true,
+	"products": true, "category": true, "product": true, "reviews": true,
+	"questions": true, "answers": true, "account": true, "manage": true,
+	"subscribe": true, "unsubscribe": true, "list": true, "shipping": true,
+	"cart": true, "currency": true, "locale": true, "css": true, "img": true, "rjs": true,
+	"metrics": true, "healthz": true, "readyz": true,
+}
+
+// ContentPage is an informational page admins write in Markdown, such as
+// a shipping or privacy policy. Every save is kept as a PageRevision; the
+// page holds the latest one and points at the revision visitors see.
+type ContentPage struct {
+	Id          int64  `db:"Id"`
+	Slug        string `db:"Slug,size:64" form:"slug" label:"Address" validate:"required,max=64"`
+	Title       string `db:"Title,size:150" form:"title" validate:"required,max=150"`
+	Description string `db:"Description" form:"description" validate:"max=255"` // for search engines
+	Body        string `db:"Body,size:65535" form:"body" validate:"max=20000"`  // Markdown
+	Status      string `db:"Status,size:16" form:"status" validate:"required,oneof=draft|published"`
+	Revision    int    `db:"Revision"` // the number of the latest revision
+	// PublishedRevision is the number of the revision visitors see, or 0
+	// while the page is not published.
+	PublishedRevision int        `db:"PublishedRevision"`
+	Published         *time.Time `db:"Published"`
+	Updated           time.Time  `db:"Updated"`
+	UpdatedBy         string     `db:"UpdatedBy"`
+}
+
+// Validate checks the slug can be used as an address.
+func (p *ContentPage) Validate() map[string]string {
+	problems := map[string]string{}
+	if p.Slug != "" && !pageSlugPattern.MatchString(p.Slug) {
+		problems["slug"] = "Address may only contain lowercase letters, digits and single dashes."
+	} else if _, locale := localeFormats[p.Slug]; reservedPageSlugs[p.Slug] || locale {
+		problems["slug"] = "Address /" + p.Slug + "/ is already used by the shop."
+	}
+	return problems
+}
+
+// Path is where visitors find the page.
+func (p ContentPage) Path() string {
+	if path, ok := builtinPagePaths[p.Slug]; ok {
+		return path
+	}
+	return "/" + p.Slug + "/"
+}
+
+// HTML is the page body rendered from Markdown.
+func (p ContentPage) HTML() template.HTML {
+	return renderMarkdown(p.Body)
+}
+
+// PageRevision is a saved version of a content page.
+type PageRevision struct {
+	Id          int64     `db:"Id"`
+	PageId      int64     `db:"PageId"`
+	Number      int       `db:"Number"`
+	Title       string    `db:"Title,size:150"`
+	Description string    `db:"Description"`
+	Body        string    `db:"Body,size:65535"`
+	Status      string    `db:"Status,size:16"`
+	Note        string    `db:"Note"` // e.g. "Restored revision 3"
+	Created     time.Time `db:"Created"`
+	CreatedBy   string    `db:"CreatedBy"`
+}
+
+// Draft reports whether the latest revision is not the published one.
+func (p ContentPage) Draft() bool {
+	return p.Revision != p.PublishedRevision
+}
+
+// withPublishedRevision returns p with the title, description and body of
+// its published revision.
+func withPublishedRevision(db *meteredDbMap, p ContentPage) (ContentPage, error) {
+	if !p.Draft() {
+		return p, nil
+	}
+	var rev PageRevision
+	if err := db.SelectOne(&rev, "SELECT * FROM pagerevisions WHERE PageId=? AND Number=?", p.Id, p.PublishedRevision); err != nil {
+		return p, err
+	}
+	p.Title, p.Description, p.Body = rev.Title, rev.Description, rev.Body
+	return p, nil
+}
+
+// publishedPage returns the published revision of the page with slug, or
+// nil when there is no such published page.
+func publishedPage(db *meteredDbMap, slug string) (*ContentPage, error) {
+	var pages []ContentPage
+	if _, err := db.Select(&pages, "SELECT * FROM pages WHERE Slug=? AND PublishedRevision>0", slug); err != nil {
+		return nil, err
+	}
+	if len(pages) == 0 {
+		return nil, nil
+	}
+	page, err := withPublishedRevision(db, pages[0])
+	if err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+type ContentPageView struct {
+	Page  ContentPage
+	Draft bool
+}
+
+type ContentPageViewPage struct {
+	User    string
+	Meta    PageMeta
+	Content ContentPageView
+}
+
+func renderContentPage(w http.ResponseWriter, r *http.Request, page ContentPage, draft bool) error {
+	meta := PageMeta{Title: page.Title, Description: page.Description, Canonical: absoluteURL(page.Path()), Type: "website"}
+	p := ContentPageViewPage{User: getStringFromSession(r, "User"), Meta: meta, Content: ContentPageView{Page: page, Draft: draft}}
+	return renderer.Render(w, r, "page", p)
+}
+
+// ContentPageHandler serves /{slug}/ for pages admins created. Visitors
+// see the published revision; admins see the latest one, draft or not.
+func ContentPageHandler(w http.ResponseWriter, r *http.Request) error {
+	slug := gmux.Vars(r)["slug"]
+	db := dbFor(r)
+	var pages []ContentPage
+	if _, err := db.Select(&pages, "SELECT * FROM pages WHERE Slug=?", slug); err != nil {
+		return Internal(err, "This page is unavailable right now, please try again later.")
+	}
+	if len(pages) == 0 {
+		return NotFound("The page you are looking for does not exist.")
+	}
+	page := pages[0]
+	admin := page.Draft() && VerifyAdmin(w, r)
+	if page.PublishedRevision == 0 && !admin {
+		return NotFound("The page you are looking for does not exist.")
+	}
+	if page.Path() != r.URL.Path {
+		http.Redirect(w, r, page.Path(), http.StatusMovedPermanently)
+		return nil
+	}
+	if !admin {
+		var err error
+		if page, err = withPublishedRevision(db, page); err != nil {
+			return Internal(err, "This page is unavailable right now, please try again later.")
+		}
+	}
+	return renderContentPage(w, r, page, admin)
+}
+
+// AboutHandler shows the published "about" page, or the timeline until
+// there is one.
+func AboutHandler(w http.ResponseWriter, r *http.Request) error {
+	page, err := publishedPage(dbFor(r), "about")
+	if err != nil {
+		return Internal(err, "This page is unavailable right now, please try again later.")
+	}
+	if page != nil {
+		return renderContentPage(w, r, *page, false)
+	}
+	p := Page{Favourites: []Favourite{}, User: getStringFromSession(r, "User"), Content: ContentReturn{}}
+	return renderer.Render(w, r, "about", p)
+}
+
+type PageAdmin struct {
+	Pages     []ContentPage
+	Statuses  []string
+	Edit      ContentPage
+	Revisions []PageRevision
+	Preview   template.HTML
+	Error     string
+	Fields    map[string]string
+}
+
+type PageAdminPage struct {
+	User    string
+	Content PageAdmin
+}
+
+func renderPageAdmin(w http.ResponseWriter, r *http.Request, status int, edit ContentPage, err error) error {
+	a := PageAdmin{Statuses: pageStatuses, Edit: edit, Preview: edit.HTML()}
+	db := dbFor(r)
+	if _, lerr := db.Select(&a.Pages, "SELECT * FROM pages ORDER BY Title"); lerr != nil {
+		return Internal(lerr, "Pages are unavailable right now.")
+	}
+	if edit.Id != 0 {
+		if _, lerr := db.Select(&a.Revisions, "SELECT * FROM pagerevisions WHERE PageId=? ORDER BY Number DESC", edit.Id); lerr != nil {
+			return Internal(lerr, "Pages are unavailable right now.")
+		}
+	}
+	if err != nil {
+		errs := formErrors(err)
+		a.Error, a.Fields = errs.Error, errs.Fields
+	}
+	return renderer.RenderStatus(w, r, status, "manage_pages", PageAdminPage{User: getStringFromSession(r, "User"), Content: a})
+}
+
+func loadContentPage(r *http.Request) (*ContentPage, error) {
+	id, _ := strconv.ParseInt(gmux.Vars(r)["id"], 10, 64)
+	obj, err := dbFor(r).Get(ContentPage{}, id)
+	if err != nil {
+		return nil, Internal(err, "The page could not be loaded.")
+	}
+	if obj == nil {
+		return nil, NotFound("Page %d does not exist.", id)
+	}
+	return obj.(*ContentPage), nil
+}
+
+// ManagePagesHandler lists the content pages next to a form for adding
+// one or editing the one given by {id}, with its revisions.
+func ManagePagesHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	edit := ContentPage{Status: PageDraft}
+	if gmux.Vars(r)["id"] != "" {
+		p, err := loadContentPage(r)
+		if err != nil {
+			return err
+		}
+		edit = *p
+	}
+	return renderPageAdmin(w, r, http.StatusOK, edit, nil)
+}
+
+// savePageRevision stores p as a new revision and updates the page, or
+// inserts it when it is new. Only a revision saved with status published
+// replaces the one visitors see; a draft leaves it as it was.
+func savePageRevision(r *http.Request, p *ContentPage, status, note string) error {
+	db, now, user := dbFor(r), time.Now(), getStringFromSession(r, "User")
+	p.Revision++
+	p.Updated, p.UpdatedBy = now, user
+	if status == PagePublished {
+		p.PublishedRevision = p.Revision
+		if p.Published == nil {
+			p.Published = &now
+		}
+	}
+	p.Status = PageDraft
+	if p.PublishedRevision > 0 {
+		p.Status = PagePublished
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if p.Id == 0 {
+		err = tx.Insert(p)
+	} else {
+		_, err = tx.Update(p)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Insert(&PageRevision{PageId: p.Id, Number: p.Revision, Title: p.Title, Description: p.Description, Body: p.Body, Status: status, Note: note, Created: now, CreatedBy: user}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// SavePageHandler creates a page, or saves a new revision of it when the
+// route has an {id}. Slugs are unique.
+func SavePageHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	p := &ContentPage{}
+	if gmux.Vars(r)["id"] != "" {
+		var err error
+		if p, err = loadContentPage(r); err != nil {
+			return err
+		}
+	}
+	if err := bind(r, p); err != nil {
+		return renderPageAdmin(w, r, http.StatusBadRequest, *p, err)
+	}
+	count, err := dbFor(r).SelectInt("SELECT count(*) FROM pages WHERE Slug=? AND Id<>?", p.Slug, p.Id)
+	if err != nil {
+		return Internal(err, "The page could not be saved.")
+	}
+	if count > 0 {
+		msg := "Another page already uses that address."
+		return renderPageAdmin(w, r, http.StatusBadRequest, *p, &AppError{Kind: KindValidation, Message: msg, Fields: map[string]string{"slug": msg}})
+	}
+	if err := savePageRevision(r, p, p.Status, ""); err != nil {
+		return Internal(err, "The page could not be saved.")
+	}
+	sitemaps.invalidate()
+	http.Redirect(w, r, "/manage/pages/"+strconv.FormatInt(p.Id, 10)+"/", http.StatusSeeOther)
+	return nil
+}
+
+// RestorePageRevisionHandler rolls page {id} back to revision {rev}. The
+// rollback is saved as a new revision, so it can be undone too.
+func RestorePageRevisionHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	p, err := loadContentPage(r)
+	if err != nil {
+		return err
+	}
+	number, _ := strconv.Atoi(gmux.Vars(r)["rev"])
+	var revs []PageRevision
+	if _, err := dbFor(r).Select(&revs, "SELECT * FROM pagerevisions WHERE PageId=? AND Number=?", p.Id, number); err != nil {
+		return Internal(err, "The revision could not be loaded.")
+	}
+	if len(revs) == 0 {
+		return NotFound("Revision %d of this page does not exist.", number)
+	}
+	rev := revs[0]
+	p.Title, p.Description, p.Body = rev.Title, rev.Description, rev.Body
+	if err := savePageRevision(r, p, rev.Status, "Restored revision "+strconv.Itoa(number)); err != nil {
+		return Internal(err, "The page could not be saved.")
+	}
+	sitemaps.invalidate()
+	http.Redirect(w, r, "/manage/pages/"+strconv.FormatInt(p.Id, 10)+"/", http.StatusSeeOther)
+	return nil
+}
+
+// UnpublishPageHandler takes page {id} offline. Its revisions are kept,
+// and publishing one puts it back.
+func UnpublishPageHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	p, err := loadContentPage(r)
+	if err != nil {
+		return err
+	}
+	p.PublishedRevision, p.Status = 0, PageDraft
+	p.Updated, p.UpdatedBy = time.Now(), getStringFromSession(r, "User")
+	if _, err := dbFor(r).Update(p); err != nil {
+		return Internal(err, "The page could not be saved.")
+	}
+	sitemaps.invalidate()
+	http.Redirect(w, r, "/manage/pages/"+strconv.FormatInt(p.Id, 10)+"/", http.StatusSeeOther)
+	return nil
+}
+
+// DeletePageHandler deletes a page with its revisions.
+func DeletePageHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	p, err := loadContentPage(r)
+	if err != nil {
+		return err
+	}
+	if _, err := dbFor(r).Exec("DELETE FROM pagerevisions WHERE PageId=?", p.Id); err != nil {
+		return Internal(err, "The page could not be deleted.")
+	}
+	if _, err := dbFor(r).Delete(p); err != nil {
+		return Internal(err, "The page could not be deleted.")
+	}
+	sitemaps.invalidate()
+	http.Redirect(w, r, "/manage/pages/", http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	gmux "github.com/gorilla/mux"
+)
+
+// ScheduledPrice is a change to the price of a product that takes effect
+// at Starts: a new regular price, or a sale price until Ends. Changes
+// without a start time take effect as soon as they are saved.
+//
+// A price change goes from pending to done; a sale from pending to running
+// to done. Cancelling either stops it where it is.
+type ScheduledPrice struct {
+	Id        int64      `db:"Id"`
+	ProductId int64      `db:"ProductId"`
+	Kind      string     `db:"Kind,size:8" form:"kind" validate:"required,oneof=price|sale"`
+	Amount    int64      `db:"Amount"`               // minor units of Currency
+	Currency  string     `db:"Currency,size:3"`      // the product's own currency
+	Starts    time.Time  `db:"Starts" form:"starts"` // zero for now
+	Ends      *time.Time `db:"Ends" form:"ends"`     // sales only, nil for no end
+	State     string     `db:"State,size:16"`        // pending, running, done or cancelled
+	Created   time.Time  `db:"Created"`
+	CreatedBy string     `db:"CreatedBy"`
+
+	AmountText string `db:"-" form:"amount" label:"Price" validate:"required"`
+}
+
+// Validate reads the amount and checks the times fit the kind of change.
+func (s *ScheduledPrice) Validate() map[string]string {
+	problems := map[string]string{}
+	m, err := parseMoney(s.AmountText, s.Currency)
+	switch {
+	case err != nil:
+		problems["amount"] = "Price " + err.Error() + "."
+	case m.IsZero():
+		problems["amount"] = "Price must be more than 0."
+	}
+	s.Amount = m.Amount
+	if s.Ends != nil {
+		starts := s.Starts
+		if starts.IsZero() {
+			starts = time.Now()
+		}
+		switch {
+		case s.Kind != "sale":
+			problems["ends"] = "Only sales have an end."
+		case !s.Ends.After(starts):
+			problems["ends"] = "Ends must be after starts."
+		}
+	}
+	return problems
+}
+
+func (s ScheduledPrice) Price() Money {
+	return Money{s.Amount, s.Currency}
+}
+
+// PriceChange is a line of the price history: a product's regular price,
+// its sale price or its price on the list of one currency going from Old
+// to New. Zero means there was or is no such price.
+type PriceChange struct {
+	Id         int64     `db:"Id"`
+	ProductId  int64     `db:"ProductId"`
+	Kind       string    `db:"Kind,size:8"` // price, sale or list
+	Currency   string    `db:"Currency,size:3"`
+	Old        int64     `db:"Old"`
+	New        int64     `db:"New"`
+	ScheduleId int64     `db:"ScheduleId"` // the scheduled change that made it, if any
+	ChangedBy  string    `db:"ChangedBy"`
+	Changed    time.Time `db:"Changed"`
+}
+
+func (c PriceChange) OldPrice() Money {
+	return Money{c.Old, c.Currency}
+}
+
+func (c PriceChange) NewPrice() Money {
+	return Money{c.New, c.Currency}
+}
+
+// applyScheduledPrices starts the changes that are due and ends the sales
+// that are over. It runs at start up and as a job.
+func applyScheduledPrices(ctx context.Context) error {
+	return applyDuePrices(dbmap.WithContext(ctx), time.Now())
+}
+
+func applyDuePrices(db *meteredDbMap, now time.Time) error {
+	var due []ScheduledPrice
+	if _, err := db.Select(&due, "SELECT * FROM scheduledprices WHERE (State='pending' AND Starts<=?) OR (State='running' AND Ends<=?) ORDER BY Starts, Id", now, now); err != nil {
+		return err
+	}
+	for _, s := range due {
+		var err error
+		if s.State == "pending" {
+			err = startScheduledPrice(db, s, now)
+		} else {
+			err = endSale(db, s, "done", s.CreatedBy, now)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimScheduledPrice moves s on to state, unless another instance or
+// admin got there first.
+func claimScheduledPrice(db *meteredDbMap, s ScheduledPrice, state string) (bool, error) {
+	res, err := db.Exec("UPDATE scheduledprices SET State=? WHERE Id=? AND State=?", state, s.Id, s.State)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// startScheduledPrice changes the product as s says. A sale replaces any
+// sale of the product that is still running, and one that ended while it
+// was waiting does nothing. The claim, the product and the history change
+// together, so a failure leaves s pending for the next run of the job.
+func startScheduledPrice(db *meteredDbMap, s ScheduledPrice, now time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := applyScheduledPrice(tx.meteredDbMap, s, now); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func applyScheduledPrice(db *meteredDbMap, s ScheduledPrice, now time.Time) error {
+	state := "done"
+	if s.Kind == "sale" && (s.Ends == nil || now.Before(*s.Ends)) {
+		state = "running"
+	}
+	if ok, err := claimScheduledPrice(db, s, state); err != nil || !ok {
+		return err
+	}
+	if s.Kind == "sale" && state == "done" {
+		return nil
+	}
+	obj, err := db.Get(Product{}, s.ProductId)
+	if err != nil || obj == nil {
+		return err
+	}
+	p := obj.(*Product)
+	change := PriceChange{ProductId: p.Id, Kind: s.Kind, Currency: p.PriceCurrency, ScheduleId: s.Id, ChangedBy: s.CreatedBy, Changed: now}
+	if s.Kind == "price" {
+		change.Old, change.New = p.PriceAmount, s.Amount
+		_, err = db.Exec("UPDATE products SET PriceAmount=?, Updated=? WHERE Id=?", s.Amount, now, p.Id)
+	} else {
+		change.Old, change.New = p.SaleAmount, s.Amount
+		if _, err = db.Exec("UPDATE scheduledprices SET State='done' WHERE ProductId=? AND Kind='sale' AND State='running' AND Id<>?", p.Id, s.Id); err == nil {
+			_, err = db.Exec("UPDATE products SET SaleAmount=?, SaleEnds=?, Updated=? WHERE Id=?", s.Amount, s.Ends, now, p.Id)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return db.Insert(&change)
+}
+
+// endSale takes the product of the running sale s off sale, leaving s in
+// state, in one transaction like startScheduledPrice.
+func endSale(db *meteredDbMap, s ScheduledPrice, state, actor string, now time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := takeOffSale(tx.meteredDbMap, s, state, actor, now); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func takeOffSale(db *meteredDbMap, s ScheduledPrice, state, actor string, now time.Time) error {
+	if ok, err := claimScheduledPrice(db, s, state); err != nil || !ok {
+		return err
+	}
+	obj, err := db.Get(Product{}, s.ProductId)
+	if err != nil || obj == nil {
+		return err
+	}
+	p := obj.(*Product)
+	if _, err := db.Exec("UPDATE products SET SaleAmount=0, SaleEnds=NULL, Updated=? WHERE Id=?", now, p.Id); err != nil {
+		return err
+	}
+	return db.Insert(&PriceChange{ProductId: p.Id, Kind: "sale", Currency: p.PriceCurrency, Old: p.SaleAmount, ScheduleId: s.Id, ChangedBy: actor, Changed: now})
+}
+
+// ProductPriceRow is a product on the admin product list.
+type ProductPriceRow struct {
+	Product   Product
+	Scheduled int64 // pending changes
+}
+
+type ProductPriceList struct {
+	Products []ProductPriceRow
+}
+
+type ProductPriceListPage struct {
+	User    string
+	Content ProductPriceList
+}
+
+// ManageProductsHandler lists every product with its price and how many
+// changes are scheduled for it.
+func ManageProductsHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	var products []Product
+	if _, err := dbFor(r).Select(&products, "SELECT * FROM products ORDER BY Name"); err != nil {
+		return Internal(err, "Products are unavailable right now.")
+	}
+	var pending []ScheduledPrice
+	if _, err := dbFor(r).Select(&pending, "SELECT * FROM scheduledprices WHERE State='pending'"); err != nil {
+		return Internal(err, "Products are unavailable right now.")
+	}
+	counts := map[int64]int64{}
+	for _, s := range pending {
+		counts[s.ProductId]++
+	}
+	var l ProductPriceList
+	for _, p := range products {
+		l.Products = append(l.Products, ProductPriceRow{Product: p, Scheduled: counts[p.Id]})
+	}
+	return renderer.Render(w, r, "manage_products", ProductPriceListPage{User: getStringFromSession(r, "User"), Content: l})
+}
+
+// ProductPrices is the price admin of one product: its schedule, newest
+// first, and its price history.
+type ProductPrices struct {
+	Product  Product
+	Schedule []ScheduledPrice
+	History  []PriceChange
+	Edit     ScheduledPrice
+	Error    string
+	Fields   map[string]string
+}
+
+type ProductPricesPage struct {
+	User    string
+	Content ProductPrices
+}
+
+// priceHistoryLength is how many changes the product price page shows.
+const priceHistoryLength = 50
+
+func renderProductPrices(w http.ResponseWriter, r *http.Request, status int, p *Product, edit ScheduledPrice, err error) error {
+	a := ProductPrices{Product: *p, Edit: edit}
+	if _, lerr := dbFor(r).Select(&a.Schedule, "SELECT * FROM scheduledprices WHERE ProductId=? AND State IN ('pending', 'running') ORDER BY Starts DESC, Id DESC", p.Id); lerr != nil {
+		return Internal(lerr, "Prices are unavailable right now.")
+	}
+	if _, lerr := dbFor(r).Select(&a.History, "SELECT * FROM pricehistory WHERE ProductId=? ORDER BY Changed DESC, Id DESC LIMIT ?", p.Id, priceHistoryLength); lerr != nil {
+		return Internal(lerr, "Prices are unavailable right now.")
+	}
+	if err != nil {
+		errs := formErrors(err)
+		a.Error, a.Fields = errs.Error, errs.Fields
+	}
+	return renderer.RenderStatus(w, r, status, "manage_product_prices", ProductPricesPage{User: getStringFromSession(r, "User"), Content: a})
+}
+
+func loadProduct(r *http.Request) (*Product, error) {
+	id, _ := strconv.ParseInt(gmux.Vars(r)["id"], 10, 64)
+	obj, err := dbFor(r).Get(Product{}, id)
+	if err != nil {
+		return nil, Internal(err, "The product could not be loaded.")
+	}
+	if obj == nil {
+		return nil, NotFound("Product %d does not exist.", id)
+	}
+	return obj.(*Product), nil
+}
+
+// ProductPricesHandler shows the price, schedule and history of {id} next
+// to a form for scheduling a change.
+func ProductPricesHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	p, err := loadProduct(r)
+	if err != nil {
+		return err
+	}
+	return renderProductPrices(w, r, http.StatusOK, p, ScheduledPrice{Kind: "price"}, nil)
+}
+
+// SaveScheduledPriceHandler schedules a price change or sale for {id}, and
+// applies it straight away when it has no start time or one in the past.
+func SaveScheduledPriceHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	p, err := loadProduct(r)
+	if err != nil {
+		return err
+	}
+	s := &ScheduledPrice{ProductId: p.Id, Currency: p.PriceCurrency}
+	if err := bind(r, s); err != nil {
+		return renderProductPrices(w, r, http.StatusBadRequest, p, *s, err)
+	}
+	if s.Kind == "sale" && s.Amount >= p.PriceAmount {
+		msg := "A sale price must be below the regular price of " + p.RegularPrice().String() + "."
+		return renderProductPrices(w, r, http.StatusBadRequest, p, *s, &AppError{Kind: KindValidation, Message: msg, Fields: map[string]string{"amount": msg}})
+	}
+	now := time.Now()
+	if s.Starts.IsZero() {
+		s.Starts = now
+	}
+	s.State, s.Created, s.CreatedBy = "pending", now, getStringFromSession(r, "User")
+	if err := dbFor(r).Insert(s); err != nil {
+		return Internal(err, "The price change could not be saved.")
+	}
+	if err := applyDuePrices(dbFor(r), now); err != nil {
+		// It stays pending, so the price-schedule job applies it later.
+		return Internal(err, "The price change was saved but could not be applied yet; it will be applied within a few minutes.")
+	}
+	http.Redirect(w, r, "/manage/products/"+strconv.FormatInt(p.Id, 10)+"/prices/", http.StatusSeeOther)
+	return nil
+}
+
+// CancelScheduledPriceHandler drops a pending change, or ends a running
+// sale now.
+func CancelScheduledPriceHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	p, err := loadProduct(r)
+	if err != nil {
+		return err
+	}
+	id, _ := strconv.ParseInt(gmux.Vars(r)["change"], 10, 64)
+	obj, err := dbFor(r).Get(ScheduledPrice{}, id)
+	if err != nil {
+		return Internal(err, "The price change could not be loaded.")
+	}
+	if obj == nil || obj.(*ScheduledPrice).ProductId != p.Id {
+		return NotFound("Price change %d does not exist.", id)
+	}
+	s := *obj.(*ScheduledPrice)
+	switch s.State {
+	case "pending":
+		_, err = claimScheduledPrice(dbFor(r), s, "cancelled")
+	case "running":
+		err = endSale(dbFor(r), s, "cancelled", getStringFromSession(r, "User"), time.Now())
+	default:
+		return Conflict("Price change %d is %s and can no longer be cancelled.", id, s.State)
+	}
+	if err != nil {
+		return Internal(err, "The price change could not be cancelled.")
+	}
+	http.Redirect(w, r, "/manage/products/"+strconv.FormatInt(p.Id, 10)+"/prices/", http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	gmux "github.com/gorilla/mux"
+)
+
+const productsPerPage = 24
+
+var slugInvalid = regexp.MustCompile(`[^a-z0-9]+`)
+
+// slugify turns a product or category name into the readable part of its
+// URL, e.g. "39 Pcs Tool Set" becomes "39-pcs-tool-set".
+func slugify(name string) string {
+	return strings.Trim(slugInvalid.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+// productPath is the canonical address of p. Names without a letter or
+// digit to slugify leave just the id.
+func productPath(p Product) string {
+	if slug := slugify(p.Name); slug != "" {
+		return fmt.Sprintf("/product/%d-%s/", p.Id, slug)
+	}
+	return fmt.Sprintf("/product/%d/", p.Id)
+}
+
+func categoryPath(category string) string {
+	return "/category/" + slugify(category) + "/"
+}
+
+// absoluteURL prefixes a site path with the configured base URL.
+func absoluteURL(path string) string {
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return path
+	}
+	return config.BaseURL + path
+}
+
+// PageMeta feeds the <head> of pages that are meant to be indexed.
+type PageMeta struct {
+	Title       string
+	Description string
+	Canonical   string
+	Image       string
+	Type        string // Open Graph type
+	Prev        string
+	Next        string
+	JSONLD      interface{}
+}
+
+type CategoryLink struct {
+	Name string
+	URL  string
+}
+
+type ProductLink struct {
+	Product Product
+	Price   Money  // in the visitor's currency
+	Was     *Money // the regular price during a sale
+	URL     string
+}
+
+type ProductDetail struct {
+	Product         Product
+	Price           Money
+	Was             *Money
+	Category        CategoryLink
+	Currency        CurrencyChoice
+	Reviews         ProductReviews
+	Questions       ProductQuestions
+	Recommendations ProductRecommendations
+	Wishlisted      bool // by the logged-in customer
+}
+
+// ProductJSON is what the product endpoint returns: the priced product
+// with its answered questions.
+type ProductJSON struct {
+	PricedProduct
+	Questions []AnsweredQuestion `json:",omitempty"`
+}
+
+type ProductDetailPage struct {
+	User    string
+	Meta    PageMeta
+	Content ProductDetail
+}
+
+type ProductListing struct {
+	Heading    string
+	Products   []ProductLink
+	Categories []CategoryLink
+	Page       int
+	Pages      int
+	PrevURL    string
+	NextURL    string
+	Currency   CurrencyChoice
+}
+
+type ProductListPage struct {
+	User    string
+	Meta    PageMeta
+	Content ProductListing
+}
+
+// productJSONLD is the schema.org Product description search engines use
+// for rich results.
+func productJSONLD(p Product, price Money) map[string]interface{} {
+	url := absoluteURL(productPath(p))
+	offer := map[string]interface{}{
+		"@type":         "Offer",
+		"url":           url,
+		"price":         price.Decimal(),
+		"priceCurrency": price.Currency,
+		"availability":  "https://schema.org/InStock",
+	}
+	if p.OnSale() && p.SaleEnds != nil {
+		offer["priceValidUntil"] = p.SaleEnds.Format("2006-01-02")
+	}
+	ld := map[string]interface{}{
+		"@context": "https://schema.org",
+		"@type":    "Product",
+		"sku":      strconv.FormatInt(p.Id, 10),
+		"name":     p.Name,
+		"image":    absoluteURL(p.Image),
+		"url":      url,
+		"category": p.Category,
+		"brand": map[string]interface{}{
+			"@type": "Brand",
+			"name":  p.Brand,
+		},
+		"offers": offer,
+	}
+	if p.RatingCount > 0 {
+		ld["aggregateRating"] = map[string]interface{}{
+			"@type":       "AggregateRating",
+			"ratingValue": strconv.FormatFloat(p.RatingAverage, 'f', 1, 64),
+			"reviewCount": p.RatingCount,
+		}
+	}
+	return ld
+}
+
+func productDescription(r *http.Request, p Product, price Money) string {
+	locale := localeFor(r)
+	name := productName(locale, p)
+	if price.IsZero() {
+		return T(r, "%s by %s at WildView.", name, p.Brand)
+	}
+	return T(r, "%s by %s for %s at WildView.", name, p.Brand, formatMoney(locale, price))
+}
+
+// ProductPageHandler renders a product detail page. Requests with an
+// outdated or missing slug are redirected to the canonical URL.
+func ProductPageHandler(w http.ResponseWriter, r *http.Request) error {
+	vars := gmux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		return NotFound("The product you are looking for does not exist.")
+	}
+	obj, err := dbFor(r).Get(Product{}, id)
+	if err != nil {
+		return Internal(err, "Product details are unavailable right now, please try again later.")
+	}
+	if obj == nil {
+		return NotFound("The product you are looking for does not exist.")
+	}
+	prod := *obj.(*Product)
+	if canonical := productPath(prod); r.URL.Path != canonical {
+		http.Redirect(w, r, canonical, http.StatusMovedPermanently)
+		return nil
+	}
+	recordView(r, prod.Id)
+	return renderProductPage(w, r, http.StatusOK, prod, productForms{Review: Review{Rating: 5}})
+}
+
+// productForms are the forms on a product page. A rejected post is shown
+// again with what was wrong with it.
+type productForms struct {
+	Review      Review
+	ReviewErr   error
+	Question    Question
+	QuestionErr error
+	Answer      Answer
+	AnswerErr   error
+}
+
+// renderProductPage renders the detail page of prod.
+func renderProductPage(w http.ResponseWriter, r *http.Request, status int, prod Product, forms productForms) error {
+	pr, err := pricerFor(r)
+	if err != nil {
+		return err
+	}
+	price := pr.Price(prod)
+	reviews, err := productReviews(r, prod, forms.Review, forms.ReviewErr)
+	if err != nil {
+		return Internal(err, "Product details are unavailable right now, please try again later.")
+	}
+	questions, err := productQuestions(w, r, prod, forms)
+	if err != nil {
+		return Internal(err, "Product details are unavailable right now, please try again later.")
+	}
+	recs, err := productRecommendations(r, pr, prod)
+	if err != nil {
+		return Internal(err, "Product details are unavailable right now, please try again later.")
+	}
+	wishlisted := false
+	if username := getStringFromSession(r, "User"); username != "" {
+		if wishlisted, err = onWishlist(dbFor(r), username, prod.Id); err != nil {
+			return Internal(err, "Product details are unavailable right now, please try again later.")
+		}
+	}
+
+	// The page shows the translated name; the URL keeps the original one.
+	ld := productJSONLD(prod, price)
+	ld["name"] = productName(localeFor(r), prod)
+	p := ProductDetailPage{
+		User: getStringFromSession(r, "User"),
+		Meta: PageMeta{
+			Title:       productName(localeFor(r), prod),
+			Description: productDescription(r, prod, price),
+			Canonical:   absoluteURL(productPath(prod)),
+			Image:       absoluteURL(prod.Image),
+			Type:        "product",
+			JSONLD:      ld,
+		},
+		Content: ProductDetail{Product: prod, Price: price, Was: pr.Was(prod), Currency: currencyChoice(r), Reviews: reviews, Questions: questions, Recommendations: recs, Wishlisted: wishlisted},
+	}
+	if prod.Category != "" {
+		p.Content.Category = CategoryLink{Name: prod.Category, URL: categoryPath(prod.Category)}
+	}
+	return renderer.RenderStatus(w, r, status, "product", p)
+}
+
+// loadCategories returns every category that has at least one product.
+func loadCategories(r *http.Request) ([]CategoryLink, error) {
+	var names []string
+	if _, err := dbFor(r).Select(&names, "SELECT DISTINCT Category FROM products WHERE Category <> '' ORDER BY Category"); err != nil {
+		return nil, err
+	}
+	links := []CategoryLink{}
+	for _, name := range names {
+		links = append(links, CategoryLink{Name: name, URL: categoryPath(name)})
+	}
+	return links, nil
+}
+
+// ProductListHandler renders /products/ and /category/{category}/, paged
+// with ?page=N.
+func ProductListHandler(w http.ResponseWriter, r *http.Request) error {
+	categories, err := loadCategories(r)
+	if err != nil {
+		return Internal(err, "Products are unavailable right now, please try again later.")
+	}
+
+	listing := ProductListing{Heading: T(r, "All products"), Categories: categories, Page: 1, Currency: currencyChoice(r)}
+	basePath := "/products/"
+	where, args := "", []interface{}{}
+	if slug, ok := gmux.Vars(r)["category"]; ok {
+		found := false
+		for _, c := range categories {
+			if slugify(c.Name) == slug {
+				listing.Heading, basePath, found = c.Name, c.URL, true
+				where, args = " WHERE Category = ?", append(args, c.Name)
+			}
+		}
+		if !found {
+			return NotFound("The category you are looking for does not exist.")
+		}
+	}
+
+	if page, err := strconv.Atoi(r.FormValue("page")); err == nil && page > 1 {
+		listing.Page = page
+	}
+	total, err := dbFor(r).SelectInt("SELECT count(*) FROM products"+where, args...)
+	if err != nil {
+		return Internal(err, "Products are unavailable right now, please try again later.")
+	}
+	listing.Pages = int((total + productsPerPage - 1) / productsPerPage)
+	if listing.Pages == 0 {
+		listing.Pages = 1
+	}
+	if listing.Page > listing.Pages {
+		return NotFound("There are only %d pages of products.", listing.Pages)
+	}
+
+	var prods []Product
+	query := "SELECT * FROM products" + where + " ORDER BY Name LIMIT ? OFFSET ?"
+	if _, err := dbFor(r).Select(&prods, query, append(args, productsPerPage, (listing.Page-1)*productsPerPage)...); err != nil {
+		return Internal(err, "Products are unavailable right now, please try again later.")
+	}
+	pr, err := pricerFor(r)
+	if err != nil {
+		return err
+	}
+	for _, prod := range prods {
+		listing.Products = append(listing.Products, ProductLink{Product: prod, Price: pr.Price(prod), Was: pr.Was(prod), URL: productPath(prod)})
+	}
+
+	pageURL := func(page int) string {
+		if page == 1 {
+			return basePath
+		}
+		return basePath + "?page=" + strconv.Itoa(page)
+	}
+	meta := PageMeta{
+		Title:       listing.Heading,
+		Description: T(r, "%s at WildView.", listing.Heading),
+		Canonical:   absoluteURL(pageURL(listing.Page)),
+		Type:        "website",
+	}
+	if listing.Page > 1 {
+		listing.PrevURL = pageURL(listing.Page - 1)
+		meta.Prev = absoluteURL(listing.PrevURL)
+	}
+	if listing.Page < listing.Pages {
+		listing.NextURL = pageURL(listing.Page + 1)
+		meta.Next = absoluteURL(listing.NextURL)
+	}
+	if len(prods) > 0 {
+		meta.Image = absoluteURL(prods[0].Image)
+	}
+
+	p := ProductListPage{User: getStringFromSession(r, "User"), Meta: meta, Content: listing}
+	return renderer.Render(w, r, "products", p)
+}
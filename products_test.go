@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestSlugify(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"39 Pcs Tool Set", "39-pcs-tool-set"},
+		{"  Drill -- Driver ", "drill-driver"},
+		{"Hammer (16 oz.)", "hammer-16-oz"},
+		{"!!!", ""},
+	}
+	for _, tt := range tests {
+		if got := slugify(tt.name); got != tt.want {
+			t.Errorf("slugify(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProductPath(t *testing.T) {
+	tests := []struct {
+		p    Product
+		want string
+	}{
+		{Product{Id: 12, Name: "39 Pcs Tool Set"}, "/product/12-39-pcs-tool-set/"},
+		{Product{Id: 12, Name: "!!!"}, "/product/12/"},
+		{Product{Id: 12}, "/product/12/"},
+	}
+	for _, tt := range tests {
+		if got := productPath(tt.p); got != tt.want {
+			t.Errorf("productPath(%q) = %q, want %q", tt.p.Name, got, tt.want)
+		}
+	}
+}
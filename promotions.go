@@ -0,0 +1,560 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	gmux "github.com/gorilla/mux"
+)
+
+// Promotion kinds. Any of them can be a coupon, applied when its code is
+// entered, or automatic when it has no code.
+const (
+	PromoPercent      = "percent"       // Percent off the goods
+	PromoFixed        = "fixed"         // Amount off the goods
+	PromoFreeShipping = "free_shipping" // no shipping charge
+	PromoBuyXGetY     = "buy_x_get_y"   // of every Buy+Get of a product, Get are Percent off
+	PromoCategory     = "category"      // Percent off the goods in Category
+	PromoThreshold    = "threshold"     // Amount or Percent off once the goods reach MinSubtotal
+)
+
+var promotionKinds = []string{PromoPercent, PromoFixed, PromoFreeShipping, PromoBuyXGetY, PromoCategory, PromoThreshold}
+
+var couponCodePattern = regexp.MustCompile(`^[A-Z0-9-]+$`)
+
+// Promotion is a discount rule. Amounts are minor units of the base
+// currency and are converted to the currency of the cart.
+type Promotion struct {
+	Id           int64      `db:"Id"`
+	Name         string     `db:"Name" form:"name" validate:"required,max=100"` // shown to customers
+	Code         string     `db:"Code,size:32" form:"code" validate:"max=32"`   // empty for automatic promotions
+	Kind         string     `db:"Kind,size:16" form:"kind" validate:"required,oneof=percent|fixed|free_shipping|buy_x_get_y|category|threshold"`
+	Percent      float64    `db:"Percent" form:"percent" validate:"max=100"`
+	Amount       int64      `db:"Amount"`
+	Category     string     `db:"Category" form:"category" validate:"max=255"` // limits buy_x_get_y and category promotions
+	Buy          int        `db:"Buy" form:"buy" validate:"max=99"`
+	Get          int        `db:"Get" form:"get" validate:"max=99"`
+	MinSubtotal  int64      `db:"MinSubtotal"`                                       // goods needed before the promotion applies
+	Stackable    bool       `db:"Stackable" form:"stackable"`                        // combines with other stackable promotions
+	UsageLimit   int        `db:"UsageLimit" form:"usage_limit" label:"Usage limit"` // 0 for unlimited
+	PerUserLimit int        `db:"PerUserLimit" form:"per_user_limit" label:"Uses per customer"`
+	Starts       time.Time  `db:"Starts" form:"starts" validate:"required"`
+	Ends         *time.Time `db:"Ends" form:"ends"` // nil for open ended
+	Active       bool       `db:"Active" form:"active"`
+	Created      time.Time  `db:"Created"`
+	Updated      time.Time  `db:"Updated"`
+
+	// The money fields as typed in the admin form.
+	AmountText      string `db:"-" form:"amount" label:"Amount"`
+	MinSubtotalText string `db:"-" form:"min_subtotal" label:"Minimum spend"`
+}
+
+// fillText copies the money fields into the form fields.
+func (p *Promotion) fillText() {
+	p.AmountText, p.MinSubtotalText = "", ""
+	if p.Amount != 0 {
+		p.AmountText = baseMoney(p.Amount).Decimal()
+	}
+	if p.MinSubtotal != 0 {
+		p.MinSubtotalText = baseMoney(p.MinSubtotal).Decimal()
+	}
+}
+
+// Validate checks the fields each kind needs and reads the money fields.
+func (p *Promotion) Validate() map[string]string {
+	problems := map[string]string{}
+	p.Code = strings.ToUpper(p.Code)
+	if p.Code != "" && !couponCodePattern.MatchString(p.Code) {
+		problems["code"] = "Code may only contain letters, digits and dashes."
+	}
+	for _, f := range []struct {
+		name, label, text string
+		dst               *int64
+	}{{"amount", "Amount", p.AmountText, &p.Amount}, {"min_subtotal", "Minimum spend", p.MinSubtotalText, &p.MinSubtotal}} {
+		*f.dst = 0
+		if f.text == "" {
+			continue
+		}
+		m, err := parseMoney(f.text, config.Currency)
+		if err != nil {
+			problems[f.name] = f.label + " " + err.Error() + "."
+			continue
+		}
+		*f.dst = m.Amount
+	}
+	needPercent := func() {
+		if p.Percent <= 0 {
+			problems["percent"] = "Percent must be more than 0."
+		}
+	}
+	switch p.Kind {
+	case PromoPercent:
+		needPercent()
+	case PromoFixed:
+		if p.Amount <= 0 && problems["amount"] == "" {
+			problems["amount"] = "Amount is required."
+		}
+	case PromoCategory:
+		needPercent()
+		if p.Category == "" {
+			problems["category"] = "Category is required."
+		}
+	case PromoBuyXGetY:
+		needPercent()
+		if p.Buy < 1 || p.Get < 1 {
+			problems["buy"] = "Buy and get must both be at least 1."
+		}
+	case PromoThreshold:
+		if p.MinSubtotal <= 0 && problems["min_subtotal"] == "" {
+			problems["min_subtotal"] = "Minimum spend is required."
+		}
+		if (p.Amount > 0) == (p.Percent > 0) {
+			problems["amount"] = "Give either an amount or a percent off."
+		}
+	}
+	if p.UsageLimit < 0 || p.PerUserLimit < 0 {
+		problems["usage_limit"] = "Limits cannot be negative."
+	}
+	if p.Ends != nil && !p.Ends.After(p.Starts) {
+		problems["ends"] = "Ends must be after starts."
+	}
+	return problems
+}
+
+// Summary describes the offer for the admin list, e.g. "10% off over $50.00".
+func (p Promotion) Summary() string {
+	var s string
+	switch p.Kind {
+	case PromoFreeShipping:
+		s = "Free shipping"
+	case PromoBuyXGetY:
+		s = "Buy " + strconv.Itoa(p.Buy) + ", get " + strconv.Itoa(p.Get) + " " + strconv.FormatFloat(p.Percent, 'f', -1, 64) + "% off"
+	default:
+		if p.Amount > 0 {
+			s = baseMoney(p.Amount).String() + " off"
+		} else {
+			s = strconv.FormatFloat(p.Percent, 'f', -1, 64) + "% off"
+		}
+	}
+	if p.Category != "" && (p.Kind == PromoCategory || p.Kind == PromoBuyXGetY) {
+		s += " " + p.Category
+	}
+	if p.MinSubtotal > 0 {
+		s += " over " + baseMoney(p.MinSubtotal).String()
+	}
+	return s
+}
+
+// Discount is what one promotion takes off an order.
+type Discount struct {
+	PromotionId  int64
+	Name         string
+	Code         string
+	Lines        []Money `json:"-"` // off each cart item, in cart order
+	Amount       Money   // off the goods, the sum of Lines
+	FreeShipping bool
+}
+
+// discount works out what p takes off items. ok is false when the cart
+// does not qualify, with the reason for customers who entered a code.
+func (p Promotion) discount(items []CartItem, subtotal Money) (d Discount, ok bool, reason string) {
+	currency := subtotal.Currency
+	d = Discount{PromotionId: p.Id, Name: p.Name, Code: p.Code, Amount: Money{Currency: currency}}
+	d.Lines = make([]Money, len(items))
+	for i := range d.Lines {
+		d.Lines[i] = Money{Currency: currency}
+	}
+	if p.MinSubtotal > 0 {
+		min, converted := convert(baseMoney(p.MinSubtotal), currency)
+		if !converted {
+			return d, false, "This promotion is not available in " + currency + "."
+		}
+		if subtotal.Amount < min.Amount {
+			return d, false, "Spend at least " + min.String() + " to use this code."
+		}
+	}
+	inCategory := func(item CartItem) bool {
+		return p.Category == "" || strings.EqualFold(item.Product.Category, p.Category)
+	}
+	switch p.Kind {
+	case PromoPercent:
+		for i, item := range items {
+			d.Lines[i] = item.Price.Mul(item.Quantity).Percent(p.Percent)
+		}
+	case PromoCategory:
+		for i, item := range items {
+			if inCategory(item) {
+				d.Lines[i] = item.Price.Mul(item.Quantity).Percent(p.Percent)
+			}
+		}
+	case PromoBuyXGetY:
+		for i, item := range items {
+			if inCategory(item) {
+				free := item.Quantity / (p.Buy + p.Get) * p.Get
+				d.Lines[i] = item.Price.Mul(free).Percent(p.Percent)
+			}
+		}
+	case PromoThreshold:
+		if p.Percent > 0 {
+			for i, item := range items {
+				d.Lines[i] = item.Price.Mul(item.Quantity).Percent(p.Percent)
+			}
+			break
+		}
+		fallthrough
+	case PromoFixed:
+		off, converted := convert(baseMoney(p.Amount), currency)
+		if !converted {
+			return d, false, "This promotion is not available in " + currency + "."
+		}
+		d.Lines = spread(off, items, subtotal)
+	case PromoFreeShipping:
+		d.FreeShipping = true
+	}
+	for _, m := range d.Lines {
+		d.Amount = d.Amount.Add(m)
+	}
+	if d.Amount.IsZero() && !d.FreeShipping {
+		return d, false, "Nothing in your cart qualifies for this code."
+	}
+	return d, true, ""
+}
+
+// spread shares amount between items in proportion to their totals, so
+// tax is worked out on what each line really costs. It never takes more
+// than the subtotal.
+func spread(amount Money, items []CartItem, subtotal Money) []Money {
+	if amount.Amount > subtotal.Amount {
+		amount = subtotal
+	}
+	lines := make([]Money, len(items))
+	left := amount
+	for i, item := range items {
+		share := Money{Currency: amount.Currency}
+		if subtotal.Amount > 0 {
+			share.Amount = amount.Amount * item.Price.Mul(item.Quantity).Amount / subtotal.Amount
+		}
+		if i == len(items)-1 {
+			share = left
+		}
+		lines[i], left = share, left.Sub(share)
+	}
+	return lines
+}
+
+// PromotionUse is one redemption of a promotion, recorded when an order is
+// placed so usage limits can be enforced.
+type PromotionUse struct {
+	Id          int64     `db:"Id"`
+	PromotionId int64     `db:"PromotionId"`
+	Username    string    `db:"Username"` // empty for guests
+	OrderRef    string    `db:"OrderRef,size:64"`
+	Created     time.Time `db:"Created"`
+}
+
+// recordPromotionUses counts the discounts of an order against their
+// limits. placeOrder calls it in the transaction that stores the order.
+func recordPromotionUses(db inserter, discounts []Discount, username, orderRef string) error {
+	for _, d := range discounts {
+		use := PromotionUse{PromotionId: d.PromotionId, Username: username, OrderRef: orderRef, Created: time.Now()}
+		if err := db.Insert(&use); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// usable checks the validity window and usage limits of p for username.
+func (p Promotion) usable(db *meteredDbMap, username string, now time.Time) (bool, string, error) {
+	if !p.Active || now.Before(p.Starts) {
+		return false, "This code is not valid yet.", nil
+	}
+	if p.Ends != nil && !now.Before(*p.Ends) {
+		return false, "This code has expired.", nil
+	}
+	var used, usedByUser int64
+	var err error
+	if p.UsageLimit > 0 {
+		if used, err = db.SelectInt("SELECT count(*) FROM promotionuses WHERE PromotionId=?", p.Id); err != nil {
+			return false, "", err
+		}
+	}
+	if p.PerUserLimit > 0 && username != "" {
+		if usedByUser, err = db.SelectInt("SELECT count(*) FROM promotionuses WHERE PromotionId=? AND Username=?", p.Id, username); err != nil {
+			return false, "", err
+		}
+	}
+	ok, reason := p.withinLimits(used, usedByUser, username)
+	return ok, reason, nil
+}
+
+// withinLimits checks the usage limits of p given how often it was used
+// in all and by username.
+func (p Promotion) withinLimits(used, usedByUser int64, username string) (bool, string) {
+	if p.UsageLimit > 0 && used >= int64(p.UsageLimit) {
+		return false, "This code has been used up."
+	}
+	if p.PerUserLimit > 0 {
+		if username == "" {
+			return false, "Please log in to use this code."
+		}
+		if usedByUser >= int64(p.PerUserLimit) {
+			return false, "You have already used this code."
+		}
+	}
+	return true, ""
+}
+
+// applyPromotions picks the discounts for a cart: every automatic
+// promotion it qualifies for plus the coupon with code, if any.
+//
+// Stacking: stackable promotions combine; one that is not stackable only
+// applies alone. An entered coupon always applies, so with a stackable
+// coupon the stackable promotions are used, and with one that is not the
+// coupon alone. Without a coupon the combination worth the most wins,
+// counting free shipping as the shipping charge it saves.
+func applyPromotions(r *http.Request, items []CartItem, subtotal, shipping Money, code string) ([]Discount, error) {
+	db, username, now := dbFor(r), getStringFromSession(r, "User"), time.Now()
+	var promos []Promotion
+	if _, err := db.Select(&promos, "SELECT * FROM promotions WHERE Active=1 AND (Code='' OR Code=?)", strings.ToUpper(strings.TrimSpace(code))); err != nil {
+		return nil, Internal(err, "Promotions are unavailable right now.")
+	}
+	blocked := map[int64]string{}
+	for _, p := range promos {
+		ok, reason, err := p.usable(db, username, now)
+		if err != nil {
+			return nil, Internal(err, "Promotions are unavailable right now.")
+		}
+		if !ok {
+			blocked[p.Id] = reason
+		}
+	}
+	return choosePromotions(promos, blocked, items, subtotal, shipping, code)
+}
+
+// choosePromotions applies the stacking rules of applyPromotions to
+// promos, leaving out the blocked ones, which cannot be used for the
+// reason given.
+func choosePromotions(promos []Promotion, blocked map[int64]string, items []CartItem, subtotal, shipping Money, code string) ([]Discount, error) {
+	var coupon *Discount
+	var couponStacks bool
+	var stackable, alone []Discount
+	for _, p := range promos {
+		isCoupon := p.Code != ""
+		reason, isBlocked := blocked[p.Id]
+		ok := !isBlocked
+		var d Discount
+		if ok {
+			d, ok, reason = p.discount(items, subtotal)
+		}
+		if !ok {
+			if isCoupon {
+				return nil, &AppError{Kind: KindValidation, Message: reason, Fields: map[string]string{"coupon": reason}}
+			}
+			continue
+		}
+		switch {
+		case isCoupon:
+			coupon, couponStacks = &d, p.Stackable
+			if p.Stackable {
+				stackable = append(stackable, d)
+			}
+		case p.Stackable:
+			stackable = append(stackable, d)
+		default:
+			alone = append(alone, d)
+		}
+	}
+	if strings.TrimSpace(code) != "" && coupon == nil {
+		msg := "There is no promotion with that code."
+		return nil, &AppError{Kind: KindValidation, Message: msg, Fields: map[string]string{"coupon": msg}}
+	}
+	if coupon != nil {
+		if couponStacks {
+			return stackable, nil
+		}
+		return []Discount{*coupon}, nil
+	}
+	best, bestValue := stackable, discountValue(stackable, shipping)
+	for _, d := range alone {
+		if v := discountValue([]Discount{d}, shipping); v > bestValue {
+			best, bestValue = []Discount{d}, v
+		}
+	}
+	return best, nil
+}
+
+// discountValue is what discounts save, in minor units.
+func discountValue(discounts []Discount, shipping Money) int64 {
+	var total int64
+	free := false
+	for _, d := range discounts {
+		total += d.Amount.Amount
+		free = free || d.FreeShipping
+	}
+	if free {
+		total += shipping.Amount
+	}
+	return total
+}
+
+type promotionUseCount struct {
+	PromotionId int64
+	Uses        int64
+}
+
+type PromotionRow struct {
+	Promotion Promotion
+	Uses      int64
+	State     string // scheduled, running, ended or paused
+}
+
+type PromotionAdmin struct {
+	Promotions []PromotionRow
+	Kinds      []string
+	Categories []string
+	Base       string
+	Edit       Promotion
+	Error      string
+	Fields     map[string]string
+}
+
+type PromotionAdminPage struct {
+	User    string
+	Content PromotionAdmin
+}
+
+func promotionState(p Promotion, now time.Time) string {
+	return scheduleState(p.Active, p.Starts, p.Ends, now)
+}
+
+func renderPromotionAdmin(w http.ResponseWriter, r *http.Request, status int, edit Promotion, err error) error {
+	a := PromotionAdmin{Kinds: promotionKinds, Base: config.Currency, Edit: edit}
+	var promos []Promotion
+	if _, lerr := dbFor(r).Select(&promos, "SELECT * FROM promotions ORDER BY Starts DESC, Id DESC"); lerr != nil {
+		return Internal(lerr, "Promotions are unavailable right now.")
+	}
+	var uses []promotionUseCount
+	if _, lerr := dbFor(r).Select(&uses, "SELECT PromotionId, count(*) AS Uses FROM promotionuses GROUP BY PromotionId"); lerr != nil {
+		return Internal(lerr, "Promotions are unavailable right now.")
+	}
+	counts := map[int64]int64{}
+	for _, u := range uses {
+		counts[u.PromotionId] = u.Uses
+	}
+	now := time.Now()
+	for _, p := range promos {
+		a.Promotions = append(a.Promotions, PromotionRow{Promotion: p, Uses: counts[p.Id], State: promotionState(p, now)})
+	}
+	categories, lerr := loadCategories(r)
+	if lerr != nil {
+		return Internal(lerr, "Promotions are unavailable right now.")
+	}
+	for _, c := range categories {
+		a.Categories = append(a.Categories, c.Name)
+	}
+	if err != nil {
+		errs := formErrors(err)
+		a.Error, a.Fields = errs.Error, errs.Fields
+	}
+	return renderer.RenderStatus(w, r, status, "manage_promotions", PromotionAdminPage{User: getStringFromSession(r, "User"), Content: a})
+}
+
+func loadPromotion(r *http.Request) (*Promotion, error) {
+	id, _ := strconv.ParseInt(gmux.Vars(r)["id"], 10, 64)
+	obj, err := dbFor(r).Get(Promotion{}, id)
+	if err != nil {
+		return nil, Internal(err, "The promotion could not be loaded.")
+	}
+	if obj == nil {
+		return nil, NotFound("Promotion %d does not exist.", id)
+	}
+	p := obj.(*Promotion)
+	p.fillText()
+	return p, nil
+}
+
+// ManagePromotionsHandler lists every promotion with how often it was
+// used, next to a form for adding one or editing the one given by {id}.
+func ManagePromotionsHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	edit := Promotion{Kind: PromoPercent, Starts: time.Now().Truncate(time.Minute), Active: true}
+	if gmux.Vars(r)["id"] != "" {
+		p, err := loadPromotion(r)
+		if err != nil {
+			return err
+		}
+		edit = *p
+	}
+	return renderPromotionAdmin(w, r, http.StatusOK, edit, nil)
+}
+
+// SavePromotionHandler creates a promotion, or updates it when the route
+// has an {id}. Coupon codes are unique.
+func SavePromotionHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	p := &Promotion{}
+	if gmux.Vars(r)["id"] != "" {
+		var err error
+		if p, err = loadPromotion(r); err != nil {
+			return err
+		}
+	}
+	if err := bind(r, p); err != nil {
+		return renderPromotionAdmin(w, r, http.StatusBadRequest, *p, err)
+	}
+	if p.Code != "" {
+		count, err := dbFor(r).SelectInt("SELECT count(*) FROM promotions WHERE Code=? AND Id<>?", p.Code, p.Id)
+		if err != nil {
+			return Internal(err, "The promotion could not be saved.")
+		}
+		if count > 0 {
+			msg := "Another promotion already uses that code."
+			return renderPromotionAdmin(w, r, http.StatusBadRequest, *p, &AppError{Kind: KindValidation, Message: msg, Fields: map[string]string{"code": msg}})
+		}
+	}
+	p.Updated = time.Now()
+	var err error
+	if p.Id == 0 {
+		p.Created = p.Updated
+		err = dbFor(r).Insert(p)
+	} else {
+		_, err = dbFor(r).Update(p)
+	}
+	if err != nil {
+		return Internal(err, "The promotion could not be saved.")
+	}
+	http.Redirect(w, r, "/manage/promotions/", http.StatusSeeOther)
+	return nil
+}
+
+// DeletePromotionHandler deletes a promotion that was never used; used
+// ones should be paused instead so past orders still explain themselves.
+func DeletePromotionHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	p, err := loadPromotion(r)
+	if err != nil {
+		return err
+	}
+	used, err := dbFor(r).SelectInt("SELECT count(*) FROM promotionuses WHERE PromotionId=?", p.Id)
+	if err != nil {
+		return Internal(err, "The promotion could not be deleted.")
+	}
+	if used > 0 {
+		return Conflict("This promotion has been used %d times; pause it instead.", used)
+	}
+	if _, err := dbFor(r).Delete(p); err != nil {
+		return Internal(err, "The promotion could not be deleted.")
+	}
+	http.Redirect(w, r, "/manage/promotions/", http.StatusSeeOther)
+	return nil
+}
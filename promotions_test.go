@@ -0,0 +1,83 @@
+package main
+
+import "testing"
+
+func TestWithinLimits(t *testing.T) {
+	tests := []struct {
+		usageLimit, perUserLimit int
+		used, usedByUser         int64
+		username                 string
+		want                     bool
+	}{
+		{0, 0, 100, 100, "", true},
+		{5, 0, 4, 0, "", true},
+		{5, 0, 5, 0, "alice", false},
+		{5, 0, 6, 0, "alice", false},
+		{0, 1, 3, 0, "alice", true},
+		{0, 1, 3, 1, "alice", false},
+		{0, 2, 3, 1, "alice", true},
+		// Uses per customer can only be counted for a logged in customer.
+		{0, 1, 0, 0, "", false},
+		{5, 1, 5, 0, "alice", false},
+	}
+	for _, tt := range tests {
+		p := Promotion{UsageLimit: tt.usageLimit, PerUserLimit: tt.perUserLimit}
+		got, reason := p.withinLimits(tt.used, tt.usedByUser, tt.username)
+		if got != tt.want {
+			t.Errorf("withinLimits(%d/%d, %d/%d, %q) = %v, want %v", tt.used, tt.usageLimit, tt.usedByUser, tt.perUserLimit, tt.username, got, tt.want)
+		}
+		if !got && reason == "" {
+			t.Errorf("withinLimits(%d/%d, %d/%d, %q) gave no reason", tt.used, tt.usageLimit, tt.usedByUser, tt.perUserLimit, tt.username)
+		}
+	}
+}
+
+func TestChoosePromotions(t *testing.T) {
+	items := []CartItem{{Product: Product{Category: "Tools"}, Price: Money{1000, "EUR"}, Quantity: 2}}
+	subtotal, shipping := Money{2000, "EUR"}, Money{500, "EUR"}
+	percent := func(id int64, code string, pct float64, stackable bool) Promotion {
+		return Promotion{Id: id, Code: code, Kind: PromoPercent, Percent: pct, Stackable: stackable}
+	}
+	freeShipping := Promotion{Id: 9, Kind: PromoFreeShipping}
+	tests := []struct {
+		name    string
+		promos  []Promotion
+		blocked map[int64]string
+		code    string
+		want    []int64 // promotion ids
+		wantErr bool
+	}{
+		{"nothing", nil, nil, "", nil, false},
+		{"stackable add up", []Promotion{percent(1, "", 5, true), percent(2, "", 10, true)}, nil, "", []int64{1, 2}, false},
+		{"best alone beats stack", []Promotion{percent(1, "", 5, true), percent(2, "", 10, true), percent(3, "", 20, false)}, nil, "", []int64{3}, false},
+		{"stack beats alone", []Promotion{percent(1, "", 10, true), percent(2, "", 10, true), percent(3, "", 15, false)}, nil, "", []int64{1, 2}, false},
+		{"free shipping counts its charge", []Promotion{percent(1, "", 20, false), freeShipping}, nil, "", []int64{9}, false},
+		{"blocked automatic skipped", []Promotion{percent(1, "", 5, true), percent(2, "", 10, true)}, map[int64]string{2: "This code has been used up."}, "", []int64{1}, false},
+		{"coupon alone", []Promotion{percent(1, "", 5, true), percent(2, "SAVE", 10, false)}, nil, "SAVE", []int64{2}, false},
+		{"stackable coupon", []Promotion{percent(1, "", 5, true), percent(2, "SAVE", 10, true), percent(3, "", 50, false)}, nil, "SAVE", []int64{1, 2}, false},
+		{"coupon used up", []Promotion{percent(2, "SAVE", 10, false)}, map[int64]string{2: "This code has been used up."}, "SAVE", nil, true},
+		{"coupon without a match", []Promotion{percent(1, "", 5, true)}, nil, "NOPE", nil, true},
+		{"coupon not in category", []Promotion{{Id: 4, Code: "GARDEN", Kind: PromoCategory, Category: "Garden", Percent: 10}}, nil, "GARDEN", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := choosePromotions(tt.promos, tt.blocked, items, subtotal, shipping, tt.code)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		var ids []int64
+		for _, d := range got {
+			ids = append(ids, d.PromotionId)
+		}
+		if len(ids) != len(tt.want) {
+			t.Errorf("%s: promotions = %v, want %v", tt.name, ids, tt.want)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != tt.want[i] {
+				t.Errorf("%s: promotions = %v, want %v", tt.name, ids, tt.want)
+				break
+			}
+		}
+	}
+}
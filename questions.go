@@ -0,0 +1,491 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	gmux "github.com/gorilla/mux"
+)
+
+// questionsShown is how many questions a product page lists, newest
+// first.
+const questionsShown = 50
+
+// Question is a customer's question about a product. The asker or an
+// admin can accept one of its answers.
+type Question struct {
+	Id               int64     `db:"Id"`
+	ProductId        int64     `db:"ProductId"`
+	Username         string    `db:"Username"`
+	Author           string    `db:"Author,size:100" form:"author" label:"Name" validate:"required,max=100"`
+	Body             string    `db:"Body,size:1000" form:"question" label:"Question" validate:"required,max=1000"`
+	AcceptedAnswerId int64     `db:"AcceptedAnswerId"` // 0 until an answer is accepted
+	Created          time.Time `db:"Created"`
+}
+
+// Answer answers a question. Only admins and customers who bought the
+// product can answer.
+type Answer struct {
+	Id            int64     `db:"Id"`
+	QuestionId    int64     `db:"QuestionId"`
+	Username      string    `db:"Username"`
+	Author        string    `db:"Author,size:100" form:"author" label:"Name" validate:"required,max=100"`
+	Body          string    `db:"Body,size:2000" form:"answer" label:"Answer" validate:"required,max=2000"`
+	Staff         bool      `db:"Staff"`         // answered by an admin
+	VerifiedBuyer bool      `db:"VerifiedBuyer"` // answered by someone who bought the product
+	Votes         int       `db:"Votes"`         // see AnswerVote
+	Created       time.Time `db:"Created"`
+}
+
+func (q Question) Anchor() string {
+	return "question-" + strconv.FormatInt(q.Id, 10)
+}
+
+func (a Answer) Anchor() string {
+	return "answer-" + strconv.FormatInt(a.Id, 10)
+}
+
+// canAnswer reports whether a visitor may answer questions about a
+// product: admins and customers who bought it.
+func canAnswer(admin, buyer bool) bool {
+	return admin || buyer
+}
+
+// canAccept reports whether username may accept an answer to q: the
+// asker and admins.
+func (q Question) canAccept(username string, admin bool) bool {
+	return admin || username != "" && q.Username == username
+}
+
+// canVote reports whether username may upvote a. Nobody votes for their
+// own answer.
+func (a Answer) canVote(username string) bool {
+	return username != "" && a.Username != username
+}
+
+// AnswerVote is a user upvoting an answer.
+type AnswerVote struct {
+	Id       int64     `db:"Id"`
+	AnswerId int64     `db:"AnswerId"`
+	Username string    `db:"Username"`
+	Created  time.Time `db:"Created"`
+}
+
+// verifiedBuyer reports whether username bought the product. There are
+// no orders yet, so that is having a review of it that a moderator
+// marked as a verified purchase.
+func verifiedBuyer(db *meteredDbMap, username string, productId int64) (bool, error) {
+	if username == "" {
+		return false, nil
+	}
+	n, err := db.SelectInt("SELECT count(*) FROM reviews WHERE ProductId=? AND Username=? AND Verified=1", productId, username)
+	return n > 0, err
+}
+
+// AnsweredQuestion is a question with its accepted answer, as the product
+// JSON has it.
+type AnsweredQuestion struct {
+	Question   string
+	Answer     string
+	AnsweredBy string
+	Staff      bool
+	Votes      int
+}
+
+// answeredQuestions returns the questions about a product that have an
+// accepted answer, newest first.
+func answeredQuestions(db *meteredDbMap, productId int64) ([]AnsweredQuestion, error) {
+	var list []AnsweredQuestion
+	_, err := db.Select(&list, "SELECT q.Body AS Question, a.Body AS Answer, a.Author AS AnsweredBy, a.Staff, a.Votes "+
+		"FROM questions q JOIN answers a ON a.Id=q.AcceptedAnswerId WHERE q.ProductId=? ORDER BY q.Created DESC LIMIT ?", productId, questionsShown)
+	return list, err
+}
+
+// QuestionThread is a question with its answers: the accepted one apart,
+// the others with the most votes first.
+type QuestionThread struct {
+	Question  Question
+	Accepted  *Answer
+	Answers   []Answer
+	CanAccept bool
+}
+
+// ProductQuestions is the questions and answers section of a product page.
+type ProductQuestions struct {
+	Threads      []QuestionThread
+	LoggedIn     bool
+	Admin        bool
+	CanAnswer    bool           // the visitor is an admin or bought the product
+	CanVote      map[int64]bool // answers the visitor can still upvote
+	Asked        bool           // the visitor just asked a question
+	Form         Question
+	Error        string
+	Fields       map[string]string
+	AnswerForm   Answer // an answer shown again, for the question it answers
+	AnswerError  string
+	AnswerFields map[string]string
+}
+
+// productQuestions loads the questions about p for the visitor, with the
+// question or answer in forms that was rejected, if any.
+func productQuestions(w http.ResponseWriter, r *http.Request, p Product, forms productForms) (ProductQuestions, error) {
+	db, username, admin := dbFor(r), getStringFromSession(r, "User"), VerifyAdmin(w, r)
+	pq := ProductQuestions{LoggedIn: username != "", CanVote: map[int64]bool{}, Asked: r.FormValue("question") == "asked", Form: forms.Question, AnswerForm: forms.Answer}
+	buyer, err := verifiedBuyer(db, username, p.Id)
+	if err != nil {
+		return pq, err
+	}
+	pq.Admin, pq.CanAnswer = admin, canAnswer(admin, buyer)
+	var questions []Question
+	if _, err := db.Select(&questions, "SELECT * FROM questions WHERE ProductId=? ORDER BY Created DESC LIMIT ?", p.Id, questionsShown); err != nil {
+		return pq, err
+	}
+	var answers []Answer
+	if _, err := db.Select(&answers, "SELECT a.* FROM answers a JOIN questions q ON q.Id=a.QuestionId WHERE q.ProductId=? ORDER BY a.Votes DESC, a.Created", p.Id); err != nil {
+		return pq, err
+	}
+	voted := map[int64]bool{}
+	if username != "" {
+		var votes []AnswerVote
+		if _, err := db.Select(&votes, "SELECT v.* FROM answervotes v JOIN answers a ON a.Id=v.AnswerId JOIN questions q ON q.Id=a.QuestionId WHERE q.ProductId=? AND v.Username=?", p.Id, username); err != nil {
+			return pq, err
+		}
+		for _, v := range votes {
+			voted[v.AnswerId] = true
+		}
+	}
+	byQuestion := map[int64][]Answer{}
+	for _, a := range answers {
+		byQuestion[a.QuestionId] = append(byQuestion[a.QuestionId], a)
+		if a.canVote(username) && !voted[a.Id] {
+			pq.CanVote[a.Id] = true
+		}
+	}
+	for _, q := range questions {
+		t := QuestionThread{Question: q, CanAccept: q.canAccept(username, admin)}
+		for i, a := range byQuestion[q.Id] {
+			if a.Id == q.AcceptedAnswerId {
+				t.Accepted = &byQuestion[q.Id][i]
+				continue
+			}
+			t.Answers = append(t.Answers, a)
+		}
+		pq.Threads = append(pq.Threads, t)
+	}
+	if forms.QuestionErr != nil {
+		errs := formErrors(forms.QuestionErr)
+		pq.Error, pq.Fields = errs.Error, errs.Fields
+	}
+	if forms.AnswerErr != nil {
+		errs := formErrors(forms.AnswerErr)
+		pq.AnswerError, pq.AnswerFields = errs.Error, errs.Fields
+	}
+	return pq, nil
+}
+
+// AskQuestionHandler takes a question about {id} from a logged-in user.
+func AskQuestionHandler(w http.ResponseWriter, r *http.Request) error {
+	username, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+	p, err := loadProduct(r)
+	if err != nil {
+		return err
+	}
+	q := &Question{ProductId: p.Id, Username: username}
+	if err := bind(r, q); err != nil {
+		return renderProductPage(w, r, http.StatusBadRequest, *p, productForms{Question: *q, QuestionErr: err})
+	}
+	if err := checkAbuse(newSubmission(r, "question", username, q.Body)); err != nil {
+		return renderProductPage(w, r, http.StatusBadRequest, *p, productForms{Question: *q, QuestionErr: err})
+	}
+	q.Created = time.Now()
+	if err := dbFor(r).Insert(q); err != nil {
+		return Internal(err, "Your question could not be saved.")
+	}
+	http.Redirect(w, r, productPath(*p)+"?question=asked#questions", http.StatusSeeOther)
+	return nil
+}
+
+// loadQuestion loads the question {id} and its product.
+func loadQuestion(r *http.Request) (*Question, *Product, error) {
+	id, _ := strconv.ParseInt(gmux.Vars(r)["id"], 10, 64)
+	obj, err := dbFor(r).Get(Question{}, id)
+	if err != nil {
+		return nil, nil, Internal(err, "The question could not be loaded.")
+	}
+	if obj == nil {
+		return nil, nil, NotFound("Question %d does not exist.", id)
+	}
+	q := obj.(*Question)
+	prod, err := dbFor(r).Get(Product{}, q.ProductId)
+	if err != nil {
+		return nil, nil, Internal(err, "The question could not be loaded.")
+	}
+	if prod == nil {
+		return nil, nil, NotFound("Question %d does not exist.", id)
+	}
+	return q, prod.(*Product), nil
+}
+
+// loadAnswer loads the answer {id} and its question.
+func loadAnswer(r *http.Request) (*Answer, *Question, *Product, error) {
+	id, _ := strconv.ParseInt(gmux.Vars(r)["id"], 10, 64)
+	obj, err := dbFor(r).Get(Answer{}, id)
+	if err != nil {
+		return nil, nil, nil, Internal(err, "The answer could not be loaded.")
+	}
+	if obj == nil {
+		return nil, nil, nil, NotFound("Answer %d does not exist.", id)
+	}
+	a := obj.(*Answer)
+	qobj, err := dbFor(r).Get(Question{}, a.QuestionId)
+	if err != nil {
+		return nil, nil, nil, Internal(err, "The answer could not be loaded.")
+	}
+	if qobj == nil {
+		return nil, nil, nil, NotFound("Answer %d does not exist.", id)
+	}
+	q := qobj.(*Question)
+	prod, err := dbFor(r).Get(Product{}, q.ProductId)
+	if err != nil {
+		return nil, nil, nil, Internal(err, "The answer could not be loaded.")
+	}
+	if prod == nil {
+		return nil, nil, nil, NotFound("Answer %d does not exist.", id)
+	}
+	return a, q, prod.(*Product), nil
+}
+
+// AnswerQuestionHandler answers question {id}, for admins and for
+// customers who bought the product.
+func AnswerQuestionHandler(w http.ResponseWriter, r *http.Request) error {
+	username, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+	q, p, err := loadQuestion(r)
+	if err != nil {
+		return err
+	}
+	a := &Answer{QuestionId: q.Id, Username: username, Staff: VerifyAdmin(w, r)}
+	if a.VerifiedBuyer, err = verifiedBuyer(dbFor(r), username, p.Id); err != nil {
+		return Internal(err, "Your answer could not be saved.")
+	}
+	if !canAnswer(a.Staff, a.VerifiedBuyer) {
+		return Unauthorized("Only customers who bought this product can answer questions about it.")
+	}
+	if err := bind(r, a); err != nil {
+		return renderProductPage(w, r, http.StatusBadRequest, *p, productForms{Answer: *a, AnswerErr: err})
+	}
+	if !a.Staff {
+		if err := checkAbuse(newSubmission(r, "answer", username, a.Body)); err != nil {
+			return renderProductPage(w, r, http.StatusBadRequest, *p, productForms{Answer: *a, AnswerErr: err})
+		}
+	}
+	a.Created = time.Now()
+	if err := dbFor(r).Insert(a); err != nil {
+		return Internal(err, "Your answer could not be saved.")
+	}
+	http.Redirect(w, r, productPath(*p)+"#"+a.Anchor(), http.StatusSeeOther)
+	return nil
+}
+
+// AcceptAnswerHandler marks answer {id} as the accepted answer of its
+// question, for the asker and admins.
+func AcceptAnswerHandler(w http.ResponseWriter, r *http.Request) error {
+	username, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+	a, q, p, err := loadAnswer(r)
+	if err != nil {
+		return err
+	}
+	if !q.canAccept(username, VerifyAdmin(w, r)) {
+		return Unauthorized("Only the person who asked can accept an answer.")
+	}
+	if _, err := dbFor(r).Exec("UPDATE questions SET AcceptedAnswerId=? WHERE Id=?", a.Id, q.Id); err != nil {
+		return Internal(err, "The answer could not be accepted.")
+	}
+	http.Redirect(w, r, productPath(*p)+"#"+a.Anchor(), http.StatusSeeOther)
+	return nil
+}
+
+// VoteAnswerHandler upvotes answer {id}, once per user and never one's
+// own.
+func VoteAnswerHandler(w http.ResponseWriter, r *http.Request) error {
+	username, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+	a, _, p, err := loadAnswer(r)
+	if err != nil {
+		return err
+	}
+	if !a.canVote(username) {
+		return Validation("You cannot vote for your own answer.")
+	}
+	db := dbFor(r)
+	voted, err := db.SelectInt("SELECT count(*) FROM answervotes WHERE AnswerId=? AND Username=?", a.Id, username)
+	if err != nil {
+		return Internal(err, "Your vote could not be saved.")
+	}
+	if voted == 0 {
+		if err := db.Insert(&AnswerVote{AnswerId: a.Id, Username: username, Created: time.Now()}); err != nil {
+			return Internal(err, "Your vote could not be saved.")
+		}
+		if _, err := db.Exec("UPDATE answers SET Votes=(SELECT count(*) FROM answervotes WHERE AnswerId=?) WHERE Id=?", a.Id, a.Id); err != nil {
+			return Internal(err, "Your vote could not be saved.")
+		}
+	}
+	http.Redirect(w, r, productPath(*p)+"#"+a.Anchor(), http.StatusSeeOther)
+	return nil
+}
+
+// QuestionRow is a question on the admin list.
+type QuestionRow struct {
+	Question    Question
+	Answers     int
+	ProductName string
+	ProductURL  string
+}
+
+type QuestionAdmin struct {
+	Unanswered bool
+	Questions  []QuestionRow
+}
+
+type QuestionAdminPage struct {
+	User    string
+	Content QuestionAdmin
+}
+
+type answerCount struct {
+	QuestionId int64
+	Answers    int
+}
+
+// ManageQuestionsHandler lists recent questions, or with ?unanswered=1
+// those nobody has answered yet, oldest first.
+func ManageQuestionsHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	a := QuestionAdmin{Unanswered: r.FormValue("unanswered") != ""}
+	db := dbFor(r)
+	var questions []Question
+	if _, err := db.Select(&questions, "SELECT * FROM questions ORDER BY Created DESC LIMIT 200"); err != nil {
+		return Internal(err, "Questions are unavailable right now.")
+	}
+	var counts []answerCount
+	if _, err := db.Select(&counts, "SELECT QuestionId, count(*) AS Answers FROM answers GROUP BY QuestionId"); err != nil {
+		return Internal(err, "Questions are unavailable right now.")
+	}
+	answered := map[int64]int{}
+	for _, c := range counts {
+		answered[c.QuestionId] = c.Answers
+	}
+	var products []Product
+	if _, err := db.Select(&products, "SELECT * FROM products"); err != nil {
+		return Internal(err, "Questions are unavailable right now.")
+	}
+	byId := map[int64]Product{}
+	for _, p := range products {
+		byId[p.Id] = p
+	}
+	for _, q := range questions {
+		if a.Unanswered && answered[q.Id] > 0 {
+			continue
+		}
+		row := QuestionRow{Question: q, Answers: answered[q.Id]}
+		if p, ok := byId[q.ProductId]; ok {
+			row.ProductName, row.ProductURL = p.Name, productPath(p)
+		}
+		a.Questions = append(a.Questions, row)
+	}
+	if a.Unanswered {
+		sort.SliceStable(a.Questions, func(i, j int) bool { return a.Questions[i].Question.Created.Before(a.Questions[j].Question.Created) })
+	}
+	return renderer.Render(w, r, "manage_questions", QuestionAdminPage{User: getStringFromSession(r, "User"), Content: a})
+}
+
+// DeleteQuestionHandler removes a question with its answers and votes.
+func DeleteQuestionHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	q, _, err := loadQuestion(r)
+	if err != nil {
+		return err
+	}
+	if err := deleteQuestion(dbFor(r), q); err != nil {
+		return Internal(err, "The question could not be deleted.")
+	}
+	http.Redirect(w, r, "/manage/questions/", http.StatusSeeOther)
+	return nil
+}
+
+// DeleteAnswerHandler removes an answer and its votes, and takes it back
+// if it was accepted.
+func DeleteAnswerHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	a, q, p, err := loadAnswer(r)
+	if err != nil {
+		return err
+	}
+	if err := deleteAnswer(dbFor(r), a, q); err != nil {
+		return Internal(err, "The answer could not be deleted.")
+	}
+	http.Redirect(w, r, productPath(*p)+"#questions", http.StatusSeeOther)
+	return nil
+}
+
+// deleteQuestion deletes q with its answers and their votes in one
+// transaction.
+func deleteQuestion(db *meteredDbMap, q *Question) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE v FROM answervotes v JOIN answers a ON a.Id=v.AnswerId WHERE a.QuestionId=?", q.Id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM answers WHERE QuestionId=?", q.Id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Delete(q); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteAnswer deletes a with its votes in one transaction, taking it back
+// from q if it was accepted.
+func deleteAnswer(db *meteredDbMap, a *Answer, q *Question) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM answervotes WHERE AnswerId=?", a.Id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("UPDATE questions SET AcceptedAnswerId=0 WHERE Id=? AND AcceptedAnswerId=?", q.Id, a.Id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Delete(a); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
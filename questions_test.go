@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestCanAnswer(t *testing.T) {
+	tests := []struct {
+		admin, buyer bool
+		want         bool
+	}{
+		{false, false, false},
+		{false, true, true},
+		{true, false, true},
+		{true, true, true},
+	}
+	for _, tt := range tests {
+		if got := canAnswer(tt.admin, tt.buyer); got != tt.want {
+			t.Errorf("canAnswer(admin %v, buyer %v) = %v, want %v", tt.admin, tt.buyer, got, tt.want)
+		}
+	}
+}
+
+func TestCanAccept(t *testing.T) {
+	q := Question{Username: "ada"}
+	tests := []struct {
+		username string
+		admin    bool
+		want     bool
+	}{
+		{"ada", false, true},
+		{"bob", false, false},
+		{"bob", true, true},
+		{"", false, false},
+	}
+	for _, tt := range tests {
+		if got := q.canAccept(tt.username, tt.admin); got != tt.want {
+			t.Errorf("canAccept(%q, admin %v) = %v, want %v", tt.username, tt.admin, got, tt.want)
+		}
+	}
+	// A visitor who is not logged in does not match a question without an
+	// asker.
+	if (Question{}).canAccept("", false) {
+		t.Error("canAccept(\"\") on a question without an asker = true, want false")
+	}
+}
+
+func TestCanVote(t *testing.T) {
+	a := Answer{Username: "ada"}
+	tests := []struct {
+		username string
+		want     bool
+	}{
+		{"bob", true},
+		{"ada", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := a.canVote(tt.username); got != tt.want {
+			t.Errorf("canVote(%q) = %v, want %v", tt.username, got, tt.want)
+		}
+	}
+}
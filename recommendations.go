@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	sessions "github.com/goincremental/negroni-sessions"
+)
+
+// Recommendation kinds, computed by computeRecommendations.
+const (
+	RecommendSimilar  = "similar"  // same category or brand, similar price
+	RecommendTogether = "together" // often in the same basket
+)
+
+const (
+	recommendationsShown = 6
+	recentlyViewedShown  = 6
+	// viewRetention is how long product views are kept for recently
+	// viewed lists.
+	viewRetention = 90 * 24 * time.Hour
+	// minBoughtTogether is how many baskets must hold two products before
+	// one is recommended with the other, so a single odd basket does not
+	// show up on both pages.
+	minBoughtTogether = 2
+)
+
+// ProductView is a visitor looking at a product. Visitor is kept in the
+// session, Username is set too once someone logs in so their history
+// follows them to other devices.
+type ProductView struct {
+	Id        int64     `db:"Id"`
+	ProductId int64     `db:"ProductId"`
+	Visitor   string    `db:"Visitor,size:32"`
+	Username  string    `db:"Username"`
+	Viewed    time.Time `db:"Viewed"`
+}
+
+// BasketItem is a product in a visitor's basket, the last time its totals
+// were priced. Products sharing a basket are bought together.
+type BasketItem struct {
+	Id        int64     `db:"Id"`
+	Basket    string    `db:"Basket,size:32"` // the order
+	ProductId int64     `db:"ProductId"`
+	Quantity  int       `db:"Quantity"`
+	Updated   time.Time `db:"Updated"`
+}
+
+// Recommendation is a product shown with another, best Score first.
+type Recommendation struct {
+	Id        int64     `db:"Id"`
+	ProductId int64     `db:"ProductId"`
+	RelatedId int64     `db:"RelatedId"`
+	Kind      string    `db:"Kind,size:16"`
+	Score     float64   `db:"Score"`
+	Updated   time.Time `db:"Updated"`
+}
+
+// visitorID returns the random ID tracking the session's views and
+// basket, starting one if the session has none yet.
+func visitorID(r *http.Request) string {
+	if id := getStringFromSession(r, "Visitor"); id != "" {
+		return id
+	}
+	id := newRequestID()
+	sessions.GetSession(r).Set("Visitor", id)
+	return id
+}
+
+// recordView notes that the visitor looked at productId. Failing to do so
+// must not cost them the page, so errors are only logged.
+func recordView(r *http.Request, productId int64) {
+	view := &ProductView{ProductId: productId, Visitor: visitorID(r), Username: getStringFromSession(r, "User"), Viewed: time.Now()}
+	if err := dbFor(r).Insert(view); err != nil {
+		logger.Error(r.Context(), "product view not recorded", Fields{"product": productId, "error": err})
+	}
+}
+
+// recordBasket stores the lines of a placed order as a basket for
+// frequently bought together. Errors are only logged, like recordView.
+func recordBasket(r *http.Request, orderId int64, lines []OrderLine) {
+	db, basket, now := dbFor(r), "order-"+strconv.FormatInt(orderId, 10), time.Now()
+	for _, line := range lines {
+		if err := db.Insert(&BasketItem{Basket: basket, ProductId: line.ProductId, Quantity: line.Quantity, Updated: now}); err != nil {
+			logger.Error(r.Context(), "basket not recorded", Fields{"error": err})
+			return
+		}
+	}
+}
+
+// recentlyViewed returns the products the visitor looked at last, newest
+// first, leaving out exclude.
+func recentlyViewed(r *http.Request, exclude int64) ([]Product, error) {
+	where, args := "Visitor=?", []interface{}{visitorID(r)}
+	if username := getStringFromSession(r, "User"); username != "" {
+		where, args = "(Visitor=? OR Username=?)", append(args, username)
+	}
+	var products []Product
+	_, err := dbFor(r).Select(&products, "SELECT p.* FROM products p JOIN "+
+		"(SELECT ProductId, MAX(Viewed) AS Last FROM productviews WHERE "+where+" AND ProductId<>? GROUP BY ProductId) v "+
+		"ON v.ProductId=p.Id ORDER BY v.Last DESC LIMIT ?", append(args, exclude, recentlyViewedShown)...)
+	return products, err
+}
+
+// recommended returns the products recommended with productId, best first.
+func recommended(db *meteredDbMap, productId int64, kind string) ([]Product, error) {
+	var products []Product
+	_, err := db.Select(&products, "SELECT p.* FROM products p JOIN recommendations rc ON rc.RelatedId=p.Id "+
+		"WHERE rc.ProductId=? AND rc.Kind=? ORDER BY rc.Score DESC LIMIT ?", productId, kind, recommendationsShown)
+	return products, err
+}
+
+// ProductRecommendations are the product lists under a product page.
+type ProductRecommendations struct {
+	RecentlyViewed []ProductLink
+	Similar        []ProductLink
+	BoughtTogether []ProductLink
+}
+
+// productRecommendations loads the lists shown with p, priced with pr.
+func productRecommendations(r *http.Request, pr *Pricer, p Product) (ProductRecommendations, error) {
+	var recs ProductRecommendations
+	links := func(products []Product) []ProductLink {
+		var l []ProductLink
+		for _, prod := range products {
+			l = append(l, ProductLink{Product: prod, Price: pr.Price(prod), Was: pr.Was(prod), URL: productPath(prod)})
+		}
+		return l
+	}
+	recent, err := recentlyViewed(r, p.Id)
+	if err != nil {
+		return recs, err
+	}
+	similar, err := recommended(dbFor(r), p.Id, RecommendSimilar)
+	if err != nil {
+		return recs, err
+	}
+	together, err := recommended(dbFor(r), p.Id, RecommendTogether)
+	if err != nil {
+		return recs, err
+	}
+	recs.RecentlyViewed, recs.Similar, recs.BoughtTogether = links(recent), links(similar), links(together)
+	return recs, nil
+}
+
+// similarity scores how alike two products are: a shared category counts
+// most, then the brand, then how close their regular prices are. Products
+// with neither in common score 0.
+func similarity(a, b Product) float64 {
+	score := 0.0
+	if a.Category != "" && a.Category == b.Category {
+		score += 2
+	}
+	if a.Brand != "" && strings.EqualFold(a.Brand, b.Brand) {
+		score++
+	}
+	if score == 0 {
+		return 0
+	}
+	lo, hi := float64(a.PriceAmount), float64(b.PriceAmount)
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+	if lo > 0 && a.PriceCurrency == b.PriceCurrency {
+		score += lo / hi
+	}
+	return score
+}
+
+// similarProducts ranks the products most like each product.
+func similarProducts(products []Product, now time.Time) []Recommendation {
+	var recs []Recommendation
+	for _, p := range products {
+		var candidates []Recommendation
+		for _, q := range products {
+			if q.Id == p.Id {
+				continue
+			}
+			if score := similarity(p, q); score > 0 {
+				candidates = append(candidates, Recommendation{ProductId: p.Id, RelatedId: q.Id, Kind: RecommendSimilar, Score: score, Updated: now})
+			}
+		}
+		recs = append(recs, topRecommendations(candidates)...)
+	}
+	return recs
+}
+
+// topRecommendations keeps the best recommendationsShown of one product's
+// candidates.
+func topRecommendations(candidates []Recommendation) []Recommendation {
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Score > candidates[j].Score })
+	if len(candidates) > recommendationsShown {
+		candidates = candidates[:recommendationsShown]
+	}
+	return candidates
+}
+
+type basketPair struct {
+	ProductId int64
+	RelatedId int64
+	Baskets   int64
+}
+
+// boughtTogether ranks, for each product, the products that share the most
+// baskets with it.
+func boughtTogether(db *meteredDbMap, now time.Time) ([]Recommendation, error) {
+	var pairs []basketPair
+	if _, err := db.Select(&pairs, "SELECT a.ProductId AS ProductId, b.ProductId AS RelatedId, count(*) AS Baskets "+
+		"FROM basketitems a JOIN basketitems b ON a.Basket=b.Basket AND a.ProductId<>b.ProductId "+
+		"GROUP BY a.ProductId, b.ProductId HAVING count(*) >= ? ORDER BY a.ProductId", minBoughtTogether); err != nil {
+		return nil, err
+	}
+	var recs, candidates []Recommendation
+	for i, pair := range pairs {
+		candidates = append(candidates, Recommendation{ProductId: pair.ProductId, RelatedId: pair.RelatedId, Kind: RecommendTogether, Score: float64(pair.Baskets), Updated: now})
+		if i == len(pairs)-1 || pairs[i+1].ProductId != pair.ProductId {
+			recs = append(recs, topRecommendations(candidates)...)
+			candidates = nil
+		}
+	}
+	return recs, nil
+}
+
+// computeRecommendations is the "recommendations" job: it ranks similar and
+// bought together products again and drops views past viewRetention.
+func computeRecommendations(ctx context.Context) error {
+	db, now := dbmap.WithContext(ctx), time.Now()
+	var products []Product
+	if _, err := db.Select(&products, "SELECT * FROM products"); err != nil {
+		return err
+	}
+	together, err := boughtTogether(db, now)
+	if err != nil {
+		return err
+	}
+	for kind, recs := range map[string][]Recommendation{RecommendSimilar: similarProducts(products, now), RecommendTogether: together} {
+		if err := replaceRecommendations(db, kind, recs); err != nil {
+			return err
+		}
+	}
+	if _, err := db.Exec("DELETE FROM productviews WHERE Viewed < ?", now.Add(-viewRetention)); err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM basketitems WHERE Updated < ?", now.Add(-viewRetention))
+	return err
+}
+
+// replaceRecommendations swaps the stored recommendations of kind for recs
+// in one transaction, so pages never see a half written list.
+func replaceRecommendations(db *meteredDbMap, kind string, recs []Recommendation) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM recommendations WHERE Kind=?", kind); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for i := range recs {
+		if err := tx.Insert(&recs[i]); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// RecentlyViewedHandler returns the visitor's recently viewed products as
+// JSON, leaving out the optional Id.
+func RecentlyViewedHandler(w http.ResponseWriter, r *http.Request) error {
+	exclude, _ := strconv.ParseInt(r.FormValue("Id"), 10, 64)
+	products, err := recentlyViewed(r, exclude)
+	if err != nil {
+		return Internal(err, "Recently viewed products are unavailable right now.")
+	}
+	pr, err := pricerFor(r)
+	if err != nil {
+		return err
+	}
+	localizeProducts(r, products)
+	encoder := json.NewEncoder(w)
+	return encoder.Encode(pr.PriceAll(products))
+}
+
+// RecommendationsHandler returns the products of one kind recommended with
+// product Id as JSON.
+func RecommendationsHandler(kind string) func(w http.ResponseWriter, r *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		id, err := strconv.ParseInt(r.FormValue("Id"), 10, 64)
+		if err != nil {
+			return Validation("Invalid product id %q.", r.FormValue("Id"))
+		}
+		products, err := recommended(dbFor(r), id, kind)
+		if err != nil {
+			return Internal(err, "Recommendations are unavailable right now.")
+		}
+		pr, err := pricerFor(r)
+		if err != nil {
+			return err
+		}
+		localizeProducts(r, products)
+		encoder := json.NewEncoder(w)
+		return encoder.Encode(pr.PriceAll(products))
+	}
+}
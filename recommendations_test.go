@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestSimilarity(t *testing.T) {
+	drill := Product{Category: "Tools", Brand: "SuperTool", PriceAmount: 1000, PriceCurrency: "USD"}
+	tests := []struct {
+		name string
+		b    Product
+		want float64
+	}{
+		{"category, brand and price", Product{Category: "Tools", Brand: "supertool", PriceAmount: 2000, PriceCurrency: "USD"}, 3.5},
+		{"category and same price", Product{Category: "Tools", PriceAmount: 1000, PriceCurrency: "USD"}, 3},
+		{"brand only", Product{Category: "Garden", Brand: "SuperTool", PriceAmount: 500, PriceCurrency: "USD"}, 1.5},
+		{"other currency", Product{Category: "Tools", PriceAmount: 1000, PriceCurrency: "EUR"}, 2},
+		{"nothing in common", Product{Category: "Garden", Brand: "Other", PriceAmount: 1000, PriceCurrency: "USD"}, 0},
+		{"empty category", Product{PriceAmount: 1000, PriceCurrency: "USD"}, 0},
+	}
+	for _, tt := range tests {
+		if got := similarity(drill, tt.b); got != tt.want {
+			t.Errorf("%s: similarity = %v, want %v", tt.name, got, tt.want)
+		}
+		if got := similarity(tt.b, drill); got != tt.want {
+			t.Errorf("%s: similarity reversed = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// layoutFiles are shared by every page; the rest of the templates
+// directory holds one page per file defining "content".
+var layoutFiles = map[string]bool{
+	"base.html":         true,
+	"currency.html":     true,
+	"header.html":       true,
+	"header_admin.html": true,
+	"footer.html":       true,
+	"meta.html":         true,
+}
+
+// templateFuncs are available to every page template.
+var templateFuncs = template.FuncMap{
+	"formGuard": formGuard,
+	"formTime":  formTime,
+	"taxNote":   taxNote,
+}
+
+// pageSet maps a page name to its parsed template.
+type pageSet map[string]*template.Template
+
+// Renderer holds every page parsed once with the visitor header and once
+// with the admin header, for each locale, since the functions of the
+// locale are bound at parse time.
+type Renderer struct {
+	dir    string
+	reload bool
+
+	mu      sync.RWMutex
+	visitor map[string]pageSet // by locale
+	admin   map[string]pageSet
+}
+
+var renderer *Renderer
+
+// NewRenderer parses all templates in dir. With reload set the templates
+// are parsed again on every render, which is handy while editing them.
+func NewRenderer(dir string, reload bool) (*Renderer, error) {
+	rd := &Renderer{dir: dir, reload: reload}
+	if err := rd.load(); err != nil {
+		return nil, err
+	}
+	return rd, nil
+}
+
+func (rd *Renderer) load() error {
+	files, err := filepath.Glob(filepath.Join(rd.dir, "*.html"))
+	if err != nil {
+		return err
+	}
+	locales := config.Locales
+	if !contains(locales, config.Locale) {
+		locales = append([]string{config.Locale}, locales...)
+	}
+	visitor := map[string]pageSet{}
+	admin := map[string]pageSet{}
+	for _, locale := range locales {
+		visitor[locale], admin[locale] = pageSet{}, pageSet{}
+		for _, f := range files {
+			name := filepath.Base(f)
+			if layoutFiles[name] {
+				continue
+			}
+			page := strings.TrimSuffix(name, ".html")
+			if visitor[locale][page], err = rd.parse(locale, "header.html", name); err != nil {
+				return err
+			}
+			if admin[locale][page], err = rd.parse(locale, "header_admin.html", name); err != nil {
+				return err
+			}
+		}
+	}
+	rd.mu.Lock()
+	rd.visitor, rd.admin = visitor, admin
+	rd.mu.Unlock()
+	return nil
+}
+
+func (rd *Renderer) parse(locale, header, page string) (*template.Template, error) {
+	// The page goes last so that its blocks override the defaults in
+	// base.html.
+	tmpl, err := template.New("").Funcs(templateFuncs).Funcs(localeFuncs(locale)).ParseFiles(
+		filepath.Join(rd.dir, "base.html"),
+		filepath.Join(rd.dir, "meta.html"),
+		filepath.Join(rd.dir, header),
+		filepath.Join(rd.dir, "footer.html"),
+		filepath.Join(rd.dir, "currency.html"),
+		filepath.Join(rd.dir, page))
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %v", page, err)
+	}
+	return tmpl, nil
+}
+
+// Check reports whether the templates can be rendered.
+func (rd *Renderer) Check() error {
+	if rd.reload {
+		return rd.load()
+	}
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+	if len(rd.visitor[config.Locale]) == 0 {
+		return fmt.Errorf("no templates loaded from %s", rd.dir)
+	}
+	return nil
+}
+
+// Render writes page (the template file name without .html) wrapped in
+// the site layout. Administrators get the header with the Manage link.
+func (rd *Renderer) Render(w http.ResponseWriter, r *http.Request, page string, data interface{}) error {
+	return rd.RenderStatus(w, r, http.StatusOK, page, data)
+}
+
+// RenderStatus is Render with an explicit status code.
+func (rd *Renderer) RenderStatus(w http.ResponseWriter, r *http.Request, status int, page string, data interface{}) error {
+	if rd.reload {
+		if err := rd.load(); err != nil {
+			return err
+		}
+	}
+	isAdmin := VerifyAdmin(w, r)
+	rd.mu.RLock()
+	sets := rd.visitor
+	if isAdmin {
+		sets = rd.admin
+	}
+	set, ok := sets[localeFor(r)]
+	if !ok {
+		set = sets[config.Locale]
+	}
+	tmpl, ok := set[page]
+	rd.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown page template %q", page)
+	}
+	// Render into a buffer so a failing template does not leave a half
+	// written page behind.
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, "base", data); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	_, err := buf.WriteTo(w)
+	return err
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTemplates creates a templates directory with a minimal layout and
+// the given pages.
+func writeTemplates(t *testing.T, pages map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{
+		"base.html":         `{{define "base"}}<html>{{template "headerHTML" .User}}{{template "content" .Content}}{{template "footerHTML"}}</html>{{end}}`,
+		"meta.html":         `{{define "metaHTML"}}{{end}}`,
+		"header.html":       `{{define "headerHTML"}}[visitor]{{end}}`,
+		"header_admin.html": `{{define "headerHTML"}}[admin]{{end}}`,
+		"footer.html":       `{{define "footerHTML"}}[footer]{{end}}`,
+		"currency.html":     `{{define "currencyPicker"}}{{end}}`,
+	}
+	for name, text := range pages {
+		files[name] = text
+	}
+	for name, text := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestRendererLoad(t *testing.T) {
+	setLocales(t)
+	saved := catalogs
+	t.Cleanup(func() { catalogs = saved })
+	catalogs = map[string]map[string]string{"de": {"Hello": "Hallo"}}
+
+	dir := writeTemplates(t, map[string]string{"hello.html": `{{define "content"}}{{t "Hello"}} {{.}}{{end}}`})
+	rd, err := NewRenderer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rd.Check(); err != nil {
+		t.Errorf("Check: %v", err)
+	}
+	tests := []struct {
+		sets   map[string]pageSet
+		locale string
+		want   string
+	}{
+		{rd.visitor, "en", "<html>[visitor]Hello Ada[footer]</html>"},
+		{rd.visitor, "de", "<html>[visitor]Hallo Ada[footer]</html>"},
+		{rd.admin, "fr", "<html>[admin]Hello Ada[footer]</html>"},
+	}
+	for _, tt := range tests {
+		if len(tt.sets[tt.locale]) != 1 {
+			t.Errorf("%s: pages %v, want only hello", tt.locale, tt.sets[tt.locale])
+		}
+		tmpl, ok := tt.sets[tt.locale]["hello"]
+		if !ok {
+			t.Errorf("%s: hello not loaded", tt.locale)
+			continue
+		}
+		var buf bytes.Buffer
+		if err := tmpl.ExecuteTemplate(&buf, "base", struct{ User, Content string }{"", "Ada"}); err != nil {
+			t.Errorf("%s: %v", tt.locale, err)
+			continue
+		}
+		if got := buf.String(); got != tt.want {
+			t.Errorf("%s: rendered %q, want %q", tt.locale, got, tt.want)
+		}
+	}
+}
+
+func TestRendererErrors(t *testing.T) {
+	setLocales(t)
+	dir := writeTemplates(t, map[string]string{"broken.html": `{{define "content"}}{{if}}{{end}}`})
+	if _, err := NewRenderer(dir, false); err == nil || !strings.Contains(err.Error(), "broken.html") {
+		t.Errorf("NewRenderer with a broken page: %v, want an error naming it", err)
+	}
+	rd, err := NewRenderer(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rd.Check(); err == nil {
+		t.Error("Check passed without templates")
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	gmux "github.com/gorilla/mux"
+)
+
+// Review states. Customers only see approved reviews, and only those count
+// towards the rating of a product.
+const (
+	ReviewPending  = "pending"
+	ReviewApproved = "approved"
+	ReviewRejected = "rejected"
+)
+
+var reviewStatuses = []string{ReviewPending, ReviewApproved, ReviewRejected}
+
+// reviewsShown is how many reviews a product page lists, most helpful
+// first.
+const reviewsShown = 50
+
+// Review is a customer's rating of a product. Every user can review a
+// product once.
+type Review struct {
+	Id          int64      `db:"Id"`
+	ProductId   int64      `db:"ProductId"`
+	Username    string     `db:"Username"`
+	Author      string     `db:"Author,size:100" form:"author" label:"Name" validate:"required,max=100"` // shown instead of the username
+	Rating      int        `db:"Rating" form:"rating" validate:"required,min=1,max=5"`
+	Title       string     `db:"Title,size:150" form:"title" validate:"required,max=150"`
+	Body        string     `db:"Body,size:5000" form:"body" label:"Review" validate:"required,max=5000"`
+	Verified    bool       `db:"Verified"` // the author bought the product, confirmed by a moderator
+	Status      string     `db:"Status,size:16"`
+	Helpful     int        `db:"Helpful"` // votes, see ReviewVote
+	Created     time.Time  `db:"Created"`
+	Moderated   *time.Time `db:"Moderated"`
+	ModeratedBy string     `db:"ModeratedBy"`
+}
+
+// Anchor is the fragment linking straight to the review.
+func (rv Review) Anchor() string {
+	return "review-" + strconv.FormatInt(rv.Id, 10)
+}
+
+// Stars draws the rating, e.g. "★★★★☆".
+func (rv Review) Stars() string {
+	return strings.Repeat("★", rv.Rating) + strings.Repeat("☆", 5-rv.Rating)
+}
+
+// moderate sets the review's status and whether its author bought the
+// product. It reports whether the product's rating changes, which is when
+// the review is approved or stops being approved.
+func (rv *Review) moderate(status string, verified bool, by string, at time.Time) (bool, error) {
+	if !contains(reviewStatuses, status) {
+		return false, Validation("Unknown status %q.", status)
+	}
+	rated := (rv.Status == ReviewApproved) != (status == ReviewApproved)
+	rv.Status, rv.Verified = status, verified
+	rv.Moderated, rv.ModeratedBy = &at, by
+	return rated, nil
+}
+
+// ReviewVote is a user finding a review helpful.
+type ReviewVote struct {
+	Id       int64     `db:"Id"`
+	ReviewId int64     `db:"ReviewId"`
+	Username string    `db:"Username"`
+	Created  time.Time `db:"Created"`
+}
+
+// updateProductRating stores the average rating and the number of
+// approved reviews on the product, so listings need not add them up.
+func updateProductRating(db *meteredDbMap, productId int64) error {
+	_, err := db.Exec("UPDATE products SET "+
+		"RatingCount=(SELECT count(*) FROM reviews WHERE ProductId=? AND Status='approved'), "+
+		"RatingAverage=(SELECT COALESCE(AVG(Rating), 0) FROM reviews WHERE ProductId=? AND Status='approved') WHERE Id=?",
+		productId, productId, productId)
+	return err
+}
+
+// ProductReviews is the review section of a product page.
+type ProductReviews struct {
+	Reviews   []Review
+	Voted     map[int64]bool // reviews the visitor found helpful
+	LoggedIn  bool
+	Own       *Review // the visitor's review, whatever its status
+	Submitted bool    // the visitor just sent a review
+	Form      Review
+	Ratings   []int // the choices of the rating input, best first
+	Error     string
+	Fields    map[string]string
+}
+
+// productReviews loads the review section of p for the visitor. form and
+// err are a rejected review to show again.
+func productReviews(r *http.Request, p Product, form Review, err error) (ProductReviews, error) {
+	db, username := dbFor(r), getStringFromSession(r, "User")
+	pr := ProductReviews{LoggedIn: username != "", Form: form, Voted: map[int64]bool{}, Submitted: r.FormValue("review") == "submitted"}
+	pr.Ratings = []int{5, 4, 3, 2, 1}
+	if _, lerr := db.Select(&pr.Reviews, "SELECT * FROM reviews WHERE ProductId=? AND Status='approved' ORDER BY Helpful DESC, Created DESC LIMIT ?", p.Id, reviewsShown); lerr != nil {
+		return pr, lerr
+	}
+	if username != "" {
+		var own []Review
+		if _, lerr := db.Select(&own, "SELECT * FROM reviews WHERE ProductId=? AND Username=?", p.Id, username); lerr != nil {
+			return pr, lerr
+		}
+		if len(own) > 0 {
+			pr.Own = &own[0]
+		}
+		var votes []ReviewVote
+		if _, lerr := db.Select(&votes, "SELECT v.* FROM reviewvotes v JOIN reviews r ON r.Id=v.ReviewId WHERE r.ProductId=? AND v.Username=?", p.Id, username); lerr != nil {
+			return pr, lerr
+		}
+		for _, v := range votes {
+			pr.Voted[v.ReviewId] = true
+		}
+	}
+	if err != nil {
+		errs := formErrors(err)
+		pr.Error, pr.Fields = errs.Error, errs.Fields
+	}
+	return pr, nil
+}
+
+// SubmitReviewHandler takes a review of {id} from a logged-in user and
+// queues it for moderation.
+func SubmitReviewHandler(w http.ResponseWriter, r *http.Request) error {
+	username, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+	p, err := loadProduct(r)
+	if err != nil {
+		return err
+	}
+	rv := &Review{ProductId: p.Id, Username: username}
+	if err := bind(r, rv); err != nil {
+		return renderProductPage(w, r, http.StatusBadRequest, *p, productForms{Review: *rv, ReviewErr: err})
+	}
+	if err := checkAbuse(newSubmission(r, "review", username, rv.Title+"\n"+rv.Body)); err != nil {
+		return renderProductPage(w, r, http.StatusBadRequest, *p, productForms{Review: *rv, ReviewErr: err})
+	}
+	count, err := dbFor(r).SelectInt("SELECT count(*) FROM reviews WHERE ProductId=? AND Username=?", p.Id, username)
+	if err != nil {
+		return Internal(err, "Your review could not be saved.")
+	}
+	if count > 0 {
+		return Conflict("You have already reviewed this product.")
+	}
+	rv.Status, rv.Created = ReviewPending, time.Now()
+	if err := dbFor(r).Insert(rv); err != nil {
+		return Internal(err, "Your review could not be saved.")
+	}
+	http.Redirect(w, r, productPath(*p)+"?review=submitted#reviews", http.StatusSeeOther)
+	return nil
+}
+
+// HelpfulReviewHandler counts the visitor finding review {id} helpful,
+// once per user.
+func HelpfulReviewHandler(w http.ResponseWriter, r *http.Request) error {
+	username, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+	id, _ := strconv.ParseInt(gmux.Vars(r)["id"], 10, 64)
+	db := dbFor(r)
+	obj, err := db.Get(Review{}, id)
+	if err != nil {
+		return Internal(err, "Your vote could not be saved.")
+	}
+	if obj == nil || obj.(*Review).Status != ReviewApproved {
+		return NotFound("Review %d does not exist.", id)
+	}
+	rv := obj.(*Review)
+	if rv.Username == username {
+		return Validation("You cannot vote for your own review.")
+	}
+	voted, err := db.SelectInt("SELECT count(*) FROM reviewvotes WHERE ReviewId=? AND Username=?", rv.Id, username)
+	if err != nil {
+		return Internal(err, "Your vote could not be saved.")
+	}
+	if voted == 0 {
+		if err := db.Insert(&ReviewVote{ReviewId: rv.Id, Username: username, Created: time.Now()}); err != nil {
+			return Internal(err, "Your vote could not be saved.")
+		}
+		if _, err := db.Exec("UPDATE reviews SET Helpful=(SELECT count(*) FROM reviewvotes WHERE ReviewId=?) WHERE Id=?", rv.Id, rv.Id); err != nil {
+			return Internal(err, "Your vote could not be saved.")
+		}
+	}
+	prod, err := db.Get(Product{}, rv.ProductId)
+	if err != nil || prod == nil {
+		http.Redirect(w, r, "/products/", http.StatusSeeOther)
+		return nil
+	}
+	http.Redirect(w, r, productPath(*prod.(*Product))+"#"+rv.Anchor(), http.StatusSeeOther)
+	return nil
+}
+
+// ReviewRow is a review in the moderation queue.
+type ReviewRow struct {
+	Review      Review
+	ProductName string
+	ProductURL  string
+}
+
+type ReviewQueue struct {
+	Status   string
+	Statuses []string
+	Counts   map[string]int64
+	Reviews  []ReviewRow
+}
+
+type ReviewQueuePage struct {
+	User    string
+	Content ReviewQueue
+}
+
+type reviewStatusCount struct {
+	Status string
+	Count  int64
+}
+
+// ManageReviewsHandler is the moderation queue: pending reviews, oldest
+// first, or those with ?status=.
+func ManageReviewsHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	q := ReviewQueue{Status: r.FormValue("status"), Statuses: reviewStatuses, Counts: map[string]int64{}}
+	if !contains(reviewStatuses, q.Status) {
+		q.Status = ReviewPending
+	}
+	order := "Created DESC"
+	if q.Status == ReviewPending {
+		order = "Created"
+	}
+	db := dbFor(r)
+	var reviews []Review
+	if _, err := db.Select(&reviews, "SELECT * FROM reviews WHERE Status=? ORDER BY "+order, q.Status); err != nil {
+		return Internal(err, "Reviews are unavailable right now.")
+	}
+	var counts []reviewStatusCount
+	if _, err := db.Select(&counts, "SELECT Status, count(*) AS Count FROM reviews GROUP BY Status"); err != nil {
+		return Internal(err, "Reviews are unavailable right now.")
+	}
+	for _, c := range counts {
+		q.Counts[c.Status] = c.Count
+	}
+	var products []Product
+	if _, err := db.Select(&products, "SELECT * FROM products"); err != nil {
+		return Internal(err, "Reviews are unavailable right now.")
+	}
+	byId := map[int64]Product{}
+	for _, p := range products {
+		byId[p.Id] = p
+	}
+	for _, rv := range reviews {
+		row := ReviewRow{Review: rv}
+		if p, ok := byId[rv.ProductId]; ok {
+			row.ProductName, row.ProductURL = p.Name, productPath(p)
+		}
+		q.Reviews = append(q.Reviews, row)
+	}
+	return renderer.Render(w, r, "manage_reviews", ReviewQueuePage{User: getStringFromSession(r, "User"), Content: q})
+}
+
+// ModerateReviewHandler approves or rejects a review and sets whether its
+// author bought the product, then updates the product's rating.
+func ModerateReviewHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	id, _ := strconv.ParseInt(gmux.Vars(r)["id"], 10, 64)
+	db := dbFor(r)
+	obj, err := db.Get(Review{}, id)
+	if err != nil {
+		return Internal(err, "The review could not be loaded.")
+	}
+	if obj == nil {
+		return NotFound("Review %d does not exist.", id)
+	}
+	rv := obj.(*Review)
+	from := rv.Status
+	rated, err := rv.moderate(r.FormValue("status"), r.FormValue("verified") != "", getStringFromSession(r, "User"), time.Now())
+	if err != nil {
+		return err
+	}
+	if _, err := db.Update(rv); err != nil {
+		return Internal(err, "The review could not be saved.")
+	}
+	if rated {
+		if err := updateProductRating(db, rv.ProductId); err != nil {
+			return Internal(err, "The product rating could not be updated.")
+		}
+	}
+	http.Redirect(w, r, "/manage/reviews/?status="+from, http.StatusSeeOther)
+	return nil
+}
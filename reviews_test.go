@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReviewStars(t *testing.T) {
+	tests := []struct {
+		rating int
+		want   string
+	}{
+		{1, "★☆☆☆☆"},
+		{4, "★★★★☆"},
+		{5, "★★★★★"},
+	}
+	for _, tt := range tests {
+		if got := (Review{Rating: tt.rating}).Stars(); got != tt.want {
+			t.Errorf("Stars(%d) = %q, want %q", tt.rating, got, tt.want)
+		}
+	}
+}
+
+func TestModerateReview(t *testing.T) {
+	at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		from, to  string
+		wantRated bool
+		wantErr   bool
+	}{
+		{ReviewPending, ReviewApproved, true, false},
+		{ReviewPending, ReviewRejected, false, false},
+		{ReviewApproved, ReviewRejected, true, false},
+		{ReviewApproved, ReviewPending, true, false},
+		{ReviewApproved, ReviewApproved, false, false},
+		{ReviewRejected, ReviewApproved, true, false},
+		{ReviewRejected, ReviewPending, false, false},
+		{ReviewPending, "deleted", false, true},
+	}
+	for _, tt := range tests {
+		rv := Review{Status: tt.from}
+		rated, err := rv.moderate(tt.to, true, "admin", at)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s -> %s: err = %v, want error %v", tt.from, tt.to, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			if rv.Status != tt.from || rv.Moderated != nil {
+				t.Errorf("%s -> %s: review changed to %+v", tt.from, tt.to, rv)
+			}
+			continue
+		}
+		if rated != tt.wantRated {
+			t.Errorf("%s -> %s: rating changed %v, want %v", tt.from, tt.to, rated, tt.wantRated)
+		}
+		if rv.Status != tt.to || !rv.Verified || rv.ModeratedBy != "admin" || rv.Moderated == nil || !rv.Moderated.Equal(at) {
+			t.Errorf("%s -> %s: review left as %+v", tt.from, tt.to, rv)
+		}
+	}
+}
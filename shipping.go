@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+)
+
+// Shipment is what a shipping rate is calculated for.
+type Shipment struct {
+	Items       []CartItem
+	Subtotal    Money
+	Weight      int // grams, the larger of actual and volumetric weight
+	Destination Address
+}
+
+// ShippingRateProvider prices a shipment in the base currency. ok is false
+// when it cannot ship this one, for instance because it is too heavy.
+type ShippingRateProvider interface {
+	Rate(s Shipment) (rate Money, ok bool)
+}
+
+// Shipping rates are set in minor units of the base currency and
+// converted to the currency of the cart.
+func baseMoney(amount int64) Money {
+	return Money{amount, config.Currency}
+}
+
+// FlatRate charges the same whatever is in the parcel.
+type FlatRate struct {
+	Amount int64
+}
+
+func (f FlatRate) Rate(s Shipment) (Money, bool) {
+	return baseMoney(f.Amount), true
+}
+
+// WeightBased charges Base plus PerKg for every started kilogram, up to
+// MaxKg when it is set.
+type WeightBased struct {
+	Base  int64
+	PerKg int64
+	MaxKg int
+}
+
+func (wb WeightBased) Rate(s Shipment) (Money, bool) {
+	kg := int(math.Ceil(float64(s.Weight) / 1000))
+	if wb.MaxKg > 0 && kg > wb.MaxKg {
+		return Money{}, false
+	}
+	return baseMoney(wb.Base + wb.PerKg*int64(kg)), true
+}
+
+// FreeOver ships for free once the subtotal reaches Threshold and charges
+// Otherwise below it.
+type FreeOver struct {
+	Threshold int64
+	Otherwise ShippingRateProvider
+}
+
+func (f FreeOver) Rate(s Shipment) (Money, bool) {
+	if threshold, ok := convert(baseMoney(f.Threshold), s.Subtotal.Currency); ok && s.Subtotal.Amount >= threshold.Amount {
+		return baseMoney(0), true
+	}
+	return f.Otherwise.Rate(s)
+}
+
+// ShippingZone groups destinations that cost the same to ship to.
+// Regions are "CC-RR" codes and win over whole countries.
+type ShippingZone struct {
+	Code      string
+	Name      string
+	Countries []string
+	Regions   []string
+}
+
+var shippingZones = []ShippingZone{
+	{Code: "us-remote", Name: "Alaska, Hawaii and US territories", Regions: []string{"US-AK", "US-HI", "US-PR", "US-GU", "US-VI", "US-AS", "US-MP"}},
+	{Code: "us", Name: "United States", Countries: []string{"US"}},
+	{Code: "north-america", Name: "Canada and Mexico", Countries: []string{"CA", "MX"}},
+	{Code: "europe", Name: "Europe", Countries: []string{"GB", "IE", "DE", "FR", "NL"}},
+	{Code: "asia-pacific", Name: "Asia Pacific", Countries: []string{"AU", "NZ", "CN", "JP", "HK"}},
+}
+
+// zoneFor returns the zone covering a destination, or nil.
+func zoneFor(a Address) *ShippingZone {
+	region := a.Country + "-" + a.Region
+	for i, z := range shippingZones {
+		if a.Region != "" && contains(z.Regions, region) {
+			return &shippingZones[i]
+		}
+	}
+	for i, z := range shippingZones {
+		if contains(z.Countries, a.Country) {
+			return &shippingZones[i]
+		}
+	}
+	return nil
+}
+
+// ShippingMethod is a delivery option with a rate per zone it serves.
+type ShippingMethod struct {
+	Code  string
+	Name  string
+	Days  string
+	Rates map[string]ShippingRateProvider // by zone code
+}
+
+var shippingMethods = []ShippingMethod{
+	{Code: "standard", Name: "Standard", Days: "3-7 business days", Rates: map[string]ShippingRateProvider{
+		"us":            FreeOver{5000, WeightBased{Base: 499, PerKg: 100}},
+		"us-remote":     WeightBased{Base: 999, PerKg: 250},
+		"north-america": WeightBased{Base: 1299, PerKg: 300, MaxKg: 30},
+		"europe":        WeightBased{Base: 1999, PerKg: 500, MaxKg: 30},
+		"asia-pacific":  WeightBased{Base: 2499, PerKg: 600, MaxKg: 30},
+	}},
+	{Code: "express", Name: "Express", Days: "1-2 business days", Rates: map[string]ShippingRateProvider{
+		"us":            WeightBased{Base: 1499, PerKg: 200, MaxKg: 30},
+		"us-remote":     WeightBased{Base: 2499, PerKg: 400, MaxKg: 20},
+		"north-america": FlatRate{3999},
+	}},
+}
+
+// volumetricDivisor turns cubic centimetres into kilograms the way the
+// carriers do.
+const volumetricDivisor = 5000
+
+// shipmentWeight is the billable weight of items in grams.
+func shipmentWeight(items []CartItem) int {
+	var grams, volumetric float64
+	for _, item := range items {
+		p := item.Product
+		q := float64(item.Quantity)
+		grams += float64(p.Weight) * q
+		cm3 := float64(p.Length) * float64(p.Width) * float64(p.Height) / 1000
+		volumetric += cm3 / volumetricDivisor * 1000 * q
+	}
+	return int(math.Ceil(math.Max(grams, volumetric)))
+}
+
+// cartSubtotal adds up items, which loadCart priced in one currency.
+func cartSubtotal(items []CartItem) Money {
+	total := Money{Currency: items[0].Price.Currency}
+	for _, item := range items {
+		total = total.Add(item.Price.Mul(item.Quantity))
+	}
+	return total
+}
+
+// ShippingOption is a method the cart can offer, with its price.
+type ShippingOption struct {
+	Code string
+	Name string
+	Days string
+	Rate Money
+}
+
+// shippingOptions prices every method that serves the destination of s,
+// in the currency of its subtotal.
+func shippingOptions(s Shipment) ([]ShippingOption, *ShippingZone) {
+	zone := zoneFor(s.Destination)
+	if zone == nil {
+		return nil, nil
+	}
+	var options []ShippingOption
+	for _, m := range shippingMethods {
+		provider, ok := m.Rates[zone.Code]
+		if !ok {
+			continue
+		}
+		rate, ok := provider.Rate(s)
+		if ok {
+			rate, ok = convert(rate, s.Subtotal.Currency)
+		}
+		if ok {
+			options = append(options, ShippingOption{Code: m.Code, Name: m.Name, Days: m.Days, Rate: rate})
+		}
+	}
+	return options, zone
+}
+
+// availableShipping is shippingOptions with the reason as an error when
+// nothing can ship s.
+func availableShipping(s Shipment) ([]ShippingOption, *ShippingZone, error) {
+	options, zone := shippingOptions(s)
+	if zone == nil {
+		return nil, nil, Validation("Sorry, we do not ship to %s yet.", s.Destination.Country)
+	}
+	if len(options) == 0 {
+		return nil, nil, Validation("Sorry, this order is too heavy to ship to %s. Please split it up.", zone.Name)
+	}
+	return options, zone, nil
+}
+
+// chooseShipping picks the option with code, or the cheapest when code
+// is empty.
+func chooseShipping(options []ShippingOption, code string) (ShippingOption, error) {
+	if code == "" {
+		cheapest := options[0]
+		for _, o := range options[1:] {
+			if o.Rate.Amount < cheapest.Rate.Amount {
+				cheapest = o
+			}
+		}
+		return cheapest, nil
+	}
+	for _, o := range options {
+		if o.Code == code {
+			return o, nil
+		}
+	}
+	return ShippingOption{}, Validation("Shipping method %q is not available for this order.", code)
+}
+
+// newShipment loads the cart of req, priced in the visitor's currency,
+// and where it is going.
+func newShipment(r *http.Request, req CartRequest) (Shipment, error) {
+	pr, err := pricerFor(r)
+	if err != nil {
+		return Shipment{}, err
+	}
+	items, err := loadCart(dbFor(r), pr, req.Lines)
+	if err != nil {
+		return Shipment{}, err
+	}
+	dest, err := req.destination(r)
+	if err != nil {
+		return Shipment{}, err
+	}
+	return Shipment{Items: items, Subtotal: cartSubtotal(items), Weight: shipmentWeight(items), Destination: dest}, nil
+}
+
+type ShippingQuote struct {
+	Zone     string
+	Subtotal Money
+	Weight   int
+	Options  []ShippingOption
+}
+
+// ShippingQuoteHandler lists the shipping options for a cart, so the
+// customer can pick one before placing the order.
+func ShippingQuoteHandler(w http.ResponseWriter, r *http.Request) error {
+	req, err := parseCartRequest(r)
+	if err != nil {
+		return err
+	}
+	s, err := newShipment(r, req)
+	if err != nil {
+		return err
+	}
+	options, zone, err := availableShipping(s)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	return encoder.Encode(ShippingQuote{Zone: zone.Name, Subtotal: s.Subtotal, Weight: s.Weight, Options: options})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// setCurrency makes USD the base currency until the test ends.
+func setCurrency(t *testing.T) {
+	t.Helper()
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.Currency = "USD"
+}
+
+func TestShippingRateProviders(t *testing.T) {
+	setCurrency(t)
+	weightBased := WeightBased{Base: 499, PerKg: 100, MaxKg: 30}
+	tests := []struct {
+		name     string
+		provider ShippingRateProvider
+		weight   int
+		subtotal int64
+		want     int64
+		wantOK   bool
+	}{
+		{"flat", FlatRate{3999}, 50000, 100, 3999, true},
+		{"empty parcel", weightBased, 0, 100, 499, true},
+		{"one gram is a started kilogram", weightBased, 1, 100, 599, true},
+		{"exactly one kilogram", weightBased, 1000, 100, 599, true},
+		{"just over", weightBased, 1001, 100, 699, true},
+		{"at the limit", weightBased, 30000, 100, 3499, true},
+		{"over the limit", weightBased, 30001, 100, 0, false},
+		{"no limit", WeightBased{Base: 999, PerKg: 250}, 100000, 100, 25999, true},
+		{"below free threshold", FreeOver{5000, weightBased}, 2500, 4999, 799, true},
+		{"at free threshold", FreeOver{5000, weightBased}, 2500, 5000, 0, true},
+		{"free threshold ignores the weight limit", FreeOver{5000, weightBased}, 40000, 6000, 0, true},
+		{"too heavy below threshold", FreeOver{5000, weightBased}, 40000, 100, 0, false},
+	}
+	for _, tt := range tests {
+		s := Shipment{Weight: tt.weight, Subtotal: Money{tt.subtotal, "USD"}}
+		got, ok := tt.provider.Rate(s)
+		if ok != tt.wantOK || (ok && got != (Money{tt.want, "USD"})) {
+			t.Errorf("%s: Rate = %v, %v; want %d, %v", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestZoneFor(t *testing.T) {
+	tests := []struct {
+		country, region string
+		want            string
+	}{
+		{"US", "CA", "us"},
+		{"US", "", "us"},
+		{"US", "AK", "us-remote"},
+		{"US", "PR", "us-remote"},
+		{"CA", "AK", "north-america"},
+		{"DE", "", "europe"},
+		{"JP", "13", "asia-pacific"},
+		{"BR", "", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if z := zoneFor(Address{Country: tt.country, Region: tt.region}); z != nil {
+			got = z.Code
+		}
+		if got != tt.want {
+			t.Errorf("zoneFor(%s, %s) = %q, want %q", tt.country, tt.region, got, tt.want)
+		}
+	}
+}
+
+func TestShipmentWeight(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []CartItem
+		want  int
+	}{
+		{"nothing", nil, 0},
+		{"actual weight", []CartItem{{Product: Product{Weight: 1200, Length: 100, Width: 100, Height: 100}, Quantity: 2}}, 2400},
+		// 400 x 300 x 200 mm is 24000 cm³, billed as 4.8 kg.
+		{"volumetric weight", []CartItem{{Product: Product{Weight: 500, Length: 400, Width: 300, Height: 200}, Quantity: 1}}, 4800},
+		{"summed over items", []CartItem{
+			{Product: Product{Weight: 500, Length: 400, Width: 300, Height: 200}, Quantity: 1},
+			{Product: Product{Weight: 6000}, Quantity: 1},
+		}, 6500},
+	}
+	for _, tt := range tests {
+		if got := shipmentWeight(tt.items); got != tt.want {
+			t.Errorf("%s: shipmentWeight = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestShippingOptions(t *testing.T) {
+	setCurrency(t)
+	tests := []struct {
+		country, region string
+		weight          int
+		subtotal        int64
+		want            string // code=rate, in order
+		wantErr         bool
+	}{
+		{"US", "CA", 1000, 2000, "standard=599,express=1699", false},
+		{"US", "CA", 1000, 6000, "standard=0,express=1699", false},
+		{"US", "HI", 2500, 2000, "standard=1749,express=3699", false},
+		{"CA", "ON", 500, 2000, "standard=1599,express=3999", false},
+		{"FR", "", 2000, 2000, "standard=2999", false},
+		{"FR", "", 31000, 2000, "", true},
+		{"BR", "", 1000, 2000, "", true},
+	}
+	for _, tt := range tests {
+		s := Shipment{Weight: tt.weight, Subtotal: Money{tt.subtotal, "USD"}, Destination: Address{Country: tt.country, Region: tt.region}}
+		options, _, err := availableShipping(s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s %d g: err = %v, want error %v", tt.country, tt.weight, err, tt.wantErr)
+			continue
+		}
+		var got []string
+		for _, o := range options {
+			got = append(got, o.Code+"="+strconv.FormatInt(o.Rate.Amount, 10))
+		}
+		if strings.Join(got, ",") != tt.want {
+			t.Errorf("%s %d g: options %v, want %s", tt.country, tt.weight, got, tt.want)
+		}
+	}
+}
+
+func TestChooseShipping(t *testing.T) {
+	options := []ShippingOption{
+		{Code: "standard", Rate: Money{799, "USD"}},
+		{Code: "express", Rate: Money{1699, "USD"}},
+		{Code: "economy", Rate: Money{499, "USD"}},
+	}
+	tests := []struct {
+		code    string
+		want    string
+		wantErr bool
+	}{
+		{"", "economy", false},
+		{"express", "express", false},
+		{"overnight", "", true},
+	}
+	for _, tt := range tests {
+		got, err := chooseShipping(options, tt.code)
+		if (err != nil) != tt.wantErr || got.Code != tt.want {
+			t.Errorf("chooseShipping(%q) = %q, %v; want %q", tt.code, got.Code, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gmux "github.com/gorilla/mux"
+)
+
+const (
+	// sitemapMaxURLs is the per-file limit from the sitemaps protocol.
+	// Larger catalogs are split into numbered files behind an index.
+	sitemapMaxURLs = 50000
+	// sitemapTTL bounds how stale the cache can get when the catalog is
+	// changed by another instance.
+	sitemapTTL = time.Hour
+)
+
+// staticPages are listed in the sitemap alongside the catalog.
+var staticPages = []string{"/", "/products/", "/search/", "/about/", "/FAQ/", "/contact/"}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"sitemapindex"`
+	Xmlns    string       `xml:"xmlns,attr"`
+	Sitemaps []sitemapURL `xml:"sitemap"`
+}
+
+// sitemapCache holds the rendered sitemap files until the catalog changes.
+type sitemapCache struct {
+	mu    sync.Mutex
+	built time.Time
+	files [][]byte // files[0] is /sitemap.xml, the rest /sitemap-N.xml
+}
+
+var sitemaps = &sitemapCache{}
+
+// invalidate drops the cached sitemap; it is rebuilt on the next request.
+func (c *sitemapCache) invalidate() {
+	c.mu.Lock()
+	c.files = nil
+	c.mu.Unlock()
+}
+
+func (c *sitemapCache) get(r *http.Request) ([][]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.files != nil && time.Since(c.built) < sitemapTTL {
+		return c.files, nil
+	}
+	urls, err := sitemapURLs(r)
+	if err != nil {
+		return nil, err
+	}
+	files, err := buildSitemaps(urls)
+	if err != nil {
+		return nil, err
+	}
+	c.files, c.built = files, time.Now()
+	return files, nil
+}
+
+func sitemapDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format("2006-01-02")
+}
+
+// sitemapURLs lists static pages, content pages, categories and products.
+func sitemapURLs(r *http.Request) ([]sitemapURL, error) {
+	urls := []sitemapURL{}
+	for _, path := range staticPages {
+		urls = append(urls, sitemapURL{Loc: absoluteURL(path)})
+	}
+
+	var categories []struct {
+		Category string
+		Updated  time.Time
+	}
+	if _, err := dbFor(r).Select(&categories, "SELECT Category, max(Updated) AS Updated FROM products WHERE Category <> '' GROUP BY Category ORDER BY Category"); err != nil {
+		return nil, err
+	}
+	for _, c := range categories {
+		urls = append(urls, sitemapURL{Loc: absoluteURL(categoryPath(c.Category)), LastMod: sitemapDate(c.Updated)})
+	}
+
+	var pages []ContentPage
+	if _, err := dbFor(r).Select(&pages, "SELECT * FROM pages WHERE Status='published' ORDER BY Slug"); err != nil {
+		return nil, err
+	}
+	for _, p := range pages {
+		if _, builtin := builtinPagePaths[p.Slug]; !builtin {
+			urls = append(urls, sitemapURL{Loc: absoluteURL(p.Path()), LastMod: sitemapDate(p.Updated)})
+		}
+	}
+
+	var prods []Product
+	if _, err := dbFor(r).Select(&prods, "SELECT * FROM products ORDER BY Id"); err != nil {
+		return nil, err
+	}
+	for _, p := range prods {
+		urls = append(urls, sitemapURL{Loc: absoluteURL(productPath(p)), LastMod: sitemapDate(p.Updated)})
+	}
+	return urls, nil
+}
+
+// buildSitemaps renders urls as a single urlset, or as an index plus one
+// urlset per sitemapMaxURLs entries.
+func buildSitemaps(urls []sitemapURL) ([][]byte, error) {
+	const xmlns = "http://www.sitemaps.org/schemas/sitemap/0.9"
+	if len(urls) <= sitemapMaxURLs {
+		file, err := encodeSitemap(sitemapURLSet{Xmlns: xmlns, URLs: urls})
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{file}, nil
+	}
+
+	index := sitemapIndex{Xmlns: xmlns}
+	files := [][]byte{nil}
+	for start := 0; start < len(urls); start += sitemapMaxURLs {
+		end := start + sitemapMaxURLs
+		if end > len(urls) {
+			end = len(urls)
+		}
+		file, err := encodeSitemap(sitemapURLSet{Xmlns: xmlns, URLs: urls[start:end]})
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+		loc := absoluteURL(fmt.Sprintf("/sitemap-%d.xml", len(files)-1))
+		index.Sitemaps = append(index.Sitemaps, sitemapURL{Loc: loc, LastMod: sitemapDate(time.Now())})
+	}
+	file, err := encodeSitemap(index)
+	if err != nil {
+		return nil, err
+	}
+	files[0] = file
+	return files, nil
+}
+
+func encodeSitemap(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SitemapHandler serves /sitemap.xml and the numbered /sitemap-N.xml parts.
+func SitemapHandler(w http.ResponseWriter, r *http.Request) error {
+	files, err := sitemaps.get(r)
+	if err != nil {
+		return Internal(err, "The sitemap is unavailable right now.")
+	}
+	n := 0
+	if part, ok := gmux.Vars(r)["part"]; ok {
+		n, _ = strconv.Atoi(part)
+		if n < 1 || n >= len(files) {
+			return NotFound("No such sitemap.")
+		}
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	_, err = w.Write(files[n])
+	return err
+}
+
+// RobotsHandler serves robots.txt, either the file configured with
+// WILDVIEW_ROBOTS_FILE or one built from WILDVIEW_ROBOTS_DISALLOW.
+func RobotsHandler(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if config.RobotsFile != "" {
+		body, err := ioutil.ReadFile(config.RobotsFile)
+		if err != nil {
+			return Internal(err, "robots.txt is unavailable right now.")
+		}
+		_, err = w.Write(body)
+		return err
+	}
+	var buf bytes.Buffer
+	buf.WriteString("User-agent: *\n")
+	for _, path := range config.RobotsDisallow {
+		buf.WriteString("Disallow: " + path + "\n")
+	}
+	buf.WriteString("\nSitemap: " + absoluteURL("/sitemap.xml") + "\n")
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// splitList parses a comma separated setting, dropping blanks.
+func splitList(val string) []string {
+	list := []string{}
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSitemapDate(t *testing.T) {
+	tests := []struct {
+		t    time.Time
+		want string
+	}{
+		{time.Time{}, ""},
+		{time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC), "2026-03-01"},
+		{time.Date(2026, 3, 1, 1, 0, 0, 0, time.FixedZone("CET", 3600*2)), "2026-02-28"},
+	}
+	for _, tt := range tests {
+		if got := sitemapDate(tt.t); got != tt.want {
+			t.Errorf("sitemapDate(%v) = %q, want %q", tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestBuildSitemaps(t *testing.T) {
+	setLocales(t)
+	tests := []struct {
+		urls      int
+		wantFiles int
+	}{
+		{0, 1},
+		{3, 1},
+		{sitemapMaxURLs, 1},
+		{sitemapMaxURLs + 1, 3},
+	}
+	for _, tt := range tests {
+		urls := make([]sitemapURL, tt.urls)
+		for i := range urls {
+			urls[i] = sitemapURL{Loc: "http://example.com/product/" + strconv.Itoa(i) + "/"}
+		}
+		files, err := buildSitemaps(urls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != tt.wantFiles {
+			t.Errorf("%d URLs: %d files, want %d", tt.urls, len(files), tt.wantFiles)
+			continue
+		}
+		if tt.wantFiles == 1 {
+			var set sitemapURLSet
+			if err := xml.Unmarshal(files[0], &set); err != nil || len(set.URLs) != tt.urls {
+				t.Errorf("%d URLs: urlset has %d, %v", tt.urls, len(set.URLs), err)
+			}
+			continue
+		}
+		var index sitemapIndex
+		if err := xml.Unmarshal(files[0], &index); err != nil {
+			t.Fatal(err)
+		}
+		total := 0
+		for i, s := range index.Sitemaps {
+			if want := "http://example.com/sitemap-" + strconv.Itoa(i+1) + ".xml"; s.Loc != want {
+				t.Errorf("index entry %d = %q, want %q", i, s.Loc, want)
+			}
+			var set sitemapURLSet
+			if err := xml.Unmarshal(files[i+1], &set); err != nil {
+				t.Fatal(err)
+			}
+			total += len(set.URLs)
+		}
+		if total != tt.urls {
+			t.Errorf("%d URLs: parts hold %d", tt.urls, total)
+		}
+	}
+}
+
+func TestRobotsHandler(t *testing.T) {
+	setLocales(t)
+	config.RobotsFile, config.RobotsDisallow = "", []string{"/manage/", "/account/"}
+	w := httptest.NewRecorder()
+	if err := RobotsHandler(w, httptest.NewRequest("GET", "/robots.txt", nil)); err != nil {
+		t.Fatal(err)
+	}
+	want := "User-agent: *\nDisallow: /manage/\nDisallow: /account/\n\nSitemap: http://example.com/sitemap.xml\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("robots.txt = %q, want %q", got, want)
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	tests := []struct {
+		val  string
+		want []string
+	}{
+		{"", []string{}},
+		{"/manage/", []string{"/manage/"}},
+		{" /manage/ , ,/account/,", []string{"/manage/", "/account/"}},
+	}
+	for _, tt := range tests {
+		got := splitList(tt.val)
+		if len(got) != len(tt.want) {
+			t.Errorf("splitList(%q) = %q, want %q", tt.val, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("splitList(%q) = %q, want %q", tt.val, got, tt.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	gmux "github.com/gorilla/mux"
+)
+
+// taxClasses are the kinds of goods rates can single out. Products are
+// "standard" unless they are taxed differently somewhere.
+var taxClasses = []string{"standard", "clothing", "zero"}
+
+// TaxRate is a rate for a country, optionally narrowed to a region and to
+// a tax class. The most specific matching rate wins: region over country,
+// then class over every class.
+type TaxRate struct {
+	Id       int64     `db:"Id"`
+	Country  string    `db:"Country,size:2" form:"country" validate:"required"`
+	Region   string    `db:"Region,size:100" form:"region" validate:"max=100"`    // empty for the whole country
+	TaxClass string    `db:"TaxClass,size:32" form:"tax_class" label:"Tax class"` // empty for every class
+	Name     string    `db:"Name" form:"name" validate:"required,max=100"`        // shown to customers, e.g. "VAT"
+	Rate     float64   `db:"Rate" form:"rate" validate:"max=100"`                 // percent
+	Shipping bool      `db:"Shipping" form:"shipping"`                            // shipping charges are taxed too
+	Updated  time.Time `db:"Updated"`
+}
+
+// Validate checks the destination and class exist and normalizes codes
+// to upper case so they compare with addresses.
+func (t *TaxRate) Validate() map[string]string {
+	t.Country, t.Region = strings.ToUpper(t.Country), strings.ToUpper(t.Region)
+	problems := map[string]string{}
+	if _, ok := countryFormats[t.Country]; !ok {
+		problems["country"] = "We do not deliver to that country."
+	}
+	if t.TaxClass != "" && !contains(taxClasses, t.TaxClass) {
+		problems["tax_class"] = "Tax class must be one of " + strings.Join(taxClasses, ", ") + "."
+	}
+	if t.Rate < 0 {
+		problems["rate"] = "Rate must be at least 0."
+	}
+	return problems
+}
+
+// matches reports whether t applies to goods of class sent to a, and how
+// specifically: 0 when it does not apply.
+func (t TaxRate) matches(a Address, class string) int {
+	if t.Country != a.Country {
+		return 0
+	}
+	score := 1
+	if t.Region != "" {
+		if !strings.EqualFold(t.Region, a.Region) {
+			return 0
+		}
+		score += 2
+	}
+	if t.TaxClass != "" {
+		if t.TaxClass != class {
+			return 0
+		}
+		score++
+	}
+	return score
+}
+
+// TaxLine is an amount to be taxed, usually a cart line.
+type TaxLine struct {
+	Ref      string // identifies the line in the result
+	TaxClass string
+	Amount   Money
+}
+
+// TaxRequest asks for the tax on lines and shipping sent to Destination.
+// Every amount is in Currency; with Inclusive set they already contain
+// the tax.
+type TaxRequest struct {
+	Destination Address
+	Currency    string
+	Lines       []TaxLine
+	Shipping    Money
+	Inclusive   bool
+}
+
+// LineTax is the tax on one line of a TaxRequest.
+type LineTax struct {
+	Ref  string
+	Name string
+	Rate float64 // percent
+	Tax  Money
+}
+
+// TaxResult has a LineTax for every line of the request, in order.
+type TaxResult struct {
+	Lines    []LineTax
+	Shipping LineTax
+	Total    Money
+}
+
+// TaxProvider calculates tax. The local one uses the rates in the
+// database; an external tax service can be plugged in by implementing it.
+type TaxProvider interface {
+	Tax(ctx context.Context, req TaxRequest) (TaxResult, error)
+}
+
+// taxProvider is set from config.TaxProvider in main.
+var taxProvider TaxProvider = localTaxProvider{}
+
+// newTaxProvider returns the provider called name.
+func newTaxProvider(name string) TaxProvider {
+	if name == "stub" {
+		return StubTaxProvider{Name: "Tax", Rate: 10}
+	}
+	return localTaxProvider{}
+}
+
+// localTaxProvider applies the rates admins maintain at /manage/tax/.
+type localTaxProvider struct{}
+
+func (localTaxProvider) Tax(ctx context.Context, req TaxRequest) (TaxResult, error) {
+	var rates []TaxRate
+	if _, err := dbmap.WithContext(ctx).Select(&rates, "SELECT * FROM taxrates WHERE Country=?", req.Destination.Country); err != nil {
+		return TaxResult{}, err
+	}
+	rateFor := func(class string) *TaxRate {
+		var best *TaxRate
+		bestScore := 0
+		for i, t := range rates {
+			if score := t.matches(req.Destination, class); score > bestScore {
+				best, bestScore = &rates[i], score
+			}
+		}
+		return best
+	}
+	result := newTaxResult(req.Currency)
+	for _, line := range req.Lines {
+		lt := LineTax{Ref: line.Ref, Tax: Money{Currency: req.Currency}}
+		if t := rateFor(line.TaxClass); t != nil {
+			lt.Name, lt.Rate = t.Name, t.Rate
+			lt.Tax = taxOn(line.Amount, t.Rate, req.Inclusive)
+		}
+		result.Lines = append(result.Lines, lt)
+		result.Total = result.Total.Add(lt.Tax)
+	}
+	// Shipping follows the rate of standard goods where it is taxed.
+	if t := rateFor("standard"); t != nil && t.Shipping && !req.Shipping.IsZero() {
+		result.Shipping = LineTax{Ref: "shipping", Name: t.Name, Rate: t.Rate, Tax: taxOn(req.Shipping, t.Rate, req.Inclusive)}
+		result.Total = result.Total.Add(result.Shipping.Tax)
+	}
+	return result, nil
+}
+
+// StubTaxProvider charges one rate on everything, shipping included,
+// without touching the database. It stands in for a tax service in tests
+// and development.
+type StubTaxProvider struct {
+	Name string
+	Rate float64
+}
+
+func (s StubTaxProvider) Tax(ctx context.Context, req TaxRequest) (TaxResult, error) {
+	result := newTaxResult(req.Currency)
+	for _, line := range req.Lines {
+		lt := LineTax{Ref: line.Ref, Name: s.Name, Rate: s.Rate, Tax: taxOn(line.Amount, s.Rate, req.Inclusive)}
+		result.Lines = append(result.Lines, lt)
+		result.Total = result.Total.Add(lt.Tax)
+	}
+	if !req.Shipping.IsZero() {
+		result.Shipping = LineTax{Ref: "shipping", Name: s.Name, Rate: s.Rate, Tax: taxOn(req.Shipping, s.Rate, req.Inclusive)}
+		result.Total = result.Total.Add(result.Shipping.Tax)
+	}
+	return result, nil
+}
+
+// newTaxResult is a result with no tax yet, in currency.
+func newTaxResult(currency string) TaxResult {
+	zero := Money{Currency: currency}
+	return TaxResult{Shipping: LineTax{Ref: "shipping", Tax: zero}, Total: zero}
+}
+
+// taxOn is the tax at rate percent on amount, which is either before tax
+// or, when inclusive, already contains it.
+func taxOn(amount Money, rate float64, inclusive bool) Money {
+	if inclusive {
+		net := Money{int64(math.Round(float64(amount.Amount) / (1 + rate/100))), amount.Currency}
+		return amount.Sub(net)
+	}
+	return amount.Percent(rate)
+}
+
+// taxNote tells customers whether the prices they see include tax.
+func taxNote() string {
+	if config.PricesIncludeTax {
+		return "incl. tax"
+	}
+	return "plus tax"
+}
+
+// defaultTaxRates are seeded into an empty taxrates table.
+var defaultTaxRates = []TaxRate{
+	{Country: "US", Region: "CA", Name: "Sales tax", Rate: 7.25},
+	{Country: "US", Region: "NY", Name: "Sales tax", Rate: 4, Shipping: true},
+	{Country: "US", Region: "PA", Name: "Sales tax", Rate: 6, Shipping: true},
+	{Country: "US", Region: "PA", TaxClass: "clothing", Name: "Sales tax", Rate: 0},
+	{Country: "CA", Name: "GST", Rate: 5, Shipping: true},
+	{Country: "GB", Name: "VAT", Rate: 20, Shipping: true},
+	{Country: "GB", TaxClass: "clothing", Name: "VAT", Rate: 0},
+	{Country: "IE", Name: "VAT", Rate: 23, Shipping: true},
+	{Country: "IE", TaxClass: "clothing", Name: "VAT", Rate: 0},
+	{Country: "DE", Name: "MwSt", Rate: 19, Shipping: true},
+	{Country: "FR", Name: "TVA", Rate: 20, Shipping: true},
+	{Country: "NL", Name: "BTW", Rate: 21, Shipping: true},
+	{Country: "AU", Name: "GST", Rate: 10, Shipping: true},
+	{Country: "NZ", Name: "GST", Rate: 15, Shipping: true},
+	{Country: "JP", Name: "Consumption tax", Rate: 10, Shipping: true},
+}
+
+type TaxAdmin struct {
+	Rates     []TaxRate
+	Countries []Country
+	Classes   []string
+	Edit      TaxRate
+	Error     string
+	Fields    map[string]string
+}
+
+type TaxAdminPage struct {
+	User    string
+	Content TaxAdmin
+}
+
+func renderTaxAdmin(w http.ResponseWriter, r *http.Request, status int, edit TaxRate, err error) error {
+	a := TaxAdmin{Countries: countries(), Classes: taxClasses, Edit: edit}
+	if _, lerr := dbFor(r).Select(&a.Rates, "SELECT * FROM taxrates ORDER BY Country, Region, TaxClass"); lerr != nil {
+		return Internal(lerr, "Tax rates are unavailable right now.")
+	}
+	if err != nil {
+		errs := formErrors(err)
+		a.Error, a.Fields = errs.Error, errs.Fields
+	}
+	return renderer.RenderStatus(w, r, status, "manage_tax", TaxAdminPage{User: getStringFromSession(r, "User"), Content: a})
+}
+
+func loadTaxRate(r *http.Request) (*TaxRate, error) {
+	id, _ := strconv.ParseInt(gmux.Vars(r)["id"], 10, 64)
+	obj, err := dbFor(r).Get(TaxRate{}, id)
+	if err != nil {
+		return nil, Internal(err, "The tax rate could not be loaded.")
+	}
+	if obj == nil {
+		return nil, NotFound("Tax rate %d does not exist.", id)
+	}
+	return obj.(*TaxRate), nil
+}
+
+// ManageTaxHandler lists the tax rates next to a form for adding one, or
+// for editing the one given by {id}.
+func ManageTaxHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	edit := TaxRate{Country: "US"}
+	if gmux.Vars(r)["id"] != "" {
+		t, err := loadTaxRate(r)
+		if err != nil {
+			return err
+		}
+		edit = *t
+	}
+	return renderTaxAdmin(w, r, http.StatusOK, edit, nil)
+}
+
+// SaveTaxRateHandler creates a rate, or updates it when the route has an
+// {id}. There is at most one rate per country, region and class.
+func SaveTaxRateHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	t := &TaxRate{}
+	if gmux.Vars(r)["id"] != "" {
+		var err error
+		if t, err = loadTaxRate(r); err != nil {
+			return err
+		}
+	}
+	if err := bind(r, t); err != nil {
+		return renderTaxAdmin(w, r, http.StatusBadRequest, *t, err)
+	}
+	count, err := dbFor(r).SelectInt("SELECT count(*) FROM taxrates WHERE Country=? AND Region=? AND TaxClass=? AND Id<>?",
+		t.Country, t.Region, t.TaxClass, t.Id)
+	if err != nil {
+		return Internal(err, "The tax rate could not be saved.")
+	}
+	if count > 0 {
+		return renderTaxAdmin(w, r, http.StatusBadRequest, *t, Validation("There is already a rate for that country, region and class."))
+	}
+	t.Updated = time.Now()
+	if t.Id == 0 {
+		err = dbFor(r).Insert(t)
+	} else {
+		_, err = dbFor(r).Update(t)
+	}
+	if err != nil {
+		return Internal(err, "The tax rate could not be saved.")
+	}
+	http.Redirect(w, r, "/manage/tax/", http.StatusSeeOther)
+	return nil
+}
+
+func DeleteTaxRateHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireAdmin(w, r); err != nil {
+		return err
+	}
+	t, err := loadTaxRate(r)
+	if err != nil {
+		return err
+	}
+	if _, err := dbFor(r).Delete(t); err != nil {
+		return Internal(err, "The tax rate could not be deleted.")
+	}
+	http.Redirect(w, r, "/manage/tax/", http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestTaxOn(t *testing.T) {
+	tests := []struct {
+		amount    int64
+		rate      float64
+		inclusive bool
+		want      int64
+	}{
+		{1000, 19, false, 190},
+		{1190, 19, true, 190},
+		{999, 8.25, false, 82},
+		{1082, 8.25, true, 82},
+		{1000, 0, false, 0},
+		{1000, 0, true, 0},
+		{0, 20, true, 0},
+		// The tax and the net amount always add up to the gross one.
+		{1, 20, true, 0},
+		{5, 20, true, 1},
+	}
+	for _, tt := range tests {
+		if got := taxOn(Money{tt.amount, "EUR"}, tt.rate, tt.inclusive); got != (Money{tt.want, "EUR"}) {
+			t.Errorf("taxOn(%d, %v, %v) = %v, want %d", tt.amount, tt.rate, tt.inclusive, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// signToken returns an HMAC of value for the given purpose, so links in
+// emails can be trusted without storing a token per recipient. The
+// purpose keeps a token for one action from being replayed for another.
+func signToken(purpose, value string) string {
+	mac := hmac.New(sha256.New, []byte(config.Secret))
+	mac.Write([]byte(purpose + "\x00" + value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func verifyToken(purpose, value, token string) bool {
+	return hmac.Equal([]byte(signToken(purpose, value)), []byte(token))
+}
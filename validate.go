@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Form-bound structs describe their inputs with struct tags:
+//
+//	form:"email"                  the form or JSON field the value comes from
+//	label:"Email"                 the name used in error messages
+//	validate:"required,email"     comma separated rules, checked in order
+//
+// Rules: required, email, phone (normalized to E.164 in place), password,
+// min=N and max=N (length in characters, or value for numbers) and
+// oneof=a|b|c. Empty optional values skip the remaining rules.
+//
+// Strings, bools, numbers and times can be bound. Times are read in the
+// format of datetime-local inputs, or as a date alone; a *time.Time is
+// left nil when the input is empty.
+
+// fieldValidator is implemented by form-bound structs with rules that do
+// not fit in a tag, such as ones depending on another field. Validate
+// may normalize fields and returns messages keyed by form field name.
+type fieldValidator interface {
+	Validate() map[string]string
+}
+
+// maxBodyBytes caps the size of a JSON body bind will read.
+const maxBodyBytes = 1 << 20
+
+// bind fills the form-tagged fields of dst, a pointer to a struct, from
+// a JSON body or from the form values, then validates it. Fields missing
+// from the request keep their current value, so bind can update a loaded
+// row. The error has a message for every field that failed.
+func bind(r *http.Request, dst interface{}) error {
+	values, err := requestValues(r)
+	if err != nil {
+		return err
+	}
+	v := reflect.ValueOf(dst).Elem()
+	t := v.Type()
+	fields := map[string]string{}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name := sf.Tag.Get("form")
+		if name == "" {
+			continue
+		}
+		raw, ok := values(name)
+		if !ok {
+			// An unticked checkbox is not posted at all.
+			if sf.Type.Kind() != reflect.Bool || isJSON(r) {
+				continue
+			}
+			raw = ""
+		}
+		if strings.Contains(sf.Tag.Get("validate"), "password") {
+			// Passwords are kept exactly as typed.
+			v.Field(i).SetString(raw)
+			continue
+		}
+		if err := setField(v.Field(i), raw); err != nil {
+			fields[name] = fieldLabel(sf) + " " + err.Error() + "."
+		}
+	}
+	return validateFields(v, fields)
+}
+
+// formErrors is what a page re-rendering its form shows for err.
+func formErrors(err error) ContentReturn {
+	appErr := asAppError(err)
+	return ContentReturn{Error: appErr.Message, Fields: appErr.Fields}
+}
+
+func isJSON(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+}
+
+func requestValues(r *http.Request) (func(name string) (string, bool), error) {
+	if isJSON(r) {
+		body := map[string]interface{}{}
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxBodyBytes)).Decode(&body); err != nil {
+			return nil, Validation("The request body is not valid JSON.")
+		}
+		for _, name := range guardFields {
+			if s, ok := body[name].(string); ok {
+				if r.Form == nil {
+					r.Form = url.Values{}
+				}
+				r.Form.Set(name, s)
+			}
+		}
+		return func(name string) (string, bool) {
+			val, ok := body[name]
+			if !ok || val == nil {
+				return "", false
+			}
+			if s, isString := val.(string); isString {
+				return s, true
+			}
+			return fmt.Sprint(val), true
+		}, nil
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, Validation("The form could not be read.")
+	}
+	return func(name string) (string, bool) {
+		vals, ok := r.Form[name]
+		if !ok || len(vals) == 0 {
+			return "", false
+		}
+		return vals[0], true
+	}, nil
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// formTimeLayouts are the ways a time can be posted, most precise first.
+var formTimeLayouts = []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"}
+
+func parseFormTime(raw string) (time.Time, error) {
+	for _, layout := range formTimeLayouts {
+		if t, err := time.ParseInLocation(layout, strings.TrimSpace(raw), time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("must be a date and time")
+}
+
+// formTime writes a time.Time or *time.Time the way a datetime-local input
+// expects it, and nothing for a zero or nil time.
+func formTime(v interface{}) string {
+	var t time.Time
+	switch v := v.(type) {
+	case time.Time:
+		t = v
+	case *time.Time:
+		if v != nil {
+			t = *v
+		}
+	}
+	if t.IsZero() {
+		return ""
+	}
+	return t.In(time.Local).Format("2006-01-02T15:04")
+}
+
+// setField stores raw in f, or says what raw should have been.
+func setField(f reflect.Value, raw string) error {
+	if f.Type() == timeType || f.Type() == reflect.PtrTo(timeType) {
+		if strings.TrimSpace(raw) == "" {
+			f.Set(reflect.Zero(f.Type()))
+			return nil
+		}
+		t, err := parseFormTime(raw)
+		if err != nil {
+			return err
+		}
+		if f.Kind() == reflect.Ptr {
+			f.Set(reflect.ValueOf(&t))
+		} else {
+			f.Set(reflect.ValueOf(t))
+		}
+		return nil
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(strings.TrimSpace(raw))
+	case reflect.Bool:
+		f.SetBool(raw != "" && raw != "false" && raw != "0")
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+		if err != nil {
+			return fmt.Errorf("must be a whole number")
+		}
+		f.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil {
+			return fmt.Errorf("must be a number")
+		}
+		f.SetFloat(n)
+	default:
+		return fmt.Errorf("cannot bind %s", f.Kind())
+	}
+	return nil
+}
+
+func fieldLabel(sf reflect.StructField) string {
+	if label := sf.Tag.Get("label"); label != "" {
+		return label
+	}
+	return sf.Name
+}
+
+// validateFields applies the validate rules of every field of v, adding
+// to the problems already found while binding.
+func validateFields(v reflect.Value, fields map[string]string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		rules := sf.Tag.Get("validate")
+		if rules == "" {
+			continue
+		}
+		name := sf.Tag.Get("form")
+		if name == "" {
+			name = sf.Name
+		}
+		if _, failed := fields[name]; failed {
+			continue
+		}
+		if problem := checkRules(v.Field(i), strings.Split(rules, ",")); problem != "" {
+			fields[name] = fieldLabel(sf) + " " + problem + "."
+		}
+	}
+	if fv, ok := v.Addr().Interface().(fieldValidator); ok && len(fields) == 0 {
+		for name, msg := range fv.Validate() {
+			fields[name] = msg
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	// Report the problems in the order the fields are declared.
+	var msgs []string
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("form")
+		if name == "" {
+			name = t.Field(i).Name
+		}
+		if msg, ok := fields[name]; ok {
+			msgs = append(msgs, msg)
+		}
+	}
+	return &AppError{Kind: KindValidation, Message: strings.Join(msgs, " "), Fields: fields}
+}
+
+// checkRules returns what is wrong with f, or "".
+func checkRules(f reflect.Value, rules []string) string {
+	for _, rule := range rules {
+		name, arg := rule, ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			name, arg = rule[:i], rule[i+1:]
+		}
+		if isZero(f) {
+			if name == "required" {
+				return "is required"
+			}
+			return ""
+		}
+		if problem := checkRule(f, name, arg); problem != "" {
+			return problem
+		}
+	}
+	return ""
+}
+
+func isZero(f reflect.Value) bool {
+	if f.Kind() == reflect.String {
+		return strings.TrimSpace(f.String()) == ""
+	}
+	return f.IsZero()
+}
+
+func checkRule(f reflect.Value, name, arg string) string {
+	switch name {
+	case "required":
+		return ""
+	case "email":
+		addr, err := mail.ParseAddress(f.String())
+		if err != nil || addr.Address != f.String() {
+			return "must be a valid email address"
+		}
+	case "phone":
+		phone, ok := normalizePhone(f.String())
+		if !ok {
+			return "must be a phone number with area code"
+		}
+		f.SetString(phone)
+	case "password":
+		return passwordProblem(f.String())
+	case "min", "max":
+		limit, _ := strconv.ParseFloat(arg, 64)
+		var n float64
+		unit := " characters"
+		switch f.Kind() {
+		case reflect.String:
+			n = float64(utf8.RuneCountInString(f.String()))
+		case reflect.Int, reflect.Int64:
+			n, unit = float64(f.Int()), ""
+		case reflect.Float64:
+			n, unit = f.Float(), ""
+		}
+		if name == "min" && n < limit {
+			return "must be at least " + arg + unit
+		}
+		if name == "max" && n > limit {
+			return "must be at most " + arg + unit
+		}
+	case "oneof":
+		if !contains(strings.Split(arg, "|"), f.String()) {
+			return "must be one of " + strings.Replace(arg, "|", ", ", -1)
+		}
+	default:
+		panic("unknown validation rule " + name)
+	}
+	return ""
+}
+
+// normalizePhone turns a phone number as people type it into E.164.
+// Numbers without a country code get config.PhoneCountryCode.
+func normalizePhone(phone string) (string, bool) {
+	phone = strings.TrimSpace(phone)
+	international := strings.HasPrefix(phone, "+") || strings.HasPrefix(phone, "00")
+	var digits strings.Builder
+	for _, c := range phone {
+		switch {
+		case c >= '0' && c <= '9':
+			digits.WriteRune(c)
+		case c == '+' || c == ' ' || c == '-' || c == '.' || c == '(' || c == ')':
+		default:
+			return "", false
+		}
+	}
+	number := digits.String()
+	if strings.HasPrefix(phone, "00") {
+		number = number[2:]
+	}
+	if !international {
+		number = config.PhoneCountryCode + strings.TrimPrefix(number, "0")
+	}
+	if len(number) < 8 || len(number) > 15 || number[0] == '0' {
+		return "", false
+	}
+	return "+" + number, true
+}
+
+// passwordProblem asks for at least eight characters mixing letters with
+// digits or symbols.
+func passwordProblem(password string) string {
+	if utf8.RuneCountInString(password) < 8 {
+		return "must be at least 8 characters"
+	}
+	var letter, other bool
+	for _, c := range password {
+		if unicode.IsLetter(c) {
+			letter = true
+		} else if !unicode.IsSpace(c) {
+			other = true
+		}
+	}
+	if !letter || !other {
+		return "must mix letters with digits or symbols"
+	}
+	return ""
+}
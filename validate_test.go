@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestNormalizePhone(t *testing.T) {
+	saved := config.PhoneCountryCode
+	defer func() { config.PhoneCountryCode = saved }()
+	config.PhoneCountryCode = "1"
+	tests := []struct {
+		in, want string
+	}{
+		{"(555) 123-4567", "+15551234567"},
+		{"0555 123 4567", "+15551234567"},
+		{"555.123.4567", "+15551234567"},
+		{"+44 20 7946 0958", "+442079460958"},
+		{"0044 20 7946 0958", "+442079460958"},
+	}
+	for _, tt := range tests {
+		if got, ok := normalizePhone(tt.in); !ok || got != tt.want {
+			t.Errorf("normalizePhone(%q) = %q, %v, want %q", tt.in, got, ok, tt.want)
+		}
+	}
+	for _, bad := range []string{"", "abc", "555 CALL NOW", "+0123456789", "+1234567890123456", "+1 23"} {
+		if got, ok := normalizePhone(bad); ok {
+			t.Errorf("normalizePhone(%q) = %q, want it rejected", bad, got)
+		}
+	}
+}
+
+func TestPasswordProblem(t *testing.T) {
+	tests := []struct {
+		password, want string
+	}{
+		{"longenough1", ""},
+		{"pass word!", ""},
+		{"pässwört1", ""},
+		{"short1", "must be at least 8 characters"},
+		{"longenough", "must mix letters with digits or symbols"},
+		{"12345678", "must mix letters with digits or symbols"},
+		{"        1", "must mix letters with digits or symbols"},
+	}
+	for _, tt := range tests {
+		if got := passwordProblem(tt.password); got != tt.want {
+			t.Errorf("passwordProblem(%q) = %q, want %q", tt.password, got, tt.want)
+		}
+	}
+}